@@ -0,0 +1,290 @@
+// Package audit writes a tamper-evident, append-only trail of security events.
+//
+// Records are stored one JSON object per line in numbered files (audit-000001.jsonl, ...).
+// Every record carries a sequence number and the SHA-256 hash of its own content, which
+// includes the hash of the previous record, so that editing, removing or reordering records
+// breaks the chain. The chain continues across rotated files. Verify checks a directory;
+// to also detect truncation of the newest records, keep the last hash it reports somewhere
+// outside the log directory and pass it back as the anchor.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBytes is the size at which a file is rotated when Options.MaxBytes is zero
+const DefaultMaxBytes = 10 << 20
+
+const (
+	filePrefix = "audit-"
+	fileSuffix = ".jsonl"
+)
+
+// Record is one audited event. Seq, PrevHash and Hash are set by Log.Append.
+type Record struct {
+	Seq           uint64    `json:"seq"`
+	Time          time.Time `json:"time"`
+	Type          string    `json:"type"`
+	Phase         string    `json:"phase,omitempty"`
+	SessionID     string    `json:"session_id,omitempty"`
+	User          string    `json:"user,omitempty"`
+	KeyThumbprint string    `json:"key_thumbprint,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	ProviderID    string    `json:"provider_id,omitempty"`
+	Initiator     string    `json:"initiator,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash"`
+}
+
+// computeHash returns the hash of the record content (everything but Hash)
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Options configures Open
+type Options struct {
+	// Dir holds the audit files. It is created if missing.
+	Dir string
+	// MaxBytes is the size after which a new file is started (DefaultMaxBytes when zero)
+	MaxBytes int64
+	// MaxFiles is the number of files kept; older files are removed on rotation. Zero keeps all files.
+	MaxFiles int
+}
+
+// Log appends hash-chained records to the files in a directory
+type Log struct {
+	options Options
+
+	mu       sync.Mutex
+	file     *os.File
+	index    int
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+// Open opens the audit log in options.Dir and continues the chain of the records already there
+func Open(options Options) (*Log, error) {
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(options.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	files, err := Files(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{options: options, index: 1}
+	if len(files) > 0 {
+		l.index = fileIndex(files[len(files)-1])
+	}
+	// 最新のファイルが空の場合 (ローテーション直後) はその前のファイルから続きを探す
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			l.seq = last.Seq
+			l.lastHash = last.Hash
+			break
+		}
+	}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append completes record with its sequence number and hashes and writes it
+func (l *Log) Append(record Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit: log is closed")
+	}
+
+	record.Seq = l.seq + 1
+	record.Time = record.Time.UTC()
+	record.PrevHash = l.lastHash
+	hash, err := record.computeHash()
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	if len(line) > maxLineSize {
+		return fmt.Errorf("audit: %s record of %d bytes exceeds %d", record.Type, len(line), maxLineSize)
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.options.MaxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	l.seq = record.Seq
+	l.lastHash = record.Hash
+	return nil
+}
+
+// LastHash returns the hash of the newest record
+func (l *Log) LastHash() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastHash
+}
+
+// Close flushes and closes the current file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+func (l *Log) openFile() error {
+	file, err := os.OpenFile(filePath(l.options.Dir, l.index), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("audit: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate starts the next file and removes the files beyond MaxFiles
+func (l *Log) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	l.file = nil
+	l.index++
+	if err := l.openFile(); err != nil {
+		return err
+	}
+
+	if l.options.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := Files(l.options.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > l.options.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Files returns the audit files in dir, oldest first
+func Files(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && fileIndex(entry.Name()) > 0 {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	slices.SortFunc(files, func(a, b string) int {
+		return fileIndex(a) - fileIndex(b)
+	})
+	return files, nil
+}
+
+func filePath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", filePrefix, index, fileSuffix))
+}
+
+// fileIndex returns the number of an audit file name, or 0 if name is not an audit file
+func fileIndex(name string) int {
+	name = filepath.Base(name)
+	if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+		return 0
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+	if err != nil || index <= 0 {
+		return 0
+	}
+	return index
+}
+
+// lastRecord returns the newest record of a file, or nil if the file is empty.
+// Oversized lines are skipped; Verify reports them.
+func lastRecord(path string) (*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := newLineReader(file)
+	for scanner.Scan() {
+		if !scanner.Oversized() && len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit: %s: %w", path, err)
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var record Record
+	if err := json.Unmarshal(last, &record); err != nil {
+		return nil, fmt.Errorf("audit: %s: last record is corrupt, run verify-audit: %w", path, err)
+	}
+	return &record, nil
+}
@@ -0,0 +1,230 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendRecords(t *testing.T, log *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := log.Append(Record{Time: time.Unix(int64(i), 0), Type: "refreshed", SessionID: "session", User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verify(t *testing.T, dir, anchor string) *Report {
+	t.Helper()
+	report, err := Verify(dir, anchor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	content := strings.Join(lines, "")
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainAcrossRotationAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(Options{Dir: dir, MaxBytes: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 5)
+	log.Close()
+
+	// 再オープン後もチェーンが続く
+	log, err = Open(Options{Dir: dir, MaxBytes: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 5)
+	lastHash := log.LastHash()
+	log.Close()
+
+	files, _ := Files(dir)
+	if len(files) < 3 {
+		t.Fatalf("files = %d, want rotation into at least 3", len(files))
+	}
+	report := verify(t, dir, lastHash)
+	if !report.OK() || report.Records != 10 || report.FirstSeq != 1 || report.LastSeq != 10 || report.LastHash != lastHash {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(Options{Dir: dir, MaxBytes: 300, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 10)
+	log.Close()
+
+	files, _ := Files(dir)
+	if len(files) != 2 {
+		t.Fatalf("files = %d, want 2", len(files))
+	}
+	// 古いファイルの削除は改ざんとはみなさない
+	if report := verify(t, dir, ""); !report.OK() || report.FirstSeq == 1 || report.LastSeq != 10 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	for name, test := range map[string]struct {
+		tamper func(lines []string) []string
+		want   string
+	}{
+		"modified": {
+			tamper: func(lines []string) []string {
+				lines[2] = strings.Replace(lines[2], `"user":"alice"`, `"user":"mallory"`, 1)
+				return lines
+			},
+			want: "hash mismatch",
+		},
+		"removed": {
+			tamper: func(lines []string) []string {
+				return append(lines[:2], lines[3:]...)
+			},
+			want: "sequence gap",
+		},
+		"reordered": {
+			tamper: func(lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			want: "chain broken",
+		},
+		"head removed": {
+			tamper: func(lines []string) []string {
+				return lines[1:]
+			},
+			want: "does not start with the first record",
+		},
+		"malformed": {
+			tamper: func(lines []string) []string {
+				lines[3] = "{\n"
+				return lines
+			},
+			want: "malformed record",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			log, err := Open(Options{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendRecords(t, log, 5)
+			log.Close()
+
+			path := filepath.Join(dir, "audit-000001.jsonl")
+			writeLines(t, path, test.tamper(readLines(t, path)))
+
+			report := verify(t, dir, "")
+			if report.OK() {
+				t.Fatal("tampering not detected")
+			}
+			for _, problem := range report.Problems {
+				if strings.Contains(problem.Message, test.want) {
+					return
+				}
+			}
+			t.Errorf("problems = %v, want %q", report.Problems, test.want)
+		})
+	}
+}
+
+func TestVerifyDetectsTruncationWithAnchor(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 5)
+	anchor := log.LastHash()
+	log.Close()
+
+	path := filepath.Join(dir, "audit-000001.jsonl")
+	writeLines(t, path, readLines(t, path)[:4])
+
+	if report := verify(t, dir, ""); !report.OK() {
+		t.Fatalf("truncated log without anchor: %+v", report)
+	}
+	if report := verify(t, dir, anchor); report.OK() {
+		t.Fatal("truncation not detected with the anchor")
+	}
+}
+
+func TestOpenRejectsCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 2)
+	log.Close()
+
+	path := filepath.Join(dir, "audit-000001.jsonl")
+	lines := readLines(t, path)
+	writeLines(t, path, append(lines, `{"seq":3,"ty`))
+	if _, err := Open(Options{Dir: dir}); err == nil {
+		t.Fatal("Open must fail on a corrupt last record")
+	}
+}
+
+func TestOversizedLine(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, log, 2)
+	if err := log.Append(Record{Type: "refreshed", UserAgent: strings.Repeat("<", maxLineSize)}); err == nil {
+		t.Error("oversized record was appended")
+	}
+	log.Close()
+
+	// 書き込まれてしまった長すぎる行は、検証を止めずに問題として報告する
+	path := filepath.Join(dir, "audit-000001.jsonl")
+	lines := readLines(t, path)
+	writeLines(t, path, []string{lines[0], strings.Repeat("x", maxLineSize+1) + "\n", lines[1]})
+
+	report := verify(t, dir, "")
+	if report.OK() || report.Records != 2 || len(report.Problems) != 1 || report.Problems[0].Line != 2 ||
+		!strings.Contains(report.Problems[0].Message, "longer than") {
+		t.Fatalf("report = %+v", report)
+	}
+
+	log, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open with an oversized line: %v", err)
+	}
+	defer log.Close()
+	if log.seq != 2 {
+		t.Errorf("seq = %d, want the chain to continue after record 2", log.seq)
+	}
+}
@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// maxLineSize bounds a single record. Append refuses longer records, and readers skip
+// longer lines instead of failing on them.
+const maxLineSize = 1 << 20
+
+// lineReader reads the lines of an audit file like bufio.Scanner, but reports a line longer
+// than maxLineSize as Oversized instead of stopping, so that one such line does not make
+// the rest of the file unreadable
+type lineReader struct {
+	reader    *bufio.Reader
+	line      []byte
+	oversized bool
+	err       error
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{reader: bufio.NewReader(r)}
+}
+
+// Scan reads the next line, reporting false at the end of the input or on an error
+func (l *lineReader) Scan() bool {
+	l.line, l.oversized = l.line[:0], false
+	read := false
+	for {
+		chunk, err := l.reader.ReadSlice('\n')
+		read = read || len(chunk) > 0
+		// 長すぎる行は読み飛ばし、改行までのデータを保持しない
+		if !l.oversized && len(l.line)+len(chunk) > maxLineSize+2 {
+			l.oversized, l.line = true, l.line[:0]
+		}
+		if !l.oversized {
+			l.line = append(l.line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF:
+			if !read {
+				return false
+			}
+		case err != nil:
+			l.err = err
+			return false
+		}
+		l.line = bytes.TrimSuffix(bytes.TrimSuffix(l.line, []byte("\n")), []byte("\r"))
+		if len(l.line) > maxLineSize {
+			l.oversized, l.line = true, l.line[:0]
+		}
+		return true
+	}
+}
+
+// Bytes returns the current line without the line ending (empty when Oversized)
+func (l *lineReader) Bytes() []byte {
+	return l.line
+}
+
+// Oversized reports whether the current line is longer than maxLineSize
+func (l *lineReader) Oversized() bool {
+	return l.oversized
+}
+
+// Err returns the error that stopped Scan, if any
+func (l *lineReader) Err() error {
+	return l.err
+}
+
+// Problem is an inconsistency found by Verify
+type Problem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// Report is the result of Verify
+type Report struct {
+	Files    int       `json:"files"`
+	Records  int       `json:"records"`
+	FirstSeq uint64    `json:"first_seq"`
+	LastSeq  uint64    `json:"last_seq"`
+	LastHash string    `json:"last_hash"`
+	Problems []Problem `json:"problems"`
+}
+
+// OK reports whether the chain is intact
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify checks the records of every audit file in dir: each record must hash to its Hash,
+// link to the previous record and follow its sequence number. The first record may start
+// after 1 when older files were removed by the MaxFiles retention.
+//
+// anchor is optional: the hash of a record saved outside the log directory (for example the
+// last hash reported by an earlier run). A missing anchor means the log was truncated or replaced.
+func Verify(dir string, anchor string) (*Report, error) {
+	files, err := Files(dir)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{report: &Report{Files: len(files), Problems: []Problem{}}, anchor: anchor}
+	// 最初のファイルが削除されていなければ、チェーンは seq 1 から始まる
+	v.genesis = len(files) > 0 && fileIndex(files[0]) == 1
+	for _, path := range files {
+		if err := v.verifyFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if anchor != "" && !v.anchored {
+		v.report.Problems = append(v.report.Problems, Problem{Message: "anchor record not found (log truncated or replaced)"})
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	report  *Report
+	genesis bool
+	seq     uint64
+	hash    string
+
+	anchor   string
+	anchored bool
+}
+
+func (v *verifier) verifyFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	defer file.Close()
+	return v.verify(filepath.Base(path), file)
+}
+
+func (v *verifier) verify(name string, r io.Reader) error {
+	problem := func(line int, seq uint64, format string, args ...any) {
+		v.report.Problems = append(v.report.Problems, Problem{File: name, Line: line, Seq: seq, Message: fmt.Sprintf(format, args...)})
+	}
+
+	scanner := newLineReader(r)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Oversized() {
+			problem(line, 0, "record longer than %d bytes", maxLineSize)
+			continue
+		}
+		if len(scanner.Bytes()) == 0 {
+			problem(line, 0, "empty line")
+			continue
+		}
+		var record Record
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			problem(line, 0, "malformed record: %v", err)
+			continue
+		}
+
+		if hash, err := record.computeHash(); err != nil || hash != record.Hash {
+			problem(line, record.Seq, "record was modified (hash mismatch)")
+		}
+		if v.report.Records == 0 {
+			v.report.FirstSeq = record.Seq
+			if v.genesis && (record.Seq != 1 || record.PrevHash != "") {
+				problem(line, record.Seq, "log does not start with the first record (seq 1)")
+			}
+		} else {
+			if record.Seq != v.seq+1 {
+				problem(line, record.Seq, "sequence gap: expected %d, got %d", v.seq+1, record.Seq)
+			}
+			if record.PrevHash != v.hash {
+				problem(line, record.Seq, "chain broken: prev_hash does not match the previous record")
+			}
+		}
+		// 改ざんされたレコードの後も、記録されたハッシュで検証を続ける
+		v.seq = record.Seq
+		v.hash = record.Hash
+		if v.anchor != "" && record.Hash == v.anchor {
+			v.anchored = true
+		}
+		v.report.Records++
+		v.report.LastSeq = record.Seq
+		v.report.LastHash = record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("audit: %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Command dbsc-client logs in to a DBSC server with a software key and calls a protected endpoint,
+// refreshing the bound session like a browser would.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"dbsc-demo/dbscclient"
+)
+
+func main() {
+	base := flag.String("base", "http://localhost:8080", "base URL of the DBSC server")
+	username := flag.String("username", "test", "login username")
+	password := flag.String("password", "test", "login password")
+	path := flag.String("path", "/api/check_dbsc_session", "protected path to request after login")
+	algorithm := flag.String("alg", dbscclient.AlgorithmES256, "key algorithm (ES256 or RS256)")
+	repeat := flag.Int("repeat", 3, "number of requests to the protected path")
+	interval := flag.Duration("interval", 6*time.Second, "interval between requests (longer than the cookie lifetime forces a refresh)")
+	flag.Parse()
+
+	client, err := dbscclient.New(*algorithm)
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	client.OnRegistrationError = func(err error) {
+		log.Printf("registration failed: %v", err)
+	}
+
+	res, err := client.PostForm(*base+"/login", url.Values{"username": {*username}, "password": {*password}})
+	if err != nil {
+		log.Fatalf("login failed: %v", err)
+	}
+	res.Body.Close()
+	fmt.Printf("login: %s\n", res.Status)
+	for _, session := range client.Sessions() {
+		fmt.Printf("registered session: %s (refresh: %s)\n", session.ID, session.RefreshURL)
+	}
+
+	for i := 0; i < *repeat; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		res, err := client.Get(*base + *path)
+		if err != nil {
+			log.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Printf("%s: %s %s\n", *path, res.Status, strings.TrimSpace(string(body)))
+	}
+}
@@ -0,0 +1,50 @@
+// Command dbsc-conformance checks the DBSC behaviour of a server and prints a pass/fail report.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"dbsc-demo/conformance"
+)
+
+func main() {
+	base := flag.String("base", "http://localhost:8080", "base URL of the server under test")
+	loginPath := flag.String("login-path", "/login", "path receiving the login form and answering with Sec-Session-Registration")
+	username := flag.String("username", "test", "login username")
+	password := flag.String("password", "test", "login password")
+	protectedPath := flag.String("protected-path", "/api/check_dbsc_session", "path requiring the bound cookie")
+	algorithm := flag.String("alg", "ES256", "key algorithm (ES256 or RS256)")
+	format := flag.String("format", "text", "report format (text or json)")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each check")
+	flag.Parse()
+
+	config := conformance.DefaultConfig(*base)
+	config.LoginPath = *loginPath
+	config.LoginForm = url.Values{"username": {*username}, "password": {*password}}
+	config.ProtectedPath = *protectedPath
+	config.Algorithm = *algorithm
+	config.Timeout = *timeout
+
+	report := conformance.Run(context.Background(), config)
+
+	var err error
+	switch *format {
+	case "text":
+		err = report.WriteText(os.Stdout)
+	case "json":
+		err = report.WriteJSON(os.Stdout)
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatalf("failed to write report: %v", err)
+	}
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
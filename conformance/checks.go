@@ -0,0 +1,619 @@
+package conformance
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc/formats"
+)
+
+type check struct {
+	name        string
+	description string
+	run         func(ctx context.Context, r *runner) error
+}
+
+var checks = []check{
+	{"registration-header-syntax", "login response carries a valid Sec-Session-Registration header", checkRegistrationHeaderSyntax},
+	{"registration-challenge-freshness", "each registration header carries a new challenge", checkRegistrationChallengeFreshness},
+	{"registration-success", "a valid proof registers a session and returns a valid session instruction", checkRegistrationSuccess},
+	{"registration-rejects-bad-signature", "a proof not signed by the key in its key claim is rejected with 4xx", checkRegistrationBadSignature},
+	{"registration-rejects-wrong-audience", "a proof for another audience is rejected with 4xx", checkRegistrationWrongAudience},
+	{"registration-rejects-replay", "a registration proof cannot be used twice", checkRegistrationReplay},
+	{"protected-requires-bound-cookie", "the protected resource is refused without the bound cookie", checkProtectedRequiresCookie},
+	{"refresh-issues-challenge", "refresh without proof answers 401/403 with a Sec-Session-Challenge for the session", checkRefreshIssuesChallenge},
+	{"refresh-challenge-freshness", "a refresh challenge is not issued again after it was used", checkRefreshChallengeFreshness},
+	{"refresh-success", "a valid refresh proof sets a new bound cookie", checkRefreshSuccess},
+	{"refresh-key-binding", "a refresh proof signed by another key is rejected with 4xx", checkRefreshKeyBinding},
+	{"refresh-rejects-replay", "a refresh proof cannot be used twice", checkRefreshReplay},
+	{"refresh-unknown-session", "refresh of an unknown session is rejected with 4xx and no challenge", checkRefreshUnknownSession},
+	{"end-to-end", "a browser-like client keeps access to the protected resource across refreshes", checkEndToEnd},
+}
+
+// runner holds the helpers shared by the checks
+type runner struct {
+	config Config
+}
+
+// session is a registered session under test
+type session struct {
+	client      *http.Client
+	key         crypto.Signer
+	instruction formats.SessionInstructionResponse
+	refreshURL  string
+}
+
+func (r *runner) url(path string) string {
+	return r.config.BaseURL + path
+}
+
+func (r *runner) newHTTPClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+func (r *runner) newKey() (crypto.Signer, error) {
+	return dbscclient.GenerateKey(r.config.Algorithm)
+}
+
+func (r *runner) do(ctx context.Context, client *http.Client, method, rawURL string, headers map[string]string, body io.Reader) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	return res, data, err
+}
+
+// login performs the login and returns the parsed registration entry
+func (r *runner) login(ctx context.Context, client *http.Client) (*formats.SecureSessionRegistrationEntry, error) {
+	res, _, err := r.do(ctx, client, http.MethodPost, r.url(r.config.LoginPath),
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+		strings.NewReader(r.config.LoginForm.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("login request failed: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("login returned status %d", res.StatusCode)
+	}
+	value := res.Header.Get("Sec-Session-Registration")
+	if value == "" {
+		return nil, fmt.Errorf("login response has no Sec-Session-Registration header")
+	}
+	header, err := formats.ParseSecureSessionRegistrationHeader(value)
+	if err != nil {
+		return nil, err
+	}
+	return header[0], nil
+}
+
+func (r *runner) registrationURL(entry *formats.SecureSessionRegistrationEntry) (string, error) {
+	path, err := url.Parse(entry.Params.Path)
+	if err != nil {
+		return "", fmt.Errorf("invalid registration path: %w", err)
+	}
+	base, err := url.Parse(r.url(r.config.LoginPath))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(path).String(), nil
+}
+
+// registrationProof signs a proof for the entry; signer and key claim can differ to forge signatures
+func (r *runner) registrationProof(entry *formats.SecureSessionRegistrationEntry, signer, claimed crypto.Signer, audience string) (string, error) {
+	jwk, err := dbscclient.PublicJWK(claimed)
+	if err != nil {
+		return "", err
+	}
+	return dbscclient.SignProof(signer, dbscclient.ProofClaims{
+		Audience:      audience,
+		JTI:           entry.Params.Challenge,
+		Key:           jwk,
+		Authorization: entry.Params.Authorization,
+	})
+}
+
+func (r *runner) postProof(ctx context.Context, client *http.Client, rawURL string, headers map[string]string) (*http.Response, []byte, error) {
+	return r.do(ctx, client, http.MethodPost, rawURL, headers, nil)
+}
+
+// register logs in and registers a session with a new key
+func (r *runner) register(ctx context.Context) (*session, error) {
+	client := r.newHTTPClient()
+	entry, err := r.login(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	key, err := r.newKey()
+	if err != nil {
+		return nil, err
+	}
+	registrationURL, err := r.registrationURL(entry)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := r.registrationProof(entry, key, key, registrationURL)
+	if err != nil {
+		return nil, err
+	}
+
+	res, body, err := r.postProof(ctx, client, registrationURL, map[string]string{"Sec-Session-Response": proof})
+	if err != nil {
+		return nil, fmt.Errorf("registration request failed: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registration returned status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var instruction formats.SessionInstructionResponse
+	if err := json.Unmarshal(body, &instruction); err != nil {
+		return nil, fmt.Errorf("session instruction is not valid JSON: %w", err)
+	}
+	if err := validateInstruction(instruction); err != nil {
+		return nil, err
+	}
+	if err := expectCookies(res, instruction); err != nil {
+		return nil, err
+	}
+
+	refreshPath, err := url.Parse(instruction.RefreshURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh_url: %w", err)
+	}
+	base, _ := url.Parse(registrationURL)
+	return &session{
+		client:      client,
+		key:         key,
+		instruction: instruction,
+		refreshURL:  base.ResolveReference(refreshPath).String(),
+	}, nil
+}
+
+// challenge asks the refresh endpoint for a challenge of the session
+func (r *runner) challenge(ctx context.Context, s *session) (string, error) {
+	res, _, err := r.postProof(ctx, s.client, s.refreshURL, map[string]string{"Sec-Session-Id": s.instruction.SessionIdentifier})
+	if err != nil {
+		return "", fmt.Errorf("refresh request failed: %w", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden {
+		return "", fmt.Errorf("refresh without proof returned status %d, want 401 or 403", res.StatusCode)
+	}
+	value := res.Header.Get("Sec-Session-Challenge")
+	if value == "" {
+		return "", fmt.Errorf("refresh response has no Sec-Session-Challenge header")
+	}
+	header, err := formats.ParseSecureSessionChallengeHeader(value)
+	if err != nil {
+		return "", err
+	}
+	for _, challenge := range header {
+		if challenge.ID == "" || challenge.ID == s.instruction.SessionIdentifier {
+			return challenge.Challenge, nil
+		}
+	}
+	return "", fmt.Errorf("no challenge for session %s in %q", s.instruction.SessionIdentifier, value)
+}
+
+func (r *runner) refreshProof(s *session, key crypto.Signer, challenge string) (string, error) {
+	return dbscclient.SignProof(key, dbscclient.ProofClaims{
+		Audience: s.refreshURL,
+		JTI:      challenge,
+		Subject:  s.instruction.SessionIdentifier,
+	})
+}
+
+func (r *runner) refresh(ctx context.Context, s *session, proof string) (*http.Response, error) {
+	res, _, err := r.postProof(ctx, s.client, s.refreshURL, map[string]string{
+		"Sec-Session-Id":       s.instruction.SessionIdentifier,
+		"Sec-Session-Response": proof,
+	})
+	return res, err
+}
+
+func validateInstruction(instruction formats.SessionInstructionResponse) error {
+	if !instruction.Continue {
+		return fmt.Errorf("session instruction has continue=false")
+	}
+	if instruction.SessionIdentifier == "" {
+		return fmt.Errorf("session instruction has no session_identifier")
+	}
+	if instruction.RefreshURL == "" {
+		return fmt.Errorf("session instruction has no refresh_url")
+	}
+	origin, err := url.Parse(instruction.Scope.Origin)
+	if err != nil || origin.Scheme == "" || origin.Host == "" {
+		return fmt.Errorf("session instruction scope.origin %q is not an origin", instruction.Scope.Origin)
+	}
+	for _, spec := range instruction.Scope.ScopeSpecification {
+		if spec.Type != "include" && spec.Type != "exclude" {
+			return fmt.Errorf("scope_specification type %q must be include or exclude", spec.Type)
+		}
+	}
+	if len(instruction.Credentials) == 0 {
+		return fmt.Errorf("session instruction has no credentials")
+	}
+	for _, credential := range instruction.Credentials {
+		if credential.Type != "cookie" || credential.Name == "" {
+			return fmt.Errorf("credential must be a named cookie: %+v", credential)
+		}
+	}
+	return nil
+}
+
+// expectCookies checks that the response sets every bound cookie of the instruction
+func expectCookies(res *http.Response, instruction formats.SessionInstructionResponse) error {
+	for _, credential := range instruction.Credentials {
+		found := false
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == credential.Name && cookie.Value != "" {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("response does not set the bound cookie %q", credential.Name)
+		}
+	}
+	return nil
+}
+
+func expectClientError(res *http.Response) error {
+	if res.StatusCode < 400 || res.StatusCode >= 500 {
+		return fmt.Errorf("status %d, want 4xx", res.StatusCode)
+	}
+	return nil
+}
+
+func checkRegistrationHeaderSyntax(ctx context.Context, r *runner) error {
+	entry, err := r.login(ctx, r.newHTTPClient())
+	if err != nil {
+		return err
+	}
+	supported := false
+	for _, algorithm := range entry.Algorithms {
+		if algorithm == dbscclient.AlgorithmES256 || algorithm == dbscclient.AlgorithmRS256 {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("no supported algorithm in %v", entry.Algorithms)
+	}
+	if entry.Params.Challenge == "" {
+		return fmt.Errorf("registration header has no challenge")
+	}
+	return nil
+}
+
+func checkRegistrationChallengeFreshness(ctx context.Context, r *runner) error {
+	first, err := r.login(ctx, r.newHTTPClient())
+	if err != nil {
+		return err
+	}
+	second, err := r.login(ctx, r.newHTTPClient())
+	if err != nil {
+		return err
+	}
+	if first.Params.Challenge == second.Params.Challenge {
+		return fmt.Errorf("the same challenge was issued twice: %q", first.Params.Challenge)
+	}
+	return nil
+}
+
+func checkRegistrationSuccess(ctx context.Context, r *runner) error {
+	_, err := r.register(ctx)
+	return err
+}
+
+func checkRegistrationBadSignature(ctx context.Context, r *runner) error {
+	return r.rejectRegistration(ctx, func(entry *formats.SecureSessionRegistrationEntry, registrationURL string) (string, error) {
+		signer, err := r.newKey()
+		if err != nil {
+			return "", err
+		}
+		claimed, err := r.newKey()
+		if err != nil {
+			return "", err
+		}
+		return r.registrationProof(entry, signer, claimed, registrationURL)
+	})
+}
+
+func checkRegistrationWrongAudience(ctx context.Context, r *runner) error {
+	return r.rejectRegistration(ctx, func(entry *formats.SecureSessionRegistrationEntry, registrationURL string) (string, error) {
+		key, err := r.newKey()
+		if err != nil {
+			return "", err
+		}
+		return r.registrationProof(entry, key, key, "https://conformance.invalid"+entry.Params.Path)
+	})
+}
+
+func (r *runner) rejectRegistration(ctx context.Context, proof func(entry *formats.SecureSessionRegistrationEntry, registrationURL string) (string, error)) error {
+	client := r.newHTTPClient()
+	entry, err := r.login(ctx, client)
+	if err != nil {
+		return err
+	}
+	registrationURL, err := r.registrationURL(entry)
+	if err != nil {
+		return err
+	}
+	value, err := proof(entry, registrationURL)
+	if err != nil {
+		return err
+	}
+	res, _, err := r.postProof(ctx, client, registrationURL, map[string]string{"Sec-Session-Response": value})
+	if err != nil {
+		return err
+	}
+	return expectClientError(res)
+}
+
+func checkRegistrationReplay(ctx context.Context, r *runner) error {
+	client := r.newHTTPClient()
+	entry, err := r.login(ctx, client)
+	if err != nil {
+		return err
+	}
+	key, err := r.newKey()
+	if err != nil {
+		return err
+	}
+	registrationURL, err := r.registrationURL(entry)
+	if err != nil {
+		return err
+	}
+	proof, err := r.registrationProof(entry, key, key, registrationURL)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Sec-Session-Response": proof}
+	res, _, err := r.postProof(ctx, client, registrationURL, headers)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("first registration returned status %d", res.StatusCode)
+	}
+	res, _, err = r.postProof(ctx, client, registrationURL, headers)
+	if err != nil {
+		return err
+	}
+	return expectClientError(res)
+}
+
+func checkProtectedRequiresCookie(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	// バウンドクッキーを除いたクライアントでアクセスする
+	client := r.newHTTPClient()
+	base, _ := url.Parse(r.config.BaseURL)
+	var cookies []*http.Cookie
+	for _, cookie := range s.client.Jar.Cookies(base) {
+		bound := false
+		for _, credential := range s.instruction.Credentials {
+			bound = bound || credential.Name == cookie.Name
+		}
+		if !bound {
+			cookies = append(cookies, cookie)
+		}
+	}
+	client.Jar.SetCookies(base, cookies)
+
+	res, _, err := r.do(ctx, client, http.MethodGet, r.url(r.config.ProtectedPath), nil, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 == 2 {
+		return fmt.Errorf("protected resource returned status %d without the bound cookie", res.StatusCode)
+	}
+
+	res, _, err = r.do(ctx, s.client, http.MethodGet, r.url(r.config.ProtectedPath), nil, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("protected resource returned status %d with the bound cookie", res.StatusCode)
+	}
+	return nil
+}
+
+func checkRefreshIssuesChallenge(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = r.challenge(ctx, s)
+	return err
+}
+
+func checkRefreshChallengeFreshness(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	// 続けて届いた要求に未使用のチャレンジを再び返すのは許されるが、使用済みのチャレンジは返さない
+	first, err := r.challenge(ctx, s)
+	if err != nil {
+		return err
+	}
+	proof, err := r.refreshProof(s, s.key, first)
+	if err != nil {
+		return err
+	}
+	res, err := r.refresh(ctx, s, proof)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh returned status %d, want 200", res.StatusCode)
+	}
+	second, err := r.challenge(ctx, s)
+	if err != nil {
+		return err
+	}
+	if first == second {
+		return fmt.Errorf("the used refresh challenge was issued again: %q", first)
+	}
+	return nil
+}
+
+func checkRefreshSuccess(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	challenge, err := r.challenge(ctx, s)
+	if err != nil {
+		return err
+	}
+	proof, err := r.refreshProof(s, s.key, challenge)
+	if err != nil {
+		return err
+	}
+	res, err := r.refresh(ctx, s, proof)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh returned status %d, want 200", res.StatusCode)
+	}
+	return expectCookies(res, s.instruction)
+}
+
+func checkRefreshKeyBinding(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	challenge, err := r.challenge(ctx, s)
+	if err != nil {
+		return err
+	}
+	otherKey, err := r.newKey()
+	if err != nil {
+		return err
+	}
+	proof, err := r.refreshProof(s, otherKey, challenge)
+	if err != nil {
+		return err
+	}
+	res, err := r.refresh(ctx, s, proof)
+	if err != nil {
+		return err
+	}
+	return expectClientError(res)
+}
+
+func checkRefreshReplay(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	challenge, err := r.challenge(ctx, s)
+	if err != nil {
+		return err
+	}
+	proof, err := r.refreshProof(s, s.key, challenge)
+	if err != nil {
+		return err
+	}
+	res, err := r.refresh(ctx, s, proof)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("first refresh returned status %d", res.StatusCode)
+	}
+	res, err = r.refresh(ctx, s, proof)
+	if err != nil {
+		return err
+	}
+	return expectClientError(res)
+}
+
+func checkRefreshUnknownSession(ctx context.Context, r *runner) error {
+	s, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	s.instruction.SessionIdentifier = "conformance-unknown-session"
+	res, _, err := r.postProof(ctx, s.client, s.refreshURL, map[string]string{"Sec-Session-Id": s.instruction.SessionIdentifier})
+	if err != nil {
+		return err
+	}
+	if err := expectClientError(res); err != nil {
+		return err
+	}
+	if res.Header.Get("Sec-Session-Challenge") != "" {
+		return fmt.Errorf("a challenge was issued for an unknown session")
+	}
+	return nil
+}
+
+func checkEndToEnd(ctx context.Context, r *runner) error {
+	client, err := dbscclient.New(r.config.Algorithm)
+	if err != nil {
+		return err
+	}
+	var registrationErr error
+	client.OnRegistrationError = func(err error) { registrationErr = err }
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url(r.config.LoginPath), strings.NewReader(r.config.LoginForm.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if registrationErr != nil {
+		return registrationErr
+	}
+	sessions := client.Sessions()
+	if len(sessions) != 1 {
+		return fmt.Errorf("client registered %d sessions, want 1", len(sessions))
+	}
+
+	// バウンドクッキーを削除し、期限切れ後の状態でアクセスする
+	base, _ := url.Parse(r.config.BaseURL)
+	var expired []*http.Cookie
+	for _, credential := range sessions[0].Instruction.Credentials {
+		expired = append(expired, &http.Cookie{Name: credential.Name, Value: "", Path: "/", MaxAge: -1})
+	}
+	client.HTTPClient.Jar.SetCookies(base, expired)
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, r.url(r.config.ProtectedPath), nil)
+	if err != nil {
+		return err
+	}
+	res, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("protected resource returned status %d after refresh", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc/formats"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+// fault makes the fake server break one part of the protocol
+type fault string
+
+const (
+	faultNone                     fault = ""
+	faultUnsupportedAlgorithm     fault = "unsupported algorithm"
+	faultStaticRegistration       fault = "static registration challenge"
+	faultNoRegistrationCookie     fault = "no cookie on registration"
+	faultNoContinue               fault = "continue=false"
+	faultBadScopeOrigin           fault = "scope origin without scheme"
+	faultBadCredential            fault = "credential of unknown type"
+	faultSkipSignature            fault = "signature not verified"
+	faultAnyAudience              fault = "audience not verified"
+	faultReusableRegistration     fault = "registration challenge not consumed"
+	faultUnprotected              fault = "protected resource without cookie check"
+	faultNoRefreshChallenge       fault = "refresh without challenge header"
+	faultRefreshOK                fault = "refresh without proof answers 200"
+	faultReissueUsedChallenge     fault = "used refresh challenge issued again"
+	faultNoRefreshCookie          fault = "no cookie on refresh"
+	faultRefreshAnyKey            fault = "refresh key not bound"
+	faultReusableRefresh          fault = "refresh challenge not consumed"
+	faultChallengeForUnknown      fault = "challenge for unknown session"
+	faultUnknownSessionOK         fault = "unknown session answers 200"
+	faultRefreshCookieOutOfScope  fault = "refreshed cookie outside the protected path"
+	faultRegistrationServerFailed fault = "registration answers 500"
+)
+
+// fakeServer is a minimal DBSC server following the protocol as the checks expect, except
+// for its fault
+type fakeServer struct {
+	t     *testing.T
+	fault fault
+	url   string
+
+	mu            sync.Mutex
+	next          int
+	registrations map[string]bool
+	sessions      map[string]*fakeSession
+	cookies       map[string]string
+}
+
+type fakeSession struct {
+	key       jwk.Key
+	challenge string
+	used      bool
+}
+
+func newFakeServer(t *testing.T, f fault) *fakeServer {
+	s := &fakeServer{
+		t:             t,
+		fault:         f,
+		registrations: make(map[string]bool),
+		sessions:      make(map[string]*fakeSession),
+		cookies:       make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", s.login)
+	mux.HandleFunc("POST /dbsc_start", s.register)
+	mux.HandleFunc("POST /dbsc_refresh", s.refresh)
+	mux.HandleFunc("GET /api/check_dbsc_session", s.protected)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+func (s *fakeServer) newID(prefix string) string {
+	s.next++
+	return prefix + "-" + strconv.Itoa(s.next)
+}
+
+func (s *fakeServer) login(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge := s.newID("registration")
+	if s.fault == faultStaticRegistration {
+		challenge = "static"
+	}
+	s.registrations[challenge] = true
+	algorithms := []string{dbscclient.AlgorithmES256, dbscclient.AlgorithmRS256}
+	if s.fault == faultUnsupportedAlgorithm {
+		algorithms = []string{"EdDSA"}
+	}
+	entry := &formats.SecureSessionRegistrationEntry{
+		Algorithms: algorithms,
+		Params:     &formats.SecureSessionRegistrationParams{Path: "/dbsc_start", Challenge: challenge, Authorization: "authorization"},
+	}
+	w.Header().Set("Sec-Session-Registration", entry.ToSFV())
+}
+
+func (s *fakeServer) register(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fault == faultRegistrationServerFailed {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	claims, key, err := s.verify(r.Header.Get("Sec-Session-Response"), nil, s.url+"/dbsc_start")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.registrations[claims.JTI] {
+		http.Error(w, "unknown challenge", http.StatusBadRequest)
+		return
+	}
+	if s.fault != faultReusableRegistration && s.fault != faultStaticRegistration {
+		delete(s.registrations, claims.JTI)
+	}
+
+	id := s.newID("session")
+	s.sessions[id] = &fakeSession{key: key}
+	if s.fault != faultNoRegistrationCookie {
+		s.setCookie(w, id, "/")
+	}
+	instruction := formats.SessionInstructionResponse{
+		SessionIdentifier: id,
+		RefreshURL:        "/dbsc_refresh",
+		Continue:          s.fault != faultNoContinue,
+		Scope:             formats.SessionInstructionScope{Origin: s.url, IncludeSite: true},
+		Credentials:       []formats.SessionInstructionCredential{{Type: "cookie", Name: "bound"}},
+	}
+	switch s.fault {
+	case faultBadScopeOrigin:
+		instruction.Scope.Origin = strings.TrimPrefix(s.url, "http://")
+	case faultBadCredential:
+		instruction.Credentials[0].Type = "header"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instruction)
+}
+
+func (s *fakeServer) refresh(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.Header.Get("Sec-Session-Id")
+	session, ok := s.sessions[id]
+	if !ok {
+		switch s.fault {
+		case faultChallengeForUnknown:
+			s.setChallenge(w, s.newID("refresh"), id)
+		case faultUnknownSessionOK:
+			return
+		}
+		http.Error(w, "unknown session", http.StatusUnauthorized)
+		return
+	}
+
+	proof := r.Header.Get("Sec-Session-Response")
+	if proof == "" {
+		if session.challenge == "" || session.used && s.fault != faultReissueUsedChallenge {
+			session.challenge, session.used = s.newID("refresh"), false
+		}
+		if s.fault != faultNoRefreshChallenge {
+			s.setChallenge(w, session.challenge, id)
+		}
+		if s.fault == faultRefreshOK {
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := session.key
+	if s.fault == faultRefreshAnyKey {
+		key = nil
+	}
+	claims, _, err := s.verify(proof, key, s.url+"/dbsc_refresh")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if claims.JTI != session.challenge || session.used && s.fault != faultReusableRefresh && s.fault != faultReissueUsedChallenge {
+		http.Error(w, "invalid challenge", http.StatusBadRequest)
+		return
+	}
+	session.used = true
+	switch s.fault {
+	case faultNoRefreshCookie:
+	case faultRefreshCookieOutOfScope:
+		s.setCookie(w, id, "/elsewhere")
+	default:
+		s.setCookie(w, id, "/")
+	}
+}
+
+func (s *fakeServer) protected(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fault == faultUnprotected {
+		return
+	}
+	cookie, err := r.Cookie("bound")
+	if err != nil || s.cookies[cookie.Value] == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func (s *fakeServer) setCookie(w http.ResponseWriter, sessionID, path string) {
+	value := s.newID("cookie")
+	s.cookies[value] = sessionID
+	http.SetCookie(w, &http.Cookie{Name: "bound", Value: value, Path: path, MaxAge: 60})
+}
+
+func (s *fakeServer) setChallenge(w http.ResponseWriter, challenge, sessionID string) {
+	w.Header().Set("Sec-Session-Challenge", formats.NewSecureSessionChallengeHeader(challenge, sessionID).ToSFV())
+}
+
+// verify checks the proof against key, or against the key claim when key is nil
+func (s *fakeServer) verify(proof string, key jwk.Key, audience string) (*dbscclient.ProofClaims, jwk.Key, error) {
+	message, err := jws.Parse([]byte(proof))
+	if err != nil || len(message.Signatures()) != 1 {
+		return nil, nil, fmt.Errorf("malformed proof")
+	}
+	var claims dbscclient.ProofClaims
+	if err := json.Unmarshal(message.Payload(), &claims); err != nil {
+		return nil, nil, err
+	}
+	if key == nil {
+		raw, err := json.Marshal(claims.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, err = jwk.ParseKey(raw); err != nil {
+			return nil, nil, err
+		}
+	}
+	if s.fault != faultSkipSignature {
+		algorithm := message.Signatures()[0].ProtectedHeaders().Algorithm()
+		if _, err := jws.Verify([]byte(proof), jws.WithKey(algorithm, key)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if claims.Audience != audience && s.fault != faultAnyAudience {
+		return nil, nil, errors.New("wrong audience")
+	}
+	return &claims, key, nil
+}
+
+func TestRunAgainstConformingServer(t *testing.T) {
+	server := newFakeServer(t, faultNone)
+	report := Run(context.Background(), DefaultConfig(server.url))
+	for _, result := range report.Failed() {
+		t.Errorf("%s: %s", result.Name, result.Error)
+	}
+	if len(report.Results) != len(checks) {
+		t.Errorf("%d results for %d checks", len(report.Results), len(checks))
+	}
+}
+
+func TestChecksFailAgainstBrokenServers(t *testing.T) {
+	tests := []struct {
+		check string
+		fault fault
+	}{
+		{"registration-header-syntax", faultUnsupportedAlgorithm},
+		{"registration-challenge-freshness", faultStaticRegistration},
+		{"registration-success", faultNoRegistrationCookie},
+		{"registration-success", faultNoContinue},
+		{"registration-success", faultBadScopeOrigin},
+		{"registration-success", faultBadCredential},
+		{"registration-success", faultRegistrationServerFailed},
+		{"registration-rejects-bad-signature", faultSkipSignature},
+		{"registration-rejects-wrong-audience", faultAnyAudience},
+		{"registration-rejects-replay", faultReusableRegistration},
+		{"protected-requires-bound-cookie", faultUnprotected},
+		{"refresh-issues-challenge", faultNoRefreshChallenge},
+		{"refresh-issues-challenge", faultRefreshOK},
+		{"refresh-challenge-freshness", faultReissueUsedChallenge},
+		{"refresh-success", faultNoRefreshCookie},
+		{"refresh-key-binding", faultRefreshAnyKey},
+		{"refresh-rejects-replay", faultReusableRefresh},
+		{"refresh-unknown-session", faultChallengeForUnknown},
+		{"refresh-unknown-session", faultUnknownSessionOK},
+		{"end-to-end", faultRefreshCookieOutOfScope},
+	}
+
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		covered[tt.check] = true
+		t.Run(tt.check+"/"+string(tt.fault), func(t *testing.T) {
+			var run func(context.Context, *runner) error
+			for _, c := range checks {
+				if c.name == tt.check {
+					run = c.run
+				}
+			}
+			if run == nil {
+				t.Fatalf("no check named %s", tt.check)
+			}
+			server := newFakeServer(t, tt.fault)
+			if err := run(context.Background(), &runner{config: DefaultConfig(server.url)}); err == nil {
+				t.Errorf("passed against a server with %s", tt.fault)
+			}
+		})
+	}
+	for _, c := range checks {
+		if !covered[c.name] {
+			t.Errorf("%s is not tested against a broken server", c.name)
+		}
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	server := newFakeServer(t, faultUnprotected)
+	report := Run(context.Background(), DefaultConfig(server.url))
+	failed := report.Failed()
+	if report.Passed() || len(failed) != 1 || failed[0].Name != "protected-requires-bound-cookie" || failed[0].Error == "" {
+		t.Fatalf("failed = %+v", failed)
+	}
+
+	var text strings.Builder
+	if err := report.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "FAIL  protected-requires-bound-cookie") || !strings.Contains(text.String(), fmt.Sprintf("%d/%d checks passed", len(checks)-1, len(checks))) {
+		t.Errorf("text report:\n%s", text.String())
+	}
+	var decoded Report
+	var buffer strings.Builder
+	if err := report.WriteJSON(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(buffer.String()), &decoded); err != nil || len(decoded.Failed()) != 1 {
+		t.Errorf("JSON report %s: %v", buffer.String(), err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package conformance checks the DBSC behaviour of a server reachable at a base URL.
+//
+// The checks cover what this project implements: registration and challenge header syntax,
+// challenge freshness and single use, status codes of the registration and refresh endpoints,
+// validity of the session instruction and binding of the session to the registered key.
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config describes how to drive the server under test
+type Config struct {
+	BaseURL string
+	// LoginPath receives LoginForm as a form POST and answers with Sec-Session-Registration
+	LoginPath string
+	LoginForm url.Values
+	// ProtectedPath requires the bound cookie
+	ProtectedPath string
+	// Algorithm of the software key (ES256 or RS256)
+	Algorithm string
+	Timeout   time.Duration
+}
+
+// DefaultConfig returns the configuration matching this demo server
+func DefaultConfig(baseURL string) Config {
+	return Config{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		LoginPath:     "/login",
+		LoginForm:     url.Values{"username": {"test"}, "password": {"test"}},
+		ProtectedPath: "/api/check_dbsc_session",
+		Algorithm:     "ES256",
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Passed      bool          `json:"passed"`
+	Error       string        `json:"error,omitempty"`
+	Duration    time.Duration `json:"duration_ns"`
+}
+
+// Report is the outcome of a conformance run
+type Report struct {
+	BaseURL   string        `json:"base_url"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration_ns"`
+	Results   []Result      `json:"results"`
+}
+
+// Passed reports whether every check passed
+func (r *Report) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the failed results
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, result := range r.Results {
+		if !result.Passed {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// WriteText writes a human readable report
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "DBSC conformance report for %s\n\n", r.BaseURL)
+	passed := 0
+	for _, result := range r.Results {
+		status := "PASS"
+		if result.Passed {
+			passed++
+		} else {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s  %-40s %s\n", status, result.Name, result.Description)
+		if result.Error != "" {
+			fmt.Fprintf(w, "      %s\n", result.Error)
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d/%d checks passed in %v\n", passed, len(r.Results), r.Duration.Round(time.Millisecond))
+	return err
+}
+
+// WriteJSON writes the report as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// Run executes every check against the server
+func Run(ctx context.Context, config Config) *Report {
+	report := &Report{
+		BaseURL:   config.BaseURL,
+		StartedAt: time.Now(),
+	}
+
+	for _, check := range checks {
+		checkCtx := ctx
+		cancel := func() {}
+		if config.Timeout > 0 {
+			checkCtx, cancel = context.WithTimeout(ctx, config.Timeout)
+		}
+
+		start := time.Now()
+		err := check.run(checkCtx, &runner{config: config})
+		cancel()
+
+		result := Result{
+			Name:        check.name,
+			Description: check.description,
+			Passed:      err == nil,
+			Duration:    time.Since(start),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	return report
+}
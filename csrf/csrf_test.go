@@ -0,0 +1,96 @@
+package csrf_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"dbsc-demo/csrf"
+)
+
+func TestCheck(t *testing.T) {
+	protection := csrf.New()
+	protection.TrustedOrigins = []string{"https://idp.example"}
+
+	// 初回のページ表示でクッキーとトークンを発行する
+	recorder := httptest.NewRecorder()
+	token, err := protection.Token(recorder, httptest.NewRequest(http.MethodGet, "http://rp.example/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("token cookie = %v", cookies)
+	}
+	cookie := cookies[0]
+
+	// 2回目以降は同じトークンを返す
+	request := httptest.NewRequest(http.MethodGet, "http://rp.example/login", nil)
+	request.AddCookie(cookie)
+	recorder = httptest.NewRecorder()
+	if again, _ := protection.Token(recorder, request); again != token || len(recorder.Result().Cookies()) != 0 {
+		t.Error("token was reissued")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		form    url.Values
+		cookie  *http.Cookie
+		want    error
+	}{
+		{name: "safe method", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{name: "non-browser client", method: http.MethodPost},
+		{name: "same origin with form token", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie},
+		{name: "same origin with header token", method: http.MethodDelete, headers: map[string]string{"Sec-Fetch-Site": "same-origin", csrf.HeaderName: token}, cookie: cookie},
+		{name: "origin only", method: http.MethodPost, headers: map[string]string{"Origin": "http://rp.example"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie},
+		{name: "trusted origin", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://idp.example"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie},
+		{name: "cross site", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie, want: csrf.ErrCrossOrigin},
+		{name: "same site", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-site"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie, want: csrf.ErrCrossOrigin},
+		{name: "cross origin without fetch metadata", method: http.MethodPost, headers: map[string]string{"Origin": "https://evil.example"}, form: url.Values{csrf.FieldName: {token}}, cookie: cookie, want: csrf.ErrCrossOrigin},
+		{name: "null origin", method: http.MethodPost, headers: map[string]string{"Origin": "null"}, cookie: cookie, want: csrf.ErrCrossOrigin},
+		{name: "browser without token", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, cookie: cookie, want: csrf.ErrInvalidToken},
+		{name: "browser without cookie", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, form: url.Values{csrf.FieldName: {token}}, want: csrf.ErrInvalidToken},
+		{name: "wrong token", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, form: url.Values{csrf.FieldName: {strings.Repeat("A", len(token))}}, cookie: cookie, want: csrf.ErrInvalidToken},
+		{name: "empty token and cookie", method: http.MethodPost, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, form: url.Values{csrf.FieldName: {""}}, cookie: &http.Cookie{Name: cookie.Name, Value: ""}, want: csrf.ErrInvalidToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, "http://rp.example/login", strings.NewReader(tc.form.Encode()))
+			if tc.form != nil {
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for name, value := range tc.headers {
+				request.Header.Set(name, value)
+			}
+			if tc.cookie != nil {
+				request.AddCookie(tc.cookie)
+			}
+			if err := protection.Check(request); !errors.Is(err, tc.want) {
+				t.Errorf("Check = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := csrf.New().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := httptest.NewRequest(http.MethodPost, "http://rp.example/logout", nil)
+	request.Header.Set("Sec-Fetch-Site", "cross-site")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("cross-site status = %d, want 403", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "http://rp.example/logout", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("non-browser status = %d, want 204", recorder.Code)
+	}
+}
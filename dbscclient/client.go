@@ -0,0 +1,460 @@
+// Package dbscclient emulates a DBSC capable browser with a software key.
+//
+// It reacts to Sec-Session-Registration headers, signs dbsc+jwt proofs, keeps the registered
+// sessions and refreshes their bound cookies before sending requests in scope, which makes it
+// possible to exercise a DBSC server from tests and scripts without Chrome.
+package dbscclient
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/dbsc/formats"
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+)
+
+// ErrSessionTerminated is returned when the server ends a session during refresh
+var ErrSessionTerminated = errors.New("dbsc session terminated by server")
+
+// Session is a DBSC session registered by the client
+type Session struct {
+	ID          string
+	Key         crypto.Signer
+	Instruction formats.SessionInstructionResponse
+	RefreshURL  *url.URL
+	// サーバから受け取った次回リフレッシュ用のチャレンジ
+	Challenge string
+	// 最後に受け取ったバインド済み Cookie の有効期限 (Client.Clock 基準)
+	CredentialsExpireAt time.Time
+}
+
+// Client sends HTTP requests like a browser supporting DBSC
+type Client struct {
+	HTTPClient *http.Client
+	// Key is used for new registrations (federated registrations reuse the provider session key)
+	Key crypto.Signer
+	// OnRegistrationError is called when a registration triggered by a response fails
+	OnRegistrationError func(err error)
+	// Clock decides when bound cookies expire and stamps the iat of proofs.
+	// The cookie jar keeps using the wall clock, so a fake clock only shortens cookie lifetimes.
+	Clock clock.Clock
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// New creates a client with a freshly generated software key for algorithm (ES256 or RS256)
+func New(algorithm string) (*Client, error) {
+	key, err := GenerateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithKey(key)
+}
+
+// NewWithKey creates a client using key for registrations
+func NewWithKey(key crypto.Signer) (*Client, error) {
+	if _, err := KeyAlgorithm(key); err != nil {
+		return nil, err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+	return &Client{
+		HTTPClient: &http.Client{Jar: jar},
+		Key:        key,
+		Clock:      clock.System,
+		sessions:   make(map[string]*Session),
+	}, nil
+}
+
+// Get issues a GET request through Do
+func (c *Client) Get(rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// PostForm issues a form POST request through Do
+func (c *Client) PostForm(rawURL string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, rawURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.Do(req)
+}
+
+// Do refreshes the bound cookies of sessions covering the request when they are missing or
+// the server sent a challenge ahead of their expiry (proactive refresh), sends the request and
+// processes the DBSC headers of the response.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	for _, session := range c.sessionsInScope(req.URL) {
+		if c.hasCredentials(session, req.URL) && !c.hasChallenge(session) {
+			continue
+		}
+		if err := c.Refresh(req.Context(), session); err != nil && !errors.Is(err, ErrSessionTerminated) {
+			return nil, fmt.Errorf("failed to refresh dbsc session %s: %w", session.ID, err)
+		}
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.handleResponse(req.Context(), res)
+	return res, nil
+}
+
+// Sessions returns the registered sessions
+func (c *Client) Sessions() []*Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Session returns the session with the identifier
+func (c *Client) Session(id string) (*Session, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, ok := c.sessions[id]
+	return session, ok
+}
+
+// Register performs the registration described by entry, received on a response for base
+func (c *Client) Register(ctx context.Context, base *url.URL, entry *formats.SecureSessionRegistrationEntry) (*Session, error) {
+	key, err := c.registrationKey(entry.Params)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := KeyAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(entry.Algorithms, algorithm) {
+		return nil, fmt.Errorf("server does not accept %s (offered %v)", algorithm, entry.Algorithms)
+	}
+
+	path, err := url.Parse(entry.Params.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration path: %w", err)
+	}
+	registrationURL := base.ResolveReference(path)
+
+	proof, err := SignProof(key, ProofClaims{
+		Audience:      registrationURL.String(),
+		JTI:           entry.Params.Challenge,
+		IssuedAt:      c.Clock.Now().Unix(),
+		Authorization: entry.Params.Authorization,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.post(ctx, registrationURL, map[string]string{"Sec-Session-Response": proof})
+	if err != nil {
+		return nil, fmt.Errorf("registration request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("registration failed with status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var instruction formats.SessionInstructionResponse
+	if err := json.NewDecoder(res.Body).Decode(&instruction); err != nil {
+		return nil, fmt.Errorf("invalid session instruction: %w", err)
+	}
+	if !instruction.Continue {
+		return nil, nil
+	}
+	if instruction.SessionIdentifier == "" || instruction.RefreshURL == "" {
+		return nil, fmt.Errorf("session instruction without session_identifier or refresh_url")
+	}
+	refreshPath, err := url.Parse(instruction.RefreshURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh_url: %w", err)
+	}
+
+	session := &Session{
+		ID:          instruction.SessionIdentifier,
+		Key:         key,
+		Instruction: instruction,
+		RefreshURL:  registrationURL.ResolveReference(refreshPath),
+	}
+	c.recordCredentials(session, res)
+	c.mu.Lock()
+	c.sessions[session.ID] = session
+	c.mu.Unlock()
+	return session, nil
+}
+
+// Refresh performs the challenge/refresh exchange for session
+func (c *Client) Refresh(ctx context.Context, session *Session) error {
+	c.mu.Lock()
+	challenge := session.Challenge
+	session.Challenge = ""
+	c.mu.Unlock()
+
+	// チャレンジがない場合はまず Sec-Session-Id のみで問い合わせ、チャレンジを受け取る
+	for attempt := 0; attempt < 3; attempt++ {
+		headers := map[string]string{"Sec-Session-Id": session.ID}
+		if challenge != "" {
+			proof, err := SignProof(session.Key, ProofClaims{
+				Audience: session.RefreshURL.String(),
+				JTI:      challenge,
+				IssuedAt: c.Clock.Now().Unix(),
+				Subject:  session.ID,
+			})
+			if err != nil {
+				return err
+			}
+			headers["Sec-Session-Response"] = proof
+		}
+
+		res, err := c.post(ctx, session.RefreshURL, headers)
+		if err != nil {
+			return fmt.Errorf("refresh request failed: %w", err)
+		}
+		c.updateInstruction(session, res)
+		res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusOK:
+			c.recordCredentials(session, res)
+			return nil
+		case res.StatusCode >= 500:
+			return fmt.Errorf("refresh failed with status %d", res.StatusCode)
+		}
+
+		// 401 などで新しいチャレンジが届いた場合はそのチャレンジで再試行し、
+		// 403 またはチャレンジのない 4xx の場合はセッション終了
+		next := c.challengeFor(res, session.ID)
+		if next == "" || res.StatusCode == http.StatusForbidden {
+			c.terminate(session.ID)
+			return ErrSessionTerminated
+		}
+		challenge = next
+	}
+	return fmt.Errorf("refresh did not complete")
+}
+
+func (c *Client) handleResponse(ctx context.Context, res *http.Response) {
+	base := res.Request.URL
+
+	for _, value := range res.Header.Values("Sec-Session-Challenge") {
+		header, err := formats.ParseSecureSessionChallengeHeader(value)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		for _, challenge := range header {
+			if session, ok := c.sessions[challenge.ID]; ok {
+				session.Challenge = challenge.Challenge
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	for _, value := range res.Header.Values("Sec-Session-Registration") {
+		header, err := formats.ParseSecureSessionRegistrationHeader(value)
+		if err != nil {
+			c.registrationError(err)
+			continue
+		}
+		for _, entry := range header {
+			if _, err := c.Register(ctx, base, entry); err != nil {
+				c.registrationError(err)
+			}
+		}
+	}
+}
+
+// registrationKey selects the key to register with, reusing the provider session key for federation
+func (c *Client) registrationKey(params *formats.SecureSessionRegistrationParams) (crypto.Signer, error) {
+	if params.ProviderKey == "" {
+		return c.Key, nil
+	}
+
+	c.mu.Lock()
+	provider, ok := c.sessions[params.ProviderID]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("provider session %s not found", params.ProviderID)
+	}
+	if params.ProviderURL != "" && !strings.HasPrefix(provider.RefreshURL.String(), strings.TrimSuffix(params.ProviderURL, "/")+"/") {
+		return nil, fmt.Errorf("provider session %s does not belong to %s", params.ProviderID, params.ProviderURL)
+	}
+	thumbprint, err := dbsc_proof.Thumbprint(provider.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if thumbprint != params.ProviderKey {
+		return nil, fmt.Errorf("provider_key does not match the provider session key")
+	}
+	return provider.Key, nil
+}
+
+func (c *Client) sessionsInScope(u *url.URL) []*Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sessions []*Session
+	for _, session := range c.sessions {
+		if inScope(session.Instruction.Scope, u) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// hasChallenge reports whether the server sent the session a challenge for its next refresh
+func (c *Client) hasChallenge(session *Session) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return session.Challenge != ""
+}
+
+// hasCredentials reports whether every bound cookie of the session is present and unexpired for u
+func (c *Client) hasCredentials(session *Session, u *url.URL) bool {
+	c.mu.Lock()
+	expiresAt := session.CredentialsExpireAt
+	c.mu.Unlock()
+	if !expiresAt.IsZero() && !c.Clock.Now().Before(expiresAt) {
+		return false
+	}
+
+	cookies := c.HTTPClient.Jar.Cookies(u)
+	for _, credential := range session.Instruction.Credentials {
+		if credential.Type != "cookie" {
+			continue
+		}
+		found := false
+		for _, cookie := range cookies {
+			if cookie.Name == credential.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// recordCredentials remembers the earliest expiry of the bound cookies set by res
+func (c *Client) recordCredentials(session *Session, res *http.Response) {
+	var expiresAt time.Time
+	for _, cookie := range res.Cookies() {
+		if !session.bindsCookie(cookie.Name) {
+			continue
+		}
+		var expiry time.Time
+		switch {
+		case cookie.MaxAge > 0:
+			expiry = c.Clock.Now().Add(time.Duration(cookie.MaxAge) * time.Second)
+		case !cookie.Expires.IsZero():
+			expiry = cookie.Expires
+		default:
+			continue
+		}
+		if expiresAt.IsZero() || expiry.Before(expiresAt) {
+			expiresAt = expiry
+		}
+	}
+	c.mu.Lock()
+	session.CredentialsExpireAt = expiresAt
+	c.mu.Unlock()
+}
+
+func (s *Session) bindsCookie(name string) bool {
+	for _, credential := range s.Instruction.Credentials {
+		if credential.Type == "cookie" && credential.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) challengeFor(res *http.Response, sessionID string) string {
+	for _, value := range res.Header.Values("Sec-Session-Challenge") {
+		header, err := formats.ParseSecureSessionChallengeHeader(value)
+		if err != nil {
+			continue
+		}
+		for _, challenge := range header {
+			if challenge.ID == "" || challenge.ID == sessionID {
+				return challenge.Challenge
+			}
+		}
+	}
+	return ""
+}
+
+// updateInstruction applies a session instruction returned by the refresh endpoint
+func (c *Client) updateInstruction(session *Session, res *http.Response) {
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return
+	}
+	var instruction formats.SessionInstructionResponse
+	if err := json.NewDecoder(res.Body).Decode(&instruction); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !instruction.Continue {
+		delete(c.sessions, session.ID)
+		return
+	}
+	session.Instruction = instruction
+}
+
+func (c *Client) terminate(sessionID string) {
+	c.mu.Lock()
+	delete(c.sessions, sessionID)
+	c.mu.Unlock()
+}
+
+func (c *Client) registrationError(err error) {
+	if c.OnRegistrationError != nil {
+		c.OnRegistrationError(err)
+	}
+}
+
+func (c *Client) post(ctx context.Context, u *url.URL, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package dbscclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"dbsc-demo/server/dbsc/formats"
+)
+
+// refreshServer answers each refresh request with the next scripted response and records
+// the challenge signed by the proof of the request ("" for a request without proof)
+type refreshServer struct {
+	t         *testing.T
+	mu        sync.Mutex
+	responses []refreshResponse
+	signed    []string
+}
+
+type refreshResponse struct {
+	status    int
+	challenge string
+}
+
+func (s *refreshServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signed = append(s.signed, proofChallenge(s.t, r.Header.Get("Sec-Session-Response")))
+	if len(s.responses) == 0 {
+		s.t.Errorf("unexpected refresh request")
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+		return
+	}
+	res := s.responses[0]
+	s.responses = s.responses[1:]
+	if res.challenge != "" {
+		w.Header().Set("Sec-Session-Challenge", formats.NewSecureSessionChallengeHeader(res.challenge, "session").ToSFV())
+	}
+	if res.status == http.StatusOK {
+		http.SetCookie(w, &http.Cookie{Name: "bound", Value: "refreshed", MaxAge: 60})
+	}
+	w.WriteHeader(res.status)
+}
+
+// proofChallenge returns the jti of a proof without verifying it
+func proofChallenge(t *testing.T, proof string) string {
+	if proof == "" {
+		return ""
+	}
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed proof %q", proof)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		JTI string `json:"jti"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims.JTI
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name string
+		// presupplied is the challenge the client already holds
+		presupplied string
+		responses   []refreshResponse
+		succeeds    bool
+		terminated  bool
+		// signed are the challenges of the requests, "" for a request without proof
+		signed []string
+	}{
+		{
+			name:      "challenge then proof",
+			responses: []refreshResponse{{http.StatusUnauthorized, "c1"}, {http.StatusOK, ""}},
+			signed:    []string{"", "c1"},
+			succeeds:  true,
+		},
+		{
+			name:        "presupplied challenge",
+			presupplied: "c0",
+			responses:   []refreshResponse{{http.StatusOK, ""}},
+			signed:      []string{"c0"},
+			succeeds:    true,
+		},
+		{
+			// 401 と新しいチャレンジは「このチャレンジで再試行」の意味
+			name:        "retry with a new challenge",
+			presupplied: "stale",
+			responses:   []refreshResponse{{http.StatusUnauthorized, "c1"}, {http.StatusOK, ""}},
+			signed:      []string{"stale", "c1"},
+			succeeds:    true,
+		},
+		{
+			name:       "forbidden with a challenge",
+			responses:  []refreshResponse{{http.StatusUnauthorized, "c1"}, {http.StatusForbidden, "c2"}},
+			terminated: true,
+			signed:     []string{"", "c1"},
+		},
+		{
+			name:       "unknown session",
+			responses:  []refreshResponse{{http.StatusUnauthorized, ""}},
+			terminated: true,
+			signed:     []string{""},
+		},
+		{
+			name:        "rejected proof",
+			presupplied: "c0",
+			responses:   []refreshResponse{{http.StatusBadRequest, ""}},
+			terminated:  true,
+			signed:      []string{"c0"},
+		},
+		{
+			name:      "server error",
+			responses: []refreshResponse{{http.StatusUnauthorized, "c1"}, {http.StatusServiceUnavailable, "c2"}},
+			signed:    []string{"", "c1"},
+		},
+		{
+			name:      "no progress",
+			responses: []refreshResponse{{http.StatusUnauthorized, "c1"}, {http.StatusUnauthorized, "c2"}, {http.StatusUnauthorized, "c3"}},
+			signed:    []string{"", "c1", "c2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &refreshServer{t: t, responses: tt.responses}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			client, err := New(AlgorithmES256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refreshURL, err := url.Parse(server.URL + "/dbsc_refresh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := &Session{
+				ID:         "session",
+				Key:        client.Key,
+				RefreshURL: refreshURL,
+				Challenge:  tt.presupplied,
+				Instruction: formats.SessionInstructionResponse{
+					Credentials: []formats.SessionInstructionCredential{{Type: "cookie", Name: "bound"}},
+				},
+			}
+			client.sessions[session.ID] = session
+
+			err = client.Refresh(context.Background(), session)
+			switch {
+			case tt.succeeds && err != nil:
+				t.Errorf("refresh failed: %v", err)
+			case tt.succeeds && session.CredentialsExpireAt.IsZero():
+				t.Error("credentials not recorded")
+			case tt.terminated && !errors.Is(err, ErrSessionTerminated):
+				t.Errorf("err = %v, want %v", err, ErrSessionTerminated)
+			case !tt.succeeds && !tt.terminated && (err == nil || errors.Is(err, ErrSessionTerminated)):
+				t.Errorf("err = %v, want a failed refresh", err)
+			}
+			if _, ok := client.Session(session.ID); ok == tt.terminated {
+				t.Errorf("session kept = %v, want %v", ok, !tt.terminated)
+			}
+			if strings.Join(handler.signed, ",") != strings.Join(tt.signed, ",") {
+				t.Errorf("signed challenges = %q, want %q", handler.signed, tt.signed)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package dbscclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+const (
+	AlgorithmES256 = "ES256"
+	AlgorithmRS256 = "RS256"
+)
+
+// ProofClaims is the payload of a dbsc+jwt proof
+type ProofClaims struct {
+	Audience      string                 `json:"aud"`
+	JTI           string                 `json:"jti"`
+	IssuedAt      int64                  `json:"iat"`
+	Key           map[string]interface{} `json:"key"`
+	Authorization string                 `json:"authorization,omitempty"`
+	Subject       string                 `json:"sub,omitempty"`
+}
+
+// GenerateKey creates a software key for the algorithm (ES256 or RS256)
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+}
+
+// KeyAlgorithm returns the DBSC algorithm matching the key type
+func KeyAlgorithm(key crypto.Signer) (string, error) {
+	switch k := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported curve: %s", k.Curve.Params().Name)
+		}
+		return AlgorithmES256, nil
+	case *rsa.PublicKey:
+		return AlgorithmRS256, nil
+	default:
+		return "", fmt.Errorf("unsupported key type: %T", k)
+	}
+}
+
+// PublicJWK returns the public part of key as a JWK map
+func PublicJWK(key crypto.Signer) (map[string]interface{}, error) {
+	publicKey, err := jwk.FromRaw(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert public key to JWK: %w", err)
+	}
+	raw, err := json.Marshal(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JWK: %w", err)
+	}
+	var jwkMap map[string]interface{}
+	if err := json.Unmarshal(raw, &jwkMap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWK: %w", err)
+	}
+	return jwkMap, nil
+}
+
+// SignProof creates a dbsc+jwt proof signed with key
+func SignProof(key crypto.Signer, claims ProofClaims) (string, error) {
+	algorithm, err := KeyAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+	if claims.Key == nil {
+		if claims.Key, err = PublicJWK(key); err != nil {
+			return "", err
+		}
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, "dbsc+jwt"); err != nil {
+		return "", fmt.Errorf("failed to set typ header: %w", err)
+	}
+	signed, err := jws.Sign(payload, jws.WithKey(jwa.SignatureAlgorithm(algorithm), key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign proof: %w", err)
+	}
+	return string(signed), nil
+}
@@ -0,0 +1,66 @@
+package dbscclient
+
+import (
+	"net/url"
+	"strings"
+
+	"dbsc-demo/server/dbsc/formats"
+)
+
+// inScope reports whether u is covered by the session scope of the instruction
+func inScope(scope formats.SessionInstructionScope, u *url.URL) bool {
+	origin, err := url.Parse(scope.Origin)
+	if err != nil || origin.Host == "" {
+		return false
+	}
+
+	if scope.IncludeSite {
+		if u.Scheme != origin.Scheme || !sameSite(origin.Hostname(), u.Hostname()) {
+			return false
+		}
+	} else if u.Scheme != origin.Scheme || !strings.EqualFold(u.Host, origin.Host) {
+		return false
+	}
+
+	// 最も具体的に一致するルールを採用する (exclude と include が同じ具体度なら exclude)
+	bestSpecificity := -1
+	included := true
+	for _, spec := range scope.ScopeSpecification {
+		if !matchDomain(spec.Domain, u.Hostname()) || !matchPath(spec.Path, u.Path) {
+			continue
+		}
+		specificity := len(spec.Domain) + len(spec.Path)
+		if specificity > bestSpecificity || specificity == bestSpecificity && spec.Type == "exclude" {
+			bestSpecificity = specificity
+			included = spec.Type != "exclude"
+		}
+	}
+	return included
+}
+
+// sameSite approximates the registrable domain comparison without a public suffix list
+func sameSite(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+func matchDomain(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func matchPath(pattern, path string) bool {
+	if pattern == "" || pattern == "/" {
+		return true
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path == pattern || strings.HasPrefix(path, strings.TrimSuffix(pattern, "/")+"/")
+}
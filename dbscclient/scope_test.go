@@ -0,0 +1,60 @@
+package dbscclient
+
+import (
+	"net/url"
+	"testing"
+
+	"dbsc-demo/server/dbsc/formats"
+)
+
+func TestInScope(t *testing.T) {
+	origin := formats.SessionInstructionScope{Origin: "https://example.com"}
+	site := formats.SessionInstructionScope{Origin: "https://example.com", IncludeSite: true}
+	rules := formats.SessionInstructionScope{
+		Origin:      "https://example.com",
+		IncludeSite: true,
+		ScopeSpecification: []formats.SessionInstructionScopeSpecification{
+			{Type: "exclude", Path: "/static"},
+			{Type: "include", Path: "/static/private"},
+			{Type: "exclude", Domain: "*.cdn.example.com"},
+			{Type: "include", Domain: "api.example.com", Path: "/"},
+			{Type: "exclude", Domain: "api.example.com", Path: "/"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		scope formats.SessionInstructionScope
+		url   string
+		want  bool
+	}{
+		{"same origin", origin, "https://example.com/account", true},
+		{"host case", origin, "https://EXAMPLE.com/", true},
+		{"other scheme", origin, "http://example.com/", false},
+		{"other port", origin, "https://example.com:8443/", false},
+		{"subdomain without site", origin, "https://www.example.com/", false},
+		{"subdomain with site", site, "https://www.example.com/", true},
+		{"other site", site, "https://example.org/", false},
+		{"suffix is not a subdomain", site, "https://badexample.com/", false},
+		{"invalid origin", formats.SessionInstructionScope{Origin: "example.com"}, "https://example.com/", false},
+
+		// 最も具体的なルールが優先し、同じ具体度では exclude が優先する
+		{"excluded path", rules, "https://example.com/static/app.js", false},
+		{"path prefix is not a segment", rules, "https://example.com/statics", true},
+		{"more specific include", rules, "https://example.com/static/private/key", true},
+		{"excluded wildcard domain", rules, "https://img.cdn.example.com/a.png", false},
+		{"wildcard excludes only subdomains", rules, "https://cdn.example.com/a.png", true},
+		{"exclude wins a tie", rules, "https://api.example.com/v1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := inScope(tt.scope, u); got != tt.want {
+				t.Errorf("inScope(%s) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
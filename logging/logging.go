@@ -1,12 +1,83 @@
+// Package logging configures the structured logger shared by the servers.
+//
+// Records are written with log/slog. Attributes carrying secrets (cookie values, proofs,
+// challenges, authorization codes) and any value shaped like a JWT are replaced by a short
+// hash unless RevealSecrets is set, and attributes attached to the request context by
+// Middleware and AddAttrs are added to every record logged with that context.
 package logging
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 )
 
-var Logger *log.Logger
+// Logger is the process wide logger, replaced by Setup
+var Logger *slog.Logger
 
 func init() {
-	Logger = log.New(os.Stdout, "DBSC_DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
+	Setup(Options{})
+}
+
+// Format selects the output encoding
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Options configures Setup
+type Options struct {
+	Level  slog.Level
+	Format Format
+	Output io.Writer
+	// RevealSecrets disables redaction. It is meant for local debugging only.
+	RevealSecrets bool
+}
+
+// Setup replaces Logger (and the slog default logger) according to options
+func Setup(options Options) *slog.Logger {
+	if options.Output == nil {
+		options.Output = os.Stdout
+	}
+	handlerOptions := &slog.HandlerOptions{
+		Level:     options.Level,
+		AddSource: options.Level <= slog.LevelDebug,
+	}
+	if !options.RevealSecrets {
+		handlerOptions.ReplaceAttr = redactAttr
+	}
+
+	var handler slog.Handler
+	if options.Format == FormatJSON {
+		handler = slog.NewJSONHandler(options.Output, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(options.Output, handlerOptions)
+	}
+
+	Logger = slog.New(&contextHandler{Handler: handler})
+	slog.SetDefault(Logger)
+	return Logger
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", value)
+	}
+	return level, nil
+}
+
+// ParseFormat parses text or json
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(strings.ToLower(value)); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid log format %q", value)
+	}
 }
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+// secretKeys are attribute keys whose values are never logged in clear
+var secretKeys = map[string]bool{
+	"cookie":        true,
+	"set_cookie":    true,
+	"proof":         true,
+	"challenge":     true,
+	"authorization": true,
+	"token":         true,
+	"password":      true,
+}
+
+// Hash returns a short stable digest used to correlate secrets and identifiers across records
+func Hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SessionID returns the attribute identifying a DBSC session without logging its identifier
+func SessionID(id string) slog.Attr {
+	return slog.String("session_id_hash", Hash(id))
+}
+
+// Redacted returns the replacement logged in place of a secret
+func Redacted(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED sha256:" + Hash(value) + "]"
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindString && a.Value.Kind() != slog.KindAny {
+		return a
+	}
+	value := a.Value.String()
+	if secretKeys[strings.ToLower(a.Key)] || looksLikeJWT(value) {
+		return slog.String(a.Key, Redacted(value))
+	}
+	return a
+}
+
+// looksLikeJWT reports whether value contains a compact JWS (base64url JSON header, payload and signature)
+func looksLikeJWT(value string) bool {
+	index := strings.Index(value, "eyJ")
+	if index < 0 {
+		return false
+	}
+	token := value[index:]
+	if end := strings.IndexAny(token, " \t\r\n\"',;"); end >= 0 {
+		token = token[:end]
+	}
+	return strings.Count(token, ".") == 2
+}
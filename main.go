@@ -1,97 +1,258 @@
 package main
 
 import (
-	"dbsc-demo/logging"
-	"fmt"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"dbsc-demo/audit"
+	"dbsc-demo/logging"
+	"dbsc-demo/metrics"
+	"dbsc-demo/ratelimit"
+	"dbsc-demo/secheaders"
+	"dbsc-demo/server/admin"
 	"dbsc-demo/server/dbsc"
+	"dbsc-demo/server/dbsc/wellknown"
 	"dbsc-demo/server/traditional"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "useradd" {
+		if err := runUserAdd(os.Args[2:], os.Stdin, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	addr := flag.String("addr", ":8080", "listen address")
+	origin := flag.String("origin", "http://localhost:8080", "origin of this server used for the DBSC session scope")
+	federationRole := flag.String("federation-role", "", `federation role of this server ("provider" or "relying")`)
+	providerURL := flag.String("provider-url", "", "base URL of the federation provider (relying role only)")
+	relyingOrigins := flag.String("relying-origins", "", "comma-separated origins allowed to federate with this provider (provider role only)")
+	registeringOrigins := flag.String("registering-origins", "", "comma-separated origins allowed to register sessions for this server (published in the well-known document)")
+	allowedRefreshInitiators := flag.String("allowed-refresh-initiators", "", "comma-separated host patterns sent as allowed_refresh_initiators (e.g. example.com,*.example.com)")
+	refreshLatencyFloor := flag.Duration("refresh-latency-floor", 0, "delay every /dbsc_refresh response to at least this duration against timing side channels (e.g. 100ms, 0 disables)")
+	refreshGracePeriod := flag.Duration("refresh-grace-period", dbsc.DefaultConfig().RefreshGracePeriod, "how long the previous DBSC cookie stays valid after a refresh, during which refreshes arriving close together share the challenge and the new cookie")
+	proofClockSkew := flag.Duration("proof-clock-skew", dbsc.DefaultConfig().ProofClockSkew, "tolerated difference between the client and server clocks for the iat, exp and nbf of DBSC proofs")
+	sessionPolicies := flag.String("session-policies", "", "JSON file of the DBSC session policies (cookie and session lifetimes, sliding expiry) by user or group (store defaults when empty)")
+	rateLimits := flag.String("rate-limits", "", "comma-separated overrides of the request budgets, name=n/period or name=off (e.g. login-user=5/1m,dbsc-refresh-ip=off)")
+	enforceRefreshInitiators := flag.Bool("enforce-refresh-initiators", false, "reject refresh requests initiated by sites outside allowed-refresh-initiators")
+	logLevel := flag.String("log-level", "info", "log level (debug, info, warn, error); debug also logs secrets in clear")
+	logFormat := flag.String("log-format", "text", "log format (text or json)")
+	auditDir := flag.String("audit-dir", "", "directory of the hash-chained audit log of DBSC security events (disabled when empty)")
+	auditMaxBytes := flag.Int64("audit-max-bytes", audit.DefaultMaxBytes, "size after which the audit log is rotated")
+	auditMaxFiles := flag.Int("audit-max-files", 0, "number of audit files kept after rotation (0 keeps all)")
+	usersFile := flag.String("users-file", "", "JSON file of the login accounts managed with the useradd subcommand (in memory when empty)")
+	adminUser := flag.String("admin-user", "admin", "user name of the admin API")
+	adminPassword := flag.String("admin-password", os.Getenv("DBSC_ADMIN_PASSWORD"), "password of the admin API, disabled when empty (default $DBSC_ADMIN_PASSWORD)")
+	flag.Parse()
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.Setup(logging.Options{
+		Level:         level,
+		Format:        format,
+		RevealSecrets: level <= slog.LevelDebug,
+	})
+
+	config := dbsc.DefaultConfig()
+	config.Origin = *origin
+	config.FederationRole = dbsc.FederationRole(*federationRole)
+	config.ProviderURL = *providerURL
+	config.RelyingOrigins = splitList(*relyingOrigins)
+	config.RegisteringOrigins = splitList(*registeringOrigins)
+	config.AllowedRefreshInitiators = splitList(*allowedRefreshInitiators)
+	config.EnforceRefreshInitiators = *enforceRefreshInitiators
+	config.RefreshLatencyFloor = *refreshLatencyFloor
+	config.RefreshGracePeriod = *refreshGracePeriod
+	config.ProofClockSkew = *proofClockSkew
+
 	traditionalServer := traditional.NewTraditionalServer()
-	dbscServer := dbsc.NewDBSCServer()
+	traditionalServer.SecureCookie = strings.HasPrefix(*origin, "https://")
+	traditionalServer.CSRF.Secure = traditionalServer.SecureCookie
+	if *usersFile != "" {
+		users, err := traditional.OpenFileUserRepository(*usersFile)
+		if err != nil {
+			log.Fatalf("failed to load users: %v", err)
+		}
+		if count, _ := users.CountUsers(); count == 0 {
+			logging.Logger.Warn("no login accounts in the users file, add one with the useradd subcommand", "users_file", *usersFile)
+		}
+		traditionalServer.Users = users
+	} else {
+		// デモ用のアカウントはメモリ上のリポジトリにだけ追加し、ファイルには書き込まない
+		users := traditional.NewMemoryUserRepository()
+		if seeded, err := traditional.SeedDemoUser(users); err != nil {
+			log.Fatalf("failed to add the demo user: %v", err)
+		} else if seeded {
+			logging.Logger.Warn("no users file given, added the demo account test/test")
+		}
+		traditionalServer.Users = users
+	}
+	dbscServer, err := dbsc.NewDBSCServer(config)
+	if err != nil {
+		log.Fatalf("invalid DBSC configuration: %v", err)
+	}
+	if *sessionPolicies != "" {
+		policies, err := dbsc.LoadSessionPolicies(*sessionPolicies)
+		if err != nil {
+			log.Fatalf("failed to load session policies: %v", err)
+		}
+		dbscServer.PolicySelector = policies.Select
+	}
+	if *auditDir != "" {
+		auditLog, err := audit.Open(audit.Options{Dir: *auditDir, MaxBytes: *auditMaxBytes, MaxFiles: *auditMaxFiles})
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+		dbscServer.Observer = dbsc.NewAuditObserver(auditLog)
+	}
 
-	r := setupRouter(traditionalServer, dbscServer)
+	var adminServer *admin.AdminServer
+	if *adminPassword != "" {
+		adminServer = admin.NewAdminServer(dbscServer, dbsc.NewHistory(), *adminUser, *adminPassword)
+		adminServer.CSRF = traditionalServer.CSRF
+	}
 
-	fmt.Println("🚀 DBSC Demo Server starting on http://localhost:8080")
-	fmt.Println("📖 DBSC specification: https://github.com/w3c/webappsec-dbsc")
+	limiter := newLimiter()
+	overrides, err := ratelimit.ParseRates(*rateLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, rate := range overrides {
+		if _, ok := limiter.Rates[name]; !ok {
+			log.Fatalf("unknown rate limit %q", name)
+		}
+		limiter.Rates[name] = rate
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", r))
-}
+	r := setupRouter(traditionalServer, dbscServer, adminServer, limiter)
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapped, r)
-
-		duration := time.Since(start)
-		statusColor := getStatusColor(wrapped.statusCode)
-		methodColor := "\033[36m" // cyan
-		pathColor := "\033[37m"   // white
-		resetColor := "\033[0m"   // reset
-
-		fmt.Printf("%s[%s]%s %s%s%s %s%s%s - %v\n",
-			statusColor, http.StatusText(wrapped.statusCode), resetColor,
-			methodColor, r.Method, resetColor,
-			pathColor, r.URL.Path, resetColor,
-			duration,
-		)
-	})
-}
+	logging.Logger.Info("DBSC demo server starting", "origin", config.Origin, "addr", *addr)
 
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
+	log.Fatal(http.ListenAndServe(*addr, r))
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-func getStatusColor(statusCode int) string {
-	switch {
-	case statusCode >= 200 && statusCode < 300:
-		return "\033[32m" // green
-	case statusCode >= 300 && statusCode < 400:
-		return "\033[33m" // yellow
-	case statusCode >= 400 && statusCode < 500:
-		return "\033[31m" // red
-	case statusCode >= 500:
-		return "\033[35m" // magenta
-	default:
-		return "\033[37m" // white
+// Names of the rate limits, configurable with -rate-limits
+const (
+	limitLoginIP            = "login-ip"
+	limitLoginUser          = "login-user"
+	limitDBSCStartIP        = "dbsc-start-ip"
+	limitDBSCStartUser      = "dbsc-start-user"
+	limitDBSCRefreshIP      = "dbsc-refresh-ip"
+	limitDBSCRefreshSession = "dbsc-refresh-session"
+)
+
+// newLimiter returns a limiter with the default budgets of the endpoints
+func newLimiter() *ratelimit.Limiter {
+	limiter := ratelimit.NewLimiter()
+	limiter.Rates = map[string]ratelimit.Rate{
+		// 総当たり対策。ユーザーごとの制限はロックアウトより先に効かないよう緩めにする
+		limitLoginIP:       ratelimit.PerPeriod(30, time.Minute),
+		limitLoginUser:     ratelimit.PerPeriod(10, time.Minute),
+		limitDBSCStartIP:   ratelimit.PerPeriod(30, time.Minute),
+		limitDBSCStartUser: ratelimit.PerPeriod(10, time.Minute),
+		// リフレッシュはチャレンジと証明の 2 リクエストで、デモのクッキーは 5 秒で切れる
+		limitDBSCRefreshIP:      ratelimit.PerPeriod(600, time.Minute),
+		limitDBSCRefreshSession: ratelimit.PerPeriod(60, time.Minute),
 	}
+	return limiter
 }
 
-func setupRouter(traditionalServer *traditional.TraditionalServer, dbscServer *dbsc.DBSCServer) *mux.Router {
-	logging.Logger.Println("Setting up router")
+// setupRouter wires the servers together. adminServer is optional.
+func setupRouter(traditionalServer *traditional.TraditionalServer, dbscServer *dbsc.DBSCServer, adminServer *admin.AdminServer, limiter *ratelimit.Limiter) *mux.Router {
+	dbscServer.UserResolver = traditionalServer.CurrentUser
+	traditionalServer.OnLogin(dbscServer.StartRegistration)
+	traditionalServer.OnLogout(dbscServer.EndLoginSession)
+	traditionalServer.BoundSession = func(r *http.Request) (*traditional.BoundSession, bool) {
+		session, cookie, ok := dbscServer.CurrentSession(r)
+		if !ok {
+			return nil, false
+		}
+		return &traditional.BoundSession{
+			ID:              session.Identifier,
+			ExpiresAt:       session.ExpiresAt,
+			CookieExpiresAt: cookie.ExpiresAt,
+			RefreshCount:    session.RefreshCount,
+		}, true
+	}
+
+	registry := metrics.NewRegistry()
+	observers := []dbsc.Observer{dbsc.NewMetrics(registry, dbscServer.Store)}
+	if dbscServer.Observer != nil {
+		observers = append([]dbsc.Observer{dbscServer.Observer}, observers...)
+	}
+	if adminServer != nil && adminServer.History != nil {
+		observers = append(observers, adminServer.History)
+	}
+	dbscServer.Observer = dbsc.MultiObserver(observers...)
+
 	r := mux.NewRouter()
 
-	r.Use(loggingMiddleware)
+	r.Use(logging.Middleware)
+	// ルートごとのポリシーがない場合のヘッダー
+	r.Use(secheaders.Default.Handler)
+	page := secheaders.Page.Handler
+	dbscHeaders := secheaders.DBSC(dbscServer.Config.Origin).Handler
+	byUser := func(r *http.Request) string {
+		username, _, _ := traditionalServer.CurrentUser(r)
+		return username
+	}
 
 	r.HandleFunc(traditional.EndpointHome, traditional.HomePageHandler)
-	r.HandleFunc(traditional.EndpointLogin, traditional.LoginPageHandler).Methods("GET")
-	r.HandleFunc(traditional.EndpointLogin, func(w http.ResponseWriter, r *http.Request) {
-		dbscServer.InitRegistrationDBSCSessionMiddleware(http.HandlerFunc(traditionalServer.LoginHandler)).ServeHTTP(w, r)
-	}).Methods("POST")
-	r.HandleFunc(traditional.EndpointUserPage, func(w http.ResponseWriter, r *http.Request) {
-		traditionalServer.VerifyCookieMiddleware(http.HandlerFunc(traditional.UserPageHandler)).ServeHTTP(w, r)
-	})
+	r.Handle(traditional.EndpointLogin, page(http.HandlerFunc(traditionalServer.LoginPageHandler))).Methods("GET")
+	r.Handle(traditional.EndpointLogin, limiter.Handler(traditionalServer.CSRF.Handler(http.HandlerFunc(traditionalServer.LoginHandler)),
+		ratelimit.Limit{Name: limitLoginIP, Key: ratelimit.ByIP},
+		ratelimit.Limit{Name: limitLoginUser, Key: ratelimit.ByFormValue("username")},
+	)).Methods("POST")
+	r.Handle(traditional.EndpointLogout, traditionalServer.CSRF.Handler(http.HandlerFunc(traditionalServer.LogoutHandler))).Methods("POST")
+	r.Handle(traditional.EndpointUserPage, page(traditionalServer.VerifyCookieMiddleware(http.HandlerFunc(traditionalServer.UserPageHandler))))
 
 	// endpoints for DBSC
-	r.HandleFunc(dbsc.EndpointDBSCStart, func(w http.ResponseWriter, r *http.Request) {
-		traditionalServer.VerifyCookieMiddleware(http.HandlerFunc(dbscServer.DBSCRegisterHandler)).ServeHTTP(w, r)
-	})
-	r.HandleFunc(dbsc.EndpointDBSCRefresh, dbscServer.DBSCRefreshHandler).Methods("POST")
+	r.Handle(dbsc.EndpointDBSCStart, dbscHeaders(limiter.Handler(traditionalServer.VerifyCookieMiddleware(http.HandlerFunc(dbscServer.DBSCRegisterHandler)),
+		ratelimit.Limit{Name: limitDBSCStartIP, Key: ratelimit.ByIP},
+		ratelimit.Limit{Name: limitDBSCStartUser, Key: byUser},
+	)))
+	// セッションごとの制限だけでは ID を変えれば回避できるので IP でも制限する
+	r.Handle(dbsc.EndpointDBSCRefresh, dbscHeaders(limiter.Handler(http.HandlerFunc(dbscServer.DBSCRefreshHandler),
+		ratelimit.Limit{Name: limitDBSCRefreshIP, Key: ratelimit.ByIP},
+		ratelimit.Limit{Name: limitDBSCRefreshSession, Key: ratelimit.ByHeader("Sec-Session-Id")},
+	))).Methods("POST")
+
+	// endpoints for DBSC federation
+	r.HandleFunc(wellknown.Path, dbscServer.WellKnownHandler).Methods("GET")
+	r.HandleFunc(dbsc.EndpointFederationStart, dbscServer.FederationStartHandler).Methods("GET")
+	r.HandleFunc(dbsc.EndpointFederationHandoff, dbscServer.FederationHandoffHandler).Methods("GET")
+	r.HandleFunc(dbsc.EndpointFederationSessionKey, dbscServer.FederationSessionKeyHandler).Methods("GET")
+
+	r.Handle("/metrics", registry.Handler()).Methods("GET")
+
+	if adminServer != nil {
+		r.Handle(strings.TrimSuffix(admin.EndpointPrefix, "/"), http.RedirectHandler(admin.EndpointPrefix, http.StatusMovedPermanently))
+		r.PathPrefix(admin.EndpointPrefix).Handler(secheaders.Admin.Handler(adminServer.Handler()))
+	}
 
 	// api
 	r.HandleFunc("/debug/check_dbsc_session", func(w http.ResponseWriter, r *http.Request) {
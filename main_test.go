@@ -0,0 +1,1780 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/conformance"
+	"dbsc-demo/csrf"
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/random"
+	"dbsc-demo/ratelimit"
+	"dbsc-demo/server/admin"
+	"dbsc-demo/server/dbsc"
+	"dbsc-demo/server/dbsc/formats"
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+	"dbsc-demo/server/traditional"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+type testEnv struct {
+	server      *httptest.Server
+	dbsc        *dbsc.DBSCServer
+	manager     *dbsc.DBSCSessionManager
+	traditional *traditional.TraditionalServer
+	admin       *admin.AdminServer
+	limiter     *ratelimit.Limiter
+	clock       *clock.Fake
+}
+
+// newTestEnv starts the demo server. configure adjusts the DBSC configuration before the
+// server is created.
+func newTestEnv(t *testing.T, configure ...func(*dbsc.Config)) *testEnv {
+	t.Helper()
+	config := dbsc.DefaultConfig()
+	for _, f := range configure {
+		f(&config)
+	}
+	dbscServer, err := dbsc.NewDBSCServer(config)
+	if err != nil {
+		t.Fatalf("NewDBSCServer: %v", err)
+	}
+	traditionalServer := traditional.NewTraditionalServer()
+
+	// 有効期限は時計を進めて検証する
+	fake := clock.NewFake(time.Now())
+	manager := dbscServer.Store.(*dbsc.DBSCSessionManager)
+	manager.Clock = fake
+	dbscServer.DBSCProofVerifier.Clock = fake
+	dbscServer.Clock = fake
+	traditionalServer.SessionManager.Clock = fake
+	traditionalServer.Lockout.Clock = fake
+	// ログインを速くするため test/test は小さいパラメータでハッシュする。conformance の
+	// チェックは実時間で動き、固定した時計で発行した 5 秒のクッキーに間に合う必要がある
+	addTestUser(t, traditionalServer.Users, "test", "test")
+
+	adminServer := admin.NewAdminServer(dbscServer, dbsc.NewHistory(), "admin", "secret")
+	adminServer.Clock = fake
+
+	// httptest のオリジンをセッションスコープとセキュリティヘッダーに反映してからルーターを作る
+	server := httptest.NewServer(nil)
+	t.Cleanup(server.Close)
+	dbscServer.Config.Origin = server.URL
+	limiter := newLimiter()
+	limiter.Clock = fake
+	server.Config.Handler = setupRouter(traditionalServer, dbscServer, adminServer, limiter)
+	return &testEnv{server: server, dbsc: dbscServer, manager: manager, traditional: traditionalServer, admin: adminServer, limiter: limiter, clock: fake}
+}
+
+var testArgon2Params = traditional.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func addTestUser(t *testing.T, users traditional.UserRepository, name, password string) {
+	t.Helper()
+	hash, err := traditional.HashPassword(password, testArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddUser(&traditional.User{Name: name, PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) url(path string) string {
+	return e.server.URL + path
+}
+
+func (e *testEnv) newClient(t *testing.T, algorithm string) *dbscclient.Client {
+	t.Helper()
+	client, err := dbscclient.New(algorithm)
+	if err != nil {
+		t.Fatalf("dbscclient.New: %v", err)
+	}
+	client.Clock = e.clock
+	client.OnRegistrationError = func(err error) {
+		t.Errorf("registration failed: %v", err)
+	}
+	return client
+}
+
+func (e *testEnv) login(t *testing.T, client *dbscclient.Client) *dbscclient.Session {
+	t.Helper()
+	return e.loginAs(t, client, "test", "test")
+}
+
+func (e *testEnv) loginAs(t *testing.T, client *dbscclient.Client, username, password string) *dbscclient.Session {
+	t.Helper()
+	res, err := client.PostForm(e.url("/login"), url.Values{"username": {username}, "password": {password}})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("login status = %d", res.StatusCode)
+	}
+	sessions := client.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("registered sessions = %d, want 1", len(sessions))
+	}
+	return sessions[0]
+}
+
+// rawLogin logs in without reacting to DBSC headers and returns the registration entry
+func (e *testEnv) rawLogin(t *testing.T, client *http.Client) *formats.SecureSessionRegistrationEntry {
+	t.Helper()
+	res, err := client.PostForm(e.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	res.Body.Close()
+	header, err := formats.ParseSecureSessionRegistrationHeader(res.Header.Get("Sec-Session-Registration"))
+	if err != nil {
+		t.Fatalf("registration header: %v", err)
+	}
+	return header[0]
+}
+
+func post(t *testing.T, client *http.Client, rawURL string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", rawURL, err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res
+}
+
+// signProof signs claims, stamping iat from the test clock unless set
+func (e *testEnv) signProof(t *testing.T, key crypto.Signer, claims dbscclient.ProofClaims) string {
+	t.Helper()
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = e.clock.Now().Unix()
+	}
+	proof, err := dbscclient.SignProof(key, claims)
+	if err != nil {
+		t.Fatalf("SignProof: %v", err)
+	}
+	return proof
+}
+
+// refreshChallenge asks the refresh endpoint for a challenge of the session
+func (e *testEnv) refreshChallenge(t *testing.T, client *http.Client, sessionID string) string {
+	t.Helper()
+	res := post(t, client, e.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": sessionID})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("challenge status = %d, want 401", res.StatusCode)
+	}
+	header, err := formats.ParseSecureSessionChallengeHeader(res.Header.Get("Sec-Session-Challenge"))
+	if err != nil {
+		t.Fatalf("challenge header: %v", err)
+	}
+	if header[0].ID != sessionID {
+		t.Fatalf("challenge id = %q, want %q", header[0].ID, sessionID)
+	}
+	return header[0].Challenge
+}
+
+func getStatus(t *testing.T, client interface {
+	Get(string) (*http.Response, error)
+}, rawURL string) int {
+	t.Helper()
+	res, err := client.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestLoginSendsRegistrationHeader(t *testing.T) {
+	env := newTestEnv(t)
+
+	entry := env.rawLogin(t, &http.Client{})
+	if entry.Params.Path != dbsc.EndpointDBSCStart {
+		t.Errorf("path = %q, want %q", entry.Params.Path, dbsc.EndpointDBSCStart)
+	}
+	if entry.Params.Challenge == "" || entry.Params.Authorization == "" {
+		t.Errorf("challenge and authorization must be set: %+v", entry.Params)
+	}
+	if strings.Join(entry.Algorithms, " ") != "ES256 RS256" {
+		t.Errorf("algorithms = %v", entry.Algorithms)
+	}
+
+	res, err := http.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("Sec-Session-Registration") != "" {
+		t.Errorf("failed login: status = %d, registration = %q", res.StatusCode, res.Header.Get("Sec-Session-Registration"))
+	}
+}
+
+func TestRegistrationAndProtectedAccess(t *testing.T) {
+	for _, algorithm := range []string{dbscclient.AlgorithmES256, dbscclient.AlgorithmRS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			env := newTestEnv(t)
+			client := env.newClient(t, algorithm)
+			session := env.login(t, client)
+
+			instruction := session.Instruction
+			if !instruction.Continue || instruction.RefreshURL != dbsc.EndpointDBSCRefresh {
+				t.Errorf("unexpected instruction: %+v", instruction)
+			}
+			if instruction.Scope.Origin != env.server.URL {
+				t.Errorf("scope origin = %q, want %q", instruction.Scope.Origin, env.server.URL)
+			}
+			if len(instruction.Credentials) != 1 || instruction.Credentials[0].Name != "dbsc_cookie" {
+				t.Errorf("unexpected credentials: %+v", instruction.Credentials)
+			}
+
+			if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+				t.Errorf("protected status = %d, want 200", status)
+			}
+		})
+	}
+}
+
+func TestMultipleUsers(t *testing.T) {
+	env := newTestEnv(t)
+	addTestUser(t, env.traditional.Users, "alice", "correct horse")
+
+	// ユーザーごとに別の鍵で別のセッションが登録される
+	sessions := map[string]*dbscclient.Session{
+		"test":  env.login(t, env.newClient(t, dbscclient.AlgorithmES256)),
+		"alice": env.loginAs(t, env.newClient(t, dbscclient.AlgorithmES256), "alice", "correct horse"),
+	}
+	if sessions["test"].ID == sessions["alice"].ID {
+		t.Fatal("users share a session")
+	}
+	for user, session := range sessions {
+		stored, ok := env.manager.GetSession(session.ID)
+		if !ok || stored.User != user {
+			t.Errorf("session of %s = %+v", user, stored)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	login := func(username, password string) *http.Response {
+		t.Helper()
+		res, err := http.PostForm(env.url("/login"), url.Values{"username": {username}, "password": {password}})
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < env.traditional.Lockout.MaxFailures; i++ {
+		if res := login("test", "wrong"); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want 401", i+1, res.StatusCode)
+		}
+	}
+	// ロック中は正しいパスワードでも拒否する
+	res := login("test", "test")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("locked status = %d, want 429", res.StatusCode)
+	}
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "900" {
+		t.Errorf("Retry-After = %q, want 900", retryAfter)
+	}
+	// 存在しないユーザーも同じ扱い
+	if res := login("nobody", "wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unknown user status = %d, want 401", res.StatusCode)
+	}
+
+	env.clock.Advance(env.traditional.Lockout.LockoutDuration)
+	if res := login("test", "test"); res.StatusCode != http.StatusOK {
+		t.Errorf("status after lockout = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	env := newTestEnv(t)
+	env.limiter.Rates[limitLoginUser] = ratelimit.PerPeriod(2, time.Minute)
+	env.limiter.Rates[limitDBSCRefreshSession] = ratelimit.PerPeriod(2, time.Minute)
+
+	// ロックアウトより先にユーザーごとの制限に達する
+	for i := 0; i < 2; i++ {
+		res, err := http.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"wrong"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	res, err := http.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "30" {
+		t.Errorf("login over budget: status = %d, Retry-After = %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+
+	// 存在しないセッションでもチャレンジの発行は制限する
+	client := &http.Client{}
+	for i := 0; i < 2; i++ {
+		if res := post(t, client, env.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": "flood"}); res.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("refresh %d was rate limited", i+1)
+		}
+	}
+	if res := post(t, client, env.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": "flood"}); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("refresh over budget: status = %d, want 429", res.StatusCode)
+	}
+
+	env.clock.Advance(30 * time.Second)
+	env.login(t, env.newClient(t, dbscclient.AlgorithmES256))
+}
+
+// sessionCookie returns the traditional session cookie set by res
+func sessionCookie(t *testing.T, res *http.Response) *http.Cookie {
+	t.Helper()
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == traditional.CookieName {
+			return cookie
+		}
+	}
+	t.Fatalf("%s not set", traditional.CookieName)
+	return nil
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	env := newTestEnv(t)
+	res, err := http.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	cookie := sessionCookie(t, res)
+	if !cookie.HttpOnly || cookie.Path != "/" || cookie.SameSite != http.SameSiteLaxMode || cookie.Secure {
+		t.Errorf("cookie attributes = %s", cookie)
+	}
+	if want := int(env.traditional.SessionManager.AbsoluteTimeout.Seconds()); cookie.MaxAge != want {
+		t.Errorf("Max-Age = %d, want %d", cookie.MaxAge, want)
+	}
+
+	env.traditional.SecureCookie = true
+	res, err = http.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if cookie := sessionCookie(t, res); !cookie.Secure {
+		t.Errorf("cookie without Secure: %s", cookie)
+	}
+}
+
+func TestLoginReplacesSession(t *testing.T) {
+	env := newTestEnv(t)
+	login := func(cookie *http.Cookie) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, env.url("/login"), strings.NewReader("username=test&password=test"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return sessionCookie(t, res).Value
+	}
+
+	// 攻撃者が仕込んだクッキーの値は採用しない
+	planted := &http.Cookie{Name: traditional.CookieName, Value: "attacker-chosen"}
+	first := login(planted)
+	if first == planted.Value {
+		t.Fatal("login adopted the planted session cookie")
+	}
+	// ログイン済みのセッションも引き継がず、古いクッキーは無効になる
+	second := login(&http.Cookie{Name: traditional.CookieName, Value: first})
+	if second == first {
+		t.Fatal("login kept the previous session cookie")
+	}
+	if env.traditional.SessionManager.VerifyCookie(first) {
+		t.Error("previous session still valid after login")
+	}
+	if !env.traditional.SessionManager.VerifyCookie(second) {
+		t.Error("new session not valid")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status before logout = %d", status)
+	}
+
+	noRedirect := *client.HTTPClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	res := post(t, &noRedirect, env.url(traditional.EndpointLogout), nil)
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != traditional.EndpointLogin {
+		t.Errorf("logout response = %d %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	if cookie := sessionCookie(t, res); cookie.MaxAge >= 0 {
+		t.Errorf("session cookie not removed: %s", cookie)
+	}
+
+	// ログインから登録された DBSC セッションも終了する
+	if _, ok := env.manager.GetSession(session.ID); ok {
+		t.Error("DBSC session survived logout")
+	}
+	if status := getStatus(t, client.HTTPClient, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Errorf("protected status after logout = %d, want 401", status)
+	}
+	res, err := noRedirect.Get(env.url("/userpage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Errorf("user page status after logout = %d, want 302", res.StatusCode)
+	}
+	events := env.admin.History.Events(session.ID)
+	if last := events[len(events)-1]; last.Type != dbsc.EventTerminated || last.TerminateReason != dbsc.TerminateLogout {
+		t.Errorf("last event = %+v, want terminated by logout", last)
+	}
+}
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf[-_]token" (?:value|content)="([^"]+)"`)
+
+// csrfToken loads a page with client and returns the CSRF token embedded in it
+func csrfToken(t *testing.T, client *http.Client, req *http.Request) string {
+	t.Helper()
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	match := csrfTokenPattern.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("%s has no CSRF token", req.URL.Path)
+	}
+	return string(match[1])
+}
+
+func TestLoginCSRF(t *testing.T) {
+	env := newTestEnv(t)
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	loginPage, _ := http.NewRequest(http.MethodGet, env.url("/login"), nil)
+	token := csrfToken(t, browser, loginPage)
+
+	login := func(headers map[string]string, token string) int {
+		t.Helper()
+		form := url.Values{"username": {"test"}, "password": {"test"}}
+		if token != "" {
+			form.Set(csrf.FieldName, token)
+		}
+		req, _ := http.NewRequest(http.MethodPost, env.url("/login"), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		token   string
+		want    int
+	}{
+		{"cross-site form post", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, token, http.StatusForbidden},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}, token, http.StatusForbidden},
+		{"same origin without token", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": env.server.URL}, "", http.StatusForbidden},
+		{"same origin with token", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": env.server.URL}, token, http.StatusOK},
+	} {
+		if status := login(tc.headers, tc.token); status != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.want)
+		}
+	}
+
+	// ログアウトフォームにもトークンが埋め込まれる
+	userPage, _ := http.NewRequest(http.MethodGet, env.url("/userpage"), nil)
+	if got := csrfToken(t, browser, userPage); got != token {
+		t.Errorf("user page token = %q, want %q", got, token)
+	}
+}
+
+func TestAdminCSRF(t *testing.T) {
+	env := newTestEnv(t)
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	dashboard, _ := http.NewRequest(http.MethodGet, env.url("/admin/"), nil)
+	dashboard.SetBasicAuth("admin", "secret")
+	token := csrfToken(t, browser, dashboard)
+
+	revoke := func(headers map[string]string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodDelete, env.url("/admin/users/test/sessions"), nil)
+		req.SetBasicAuth("admin", "secret")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// ブラウザは Basic 認証の資格情報を自動で送るため、クロスサイトのリクエストは拒否する
+	if status := revoke(map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example", csrf.HeaderName: token}); status != http.StatusForbidden {
+		t.Errorf("cross-site status = %d, want 403", status)
+	}
+	if status := revoke(map[string]string{"Sec-Fetch-Site": "same-origin"}); status != http.StatusForbidden {
+		t.Errorf("status without token = %d, want 403", status)
+	}
+	if status := revoke(map[string]string{"Sec-Fetch-Site": "same-origin", csrf.HeaderName: token}); status != http.StatusOK {
+		t.Errorf("dashboard request status = %d, want 200", status)
+	}
+	// curl などブラウザ以外のクライアントはトークンなしで使える
+	if status, _ := env.adminRequest(t, http.MethodDelete, "/admin/users/test/sessions"); status != http.StatusOK {
+		t.Errorf("non-browser status = %d, want 200", status)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	env.login(t, client)
+	noRedirect := *client.HTTPClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	pageCSP := regexp.MustCompile(`^default-src 'none'; script-src 'nonce-([^']+)'; style-src 'nonce-([^']+)'; connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'$`)
+	dbscCSP := "default-src 'none'; frame-ancestors 'none'"
+	for _, tc := range []struct {
+		method, path string
+		page         bool
+		headers      map[string]string
+	}{
+		{method: http.MethodGet, path: "/login", page: true, headers: map[string]string{"Cross-Origin-Opener-Policy": "same-origin"}},
+		{method: http.MethodGet, path: "/userpage", page: true, headers: map[string]string{"Cache-Control": "no-store, no-cache, must-revalidate, max-age=0"}},
+		{method: http.MethodGet, path: "/admin/", page: true, headers: map[string]string{"Cache-Control": "no-store"}},
+		{method: http.MethodGet, path: "/admin/sessions", headers: map[string]string{"Cache-Control": "no-store"}},
+		{method: http.MethodPost, path: dbsc.EndpointDBSCStart, headers: map[string]string{
+			"Content-Security-Policy": dbscCSP, "Access-Control-Allow-Origin": env.server.URL, "Cache-Control": "no-store", "Referrer-Policy": "no-referrer",
+		}},
+		{method: http.MethodPost, path: dbsc.EndpointDBSCRefresh, headers: map[string]string{
+			"Content-Security-Policy": dbscCSP, "Access-Control-Allow-Origin": env.server.URL, "Cache-Control": "no-store", "Referrer-Policy": "no-referrer",
+		}},
+		{method: http.MethodGet, path: "/metrics", headers: map[string]string{"Content-Security-Policy": dbscCSP, "Access-Control-Allow-Origin": ""}},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, env.url(tc.path), nil)
+			req.SetBasicAuth("admin", "secret")
+			res, err := noRedirect.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			for name, want := range map[string]string{"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff", "Access-Control-Allow-Credentials": ""} {
+				if got := res.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tc.headers {
+				if got := res.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if !tc.page {
+				return
+			}
+			// インラインのスクリプトとスタイルはヘッダーの nonce を持つ
+			match := pageCSP.FindStringSubmatch(res.Header.Get("Content-Security-Policy"))
+			if match == nil {
+				t.Fatalf("Content-Security-Policy = %q", res.Header.Get("Content-Security-Policy"))
+			}
+			for _, element := range []string{"<script", "<style"} {
+				if !strings.Contains(string(body), element+` nonce="`+match[1]+`"`) {
+					t.Errorf("%s without the nonce", element)
+				}
+			}
+			if strings.Contains(string(body), "onclick=") {
+				t.Error("inline event handler blocked by the CSP")
+			}
+		})
+	}
+}
+
+func TestUserAdd(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	if err := runUserAdd([]string{"-users-file", path, "alice"}, strings.NewReader("secret\n"), io.Discard); err != nil {
+		t.Fatalf("useradd: %v", err)
+	}
+	if err := runUserAdd([]string{"-users-file", path, "alice"}, strings.NewReader("other\n"), io.Discard); !errors.Is(err, traditional.ErrUserExists) {
+		t.Errorf("duplicate useradd error = %v, want ErrUserExists", err)
+	}
+	if err := runUserAdd([]string{"-users-file", path}, strings.NewReader("secret\n"), io.Discard); err == nil {
+		t.Error("useradd without a name succeeded")
+	}
+	if err := runUserAdd([]string{"bob"}, strings.NewReader("secret\n"), io.Discard); err == nil {
+		t.Error("useradd without a users file succeeded")
+	}
+
+	users, err := traditional.OpenFileUserRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, ok, err := users.FindUser("alice")
+	if err != nil || !ok {
+		t.Fatalf("alice not found: %v", err)
+	}
+	if valid, err := traditional.VerifyPassword(user.PasswordHash, "secret"); err != nil || !valid {
+		t.Errorf("password not stored: %v", err)
+	}
+}
+
+func TestCookieExpiryTriggersRefresh(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	env.login(t, client)
+
+	env.clock.Advance(env.manager.CookieLifetime)
+
+	// 期限切れのクッキーではアクセスできない
+	if status := getStatus(t, client.HTTPClient, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Fatalf("status with expired cookie = %d, want 401", status)
+	}
+	// クライアントはリフレッシュしてからアクセスする
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status after refresh = %d, want 200", status)
+	}
+}
+
+func TestUserPage(t *testing.T) {
+	// ページはバイナリに埋め込まれているため、作業ディレクトリに依存しない
+	t.Chdir(t.TempDir())
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+
+	userPage := func() string {
+		t.Helper()
+		res, err := client.Get(env.url("/userpage"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("user page status = %d", res.StatusCode)
+		}
+		return string(body)
+	}
+
+	if status := getStatus(t, client, env.url("/login")); status != http.StatusOK {
+		t.Fatalf("login page status = %d", status)
+	}
+	session := env.login(t, client)
+	body := userPage()
+	for _, want := range []string{"<strong>test</strong>", session.ID, "リフレッシュ回数: 0", "data-expires-at="} {
+		if !strings.Contains(body, want) {
+			t.Errorf("user page missing %q", want)
+		}
+	}
+
+	env.clock.Advance(env.manager.CookieLifetime)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status after refresh = %d", status)
+	}
+	if body := userPage(); !strings.Contains(body, "リフレッシュ回数: 1") {
+		t.Error("user page does not show the refresh")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	env.login(t, client)
+	env.clock.Advance(env.manager.CookieLifetime)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status after refresh = %d, want 200", status)
+	}
+
+	res, err := http.Get(env.url("/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	for _, line := range []string{
+		"dbsc_registrations_total 1",
+		"dbsc_refreshes_total 1",
+		`dbsc_challenges_issued_total{phase="refresh"} 1`,
+		"dbsc_refresh_duration_seconds_count 1",
+		"dbsc_live_sessions 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+// adminRequest calls the admin API and decodes the JSON response
+func (e *testEnv) adminRequest(t *testing.T, method, path string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, e.url(path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	var body map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return res.StatusCode, body
+}
+
+func TestAdminRequiresAuthentication(t *testing.T) {
+	env := newTestEnv(t)
+	for _, credentials := range [][2]string{{"", ""}, {"admin", "wrong"}, {"other", "secret"}} {
+		req, _ := http.NewRequest(http.MethodGet, env.url("/admin/sessions"), nil)
+		if credentials[0] != "" {
+			req.SetBasicAuth(credentials[0], credentials[1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%v: status = %d, want 401 with a challenge", credentials, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	count := func(query string) int {
+		t.Helper()
+		status, body := env.adminRequest(t, http.MethodGet, "/admin/sessions"+query)
+		if status != http.StatusOK {
+			t.Fatalf("list%s status = %d", query, status)
+		}
+		return len(body["sessions"].([]any))
+	}
+	_, body := env.adminRequest(t, http.MethodGet, "/admin/sessions")
+	listed := body["sessions"].([]any)[0].(map[string]any)
+	if listed["id"] != session.ID || listed["user"] != "test" || listed["key_thumbprint"] == "" {
+		t.Fatalf("listed session = %v", listed)
+	}
+	for query, want := range map[string]int{
+		"?user=test":  1,
+		"?user=other": 0,
+		"?thumbprint=" + listed["key_thumbprint"].(string): 1,
+		"?thumbprint=unknown":                              0,
+		"?max_age=1m":                                      1,
+		"?min_age=1m":                                      0,
+	} {
+		if got := count(query); got != want {
+			t.Errorf("list%s = %d sessions, want %d", query, got, want)
+		}
+	}
+
+	// リフレッシュの回数と履歴
+	env.clock.Advance(env.manager.CookieLifetime)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status after refresh = %d", status)
+	}
+	_, body = env.adminRequest(t, http.MethodGet, "/admin/sessions/"+session.ID)
+	if refreshes := body["session"].(map[string]any)["refresh_count"]; refreshes != 1.0 {
+		t.Errorf("refresh_count = %v, want 1", refreshes)
+	}
+	var history []string
+	for _, event := range body["history"].([]any) {
+		history = append(history, event.(map[string]any)["type"].(string))
+	}
+	if got := strings.Join(history, ","); got != "registered,challenge_issued,refreshed" {
+		t.Errorf("history = %s", got)
+	}
+
+	// 再チャレンジを要求すると、Cookie が無効になり新しいチャレンジでリフレッシュする
+	if status, _ := env.adminRequest(t, http.MethodPost, "/admin/sessions/"+session.ID+"/rechallenge"); status != http.StatusOK {
+		t.Fatalf("rechallenge status = %d", status)
+	}
+	if status := getStatus(t, client.HTTPClient, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Fatalf("status after rechallenge = %d, want 401", status)
+	}
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Fatalf("status after re-challenged refresh = %d, want 200", status)
+	}
+
+	// 失効後はリフレッシュできず、履歴のみ参照できる
+	if status, _ := env.adminRequest(t, http.MethodDelete, "/admin/sessions/"+session.ID); status != http.StatusOK {
+		t.Fatalf("revoke status = %d", status)
+	}
+	if status, _ := env.adminRequest(t, http.MethodDelete, "/admin/sessions/"+session.ID); status != http.StatusNotFound {
+		t.Errorf("second revoke status = %d, want 404", status)
+	}
+	if count("") != 0 {
+		t.Error("revoked session still listed")
+	}
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Errorf("status after revocation = %d, want 401", status)
+	}
+	_, body = env.adminRequest(t, http.MethodGet, "/admin/sessions/"+session.ID)
+	events := body["history"].([]any)
+	if last := events[len(events)-1].(map[string]any); body["session"] != nil || last["type"] != "terminated" || last["reason"] != "revoked" {
+		t.Errorf("history after revocation = %v", body)
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+	post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id":       session.ID,
+		"Sec-Session-Response": "not-a-proof",
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, env.url("/admin/"), nil)
+	req.SetBasicAuth("admin", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "/admin/failures") {
+		t.Fatalf("dashboard = %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	_, failures := env.adminRequest(t, http.MethodGet, "/admin/failures")
+	got := failures["failures"].([]any)
+	if len(got) != 1 {
+		t.Fatalf("failures = %v", failures)
+	}
+	if failure := got[0].(map[string]any); failure["session_id"] != session.ID || failure["reason"] != "malformed_proof" || failure["user"] != "test" {
+		t.Errorf("failure = %v", failure)
+	}
+}
+
+func TestAdminRevokeUserSessions(t *testing.T) {
+	env := newTestEnv(t)
+	for i := 0; i < 2; i++ {
+		env.login(t, env.newClient(t, dbscclient.AlgorithmES256))
+	}
+	status, body := env.adminRequest(t, http.MethodDelete, "/admin/users/test/sessions")
+	if status != http.StatusOK || len(body["revoked"].([]any)) != 2 {
+		t.Fatalf("revoke user sessions = %d %v", status, body)
+	}
+	if _, body := env.adminRequest(t, http.MethodGet, "/admin/sessions"); len(body["sessions"].([]any)) != 0 {
+		t.Errorf("sessions left: %v", body)
+	}
+}
+
+func TestRefreshChallengeAndRefresh(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	challenge := env.refreshChallenge(t, client.HTTPClient, session.ID)
+	proof := env.signProof(t, session.Key, dbscclient.ProofClaims{
+		Audience: env.url(dbsc.EndpointDBSCRefresh),
+		JTI:      challenge,
+		Subject:  session.ID,
+	})
+	res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id":       session.ID,
+		"Sec-Session-Response": proof,
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh status = %d, want 200", res.StatusCode)
+	}
+	if !strings.HasPrefix(res.Header.Get("Set-Cookie"), "dbsc_cookie=") {
+		t.Errorf("refresh must set dbsc_cookie, got %q", res.Header.Get("Set-Cookie"))
+	}
+
+	// 同じ proof の再送 (リプレイ) は拒否される
+	res = post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id":       session.ID,
+		"Sec-Session-Response": proof,
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed refresh status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestRefreshInitiators(t *testing.T) {
+	env := newTestEnv(t)
+	env.dbsc.Config.AllowedRefreshInitiators = []string{"*.example.com"}
+	env.dbsc.Config.EnforceRefreshInitiators = true
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	// refresh はチャレンジの取得とリフレッシュを同じヘッダーで行い、最後のステータスを返す
+	refresh := func(headers map[string]string) int {
+		t.Helper()
+		res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), merge(headers, map[string]string{"Sec-Session-Id": session.ID}))
+		header, err := formats.ParseSecureSessionChallengeHeader(res.Header.Get("Sec-Session-Challenge"))
+		if err != nil {
+			return res.StatusCode
+		}
+		proof := env.signProof(t, session.Key, dbscclient.ProofClaims{
+			Audience: env.url(dbsc.EndpointDBSCRefresh),
+			JTI:      header[0].Challenge,
+			Subject:  session.ID,
+		})
+		res = post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), merge(headers, map[string]string{
+			"Sec-Session-Id":       session.ID,
+			"Sec-Session-Response": proof,
+		}))
+		return res.StatusCode
+	}
+	lastInitiator := func() string {
+		t.Helper()
+		stored, ok := env.manager.GetSession(session.ID)
+		if !ok {
+			t.Fatal("session not found")
+		}
+		return stored.LastRefreshInitiator
+	}
+
+	tests := []struct {
+		name          string
+		headers       map[string]string
+		wantStatus    int
+		wantInitiator string
+	}{
+		{"allowed origin", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://app.example.com"}, http.StatusOK, "app.example.com"},
+		{"allowed referer", map[string]string{"Sec-Fetch-Site": "same-site", "Referer": "https://www.example.com/page"}, http.StatusOK, "www.example.com"},
+		{"other site", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.test"}, http.StatusUnauthorized, "www.example.com"},
+		{"cross-site without origin", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusUnauthorized, "www.example.com"},
+		{"same-site without origin", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "null"}, http.StatusUnauthorized, "www.example.com"},
+		{"same origin", map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusOK, ""},
+		{"origin of the server", map[string]string{"Origin": env.server.URL}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		if status := refresh(tt.headers); status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+		if initiator := lastInitiator(); initiator != tt.wantInitiator {
+			t.Errorf("%s: last initiator = %q, want %q", tt.name, initiator, tt.wantInitiator)
+		}
+	}
+
+	// 検証できない証明では記録を書き換えない
+	res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Fetch-Site":       "cross-site",
+		"Origin":               "https://app.example.com",
+		"Sec-Session-Id":       session.ID,
+		"Sec-Session-Response": "invalid",
+	})
+	if res.StatusCode != http.StatusBadRequest || lastInitiator() != "" {
+		t.Errorf("unverified refresh: status = %d, last initiator = %q", res.StatusCode, lastInitiator())
+	}
+
+	// 強制しない場合は発信元の分からない別サイトとして記録する
+	env.dbsc.Config.EnforceRefreshInitiators = false
+	if status := refresh(map[string]string{"Sec-Fetch-Site": "cross-site"}); status != http.StatusOK || lastInitiator() != "(unknown)" {
+		t.Errorf("unenforced: status = %d, last initiator = %q", status, lastInitiator())
+	}
+}
+
+func merge(headers ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, h := range headers {
+		for name, value := range h {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// dbscCookieOf returns the DBSC cookie set by res
+func dbscCookieOf(t *testing.T, res *http.Response) *http.Cookie {
+	t.Helper()
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == dbsc.DefaultCookieName {
+			return cookie
+		}
+	}
+	t.Fatalf("no %s in %v", dbsc.DefaultCookieName, res.Header.Values("Set-Cookie"))
+	return nil
+}
+
+func checkWithCookie(t *testing.T, env *testEnv, cookie *http.Cookie) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, env.url("/api/check_dbsc_session"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestConcurrentRefreshSharesCookie(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+	refresh := func(proof string) *http.Response {
+		t.Helper()
+		return post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+			"Sec-Session-Id":       session.ID,
+			"Sec-Session-Response": proof,
+		})
+	}
+	claims := dbscclient.ProofClaims{
+		Audience: env.url(dbsc.EndpointDBSCRefresh),
+		JTI:      env.refreshChallenge(t, client.HTTPClient, session.ID),
+		Subject:  session.ID,
+	}
+
+	// 2 つのタブが同じチャレンジに署名した場合 (ES256 の署名は毎回異なる)
+	first := refresh(env.signProof(t, session.Key, claims))
+	proof := env.signProof(t, session.Key, claims)
+	second := refresh(proof)
+	if first.StatusCode != http.StatusOK || second.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, %d, want 200", first.StatusCode, second.StatusCode)
+	}
+	if a, b := dbscCookieOf(t, first).Value, dbscCookieOf(t, second).Value; a != b {
+		t.Errorf("concurrent refreshes got different cookies %q and %q", a, b)
+	}
+	if current, _ := env.manager.GetSession(session.ID); current.RefreshCount != 1 {
+		t.Errorf("refresh count = %d, want 1", current.RefreshCount)
+	}
+
+	// 同じ証明の再送はリプレイ
+	if res := refresh(proof); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed proof status = %d, want 400", res.StatusCode)
+	}
+	// 猶予期間を過ぎたチャレンジは使えない
+	env.clock.Advance(env.dbsc.Config.RefreshGracePeriod)
+	if res := refresh(env.signProof(t, session.Key, claims)); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("proof after the grace period status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestStaggeredRefreshSharesChallenge(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	// 少し遅れて届いた別のタブのチャレンジ要求にも、未使用のチャレンジを返す
+	first := env.refreshChallenge(t, client.HTTPClient, session.ID)
+	env.clock.Advance(env.dbsc.Config.RefreshGracePeriod / 2)
+	if second := env.refreshChallenge(t, client.HTTPClient, session.ID); second != first {
+		t.Fatalf("staggered challenge requests got %q and %q", first, second)
+	}
+
+	claims := dbscclient.ProofClaims{Audience: env.url(dbsc.EndpointDBSCRefresh), JTI: first, Subject: session.ID}
+	var cookies []string
+	for i := 0; i < 2; i++ {
+		res := post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+			"Sec-Session-Id":       session.ID,
+			"Sec-Session-Response": env.signProof(t, session.Key, claims),
+		})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("refresh %d: status = %d", i+1, res.StatusCode)
+		}
+		cookies = append(cookies, dbscCookieOf(t, res).Value)
+		env.clock.Advance(env.dbsc.Config.RefreshGracePeriod / 4)
+	}
+	if cookies[0] != cookies[1] {
+		t.Errorf("staggered refreshes got different cookies %q and %q", cookies[0], cookies[1])
+	}
+	if current, _ := env.manager.GetSession(session.ID); current.RefreshCount != 1 {
+		t.Errorf("refresh count = %d, want 1", current.RefreshCount)
+	}
+
+	// 使用済みのチャレンジは再利用しない
+	if next := env.refreshChallenge(t, client.HTTPClient, session.ID); next == first {
+		t.Error("consumed challenge issued again")
+	}
+}
+
+func TestRefreshGracePeriod(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+	serverURL, err := url.Parse(env.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var previous *http.Cookie
+	for _, cookie := range client.HTTPClient.Jar.Cookies(serverURL) {
+		if cookie.Name == dbsc.DefaultCookieName {
+			previous = cookie
+		}
+	}
+	if previous == nil {
+		t.Fatal("no DBSC cookie after registration")
+	}
+
+	challenge := env.refreshChallenge(t, client.HTTPClient, session.ID)
+	res := post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id": session.ID,
+		"Sec-Session-Response": env.signProof(t, session.Key, dbscclient.ProofClaims{
+			Audience: env.url(dbsc.EndpointDBSCRefresh),
+			JTI:      challenge,
+			Subject:  session.ID,
+		}),
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh status = %d", res.StatusCode)
+	}
+	current := dbscCookieOf(t, res)
+
+	// ローテーション中に送られたリクエストのため、前の Cookie も猶予期間だけ有効
+	if status := checkWithCookie(t, env, previous); status != http.StatusOK {
+		t.Errorf("previous cookie within the grace period: status = %d, want 200", status)
+	}
+	env.clock.Advance(env.dbsc.Config.RefreshGracePeriod)
+	if status := checkWithCookie(t, env, previous); status != http.StatusUnauthorized {
+		t.Errorf("previous cookie after the grace period: status = %d, want 401", status)
+	}
+	if status := checkWithCookie(t, env, current); status != http.StatusOK {
+		t.Errorf("new cookie: status = %d, want 200", status)
+	}
+}
+
+func TestRefreshLatencyFloor(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+	const floor = 100 * time.Millisecond
+	env.dbsc.Config.RefreshLatencyFloor = floor
+
+	// 未知のセッションと不正な proof のどちらも floor より前には応答しない
+	for name, headers := range map[string]map[string]string{
+		"unknown session": {"Sec-Session-Id": "unknown"},
+		"invalid proof":   {"Sec-Session-Id": session.ID, "Sec-Session-Response": "not-a-proof"},
+		"challenge":       {"Sec-Session-Id": session.ID},
+	} {
+		start := time.Now()
+		res := post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), headers)
+		if elapsed := time.Since(start); elapsed < floor {
+			t.Errorf("%s: response after %v, want at least %v", name, elapsed, floor)
+		}
+		if res.StatusCode/100 != 4 {
+			t.Errorf("%s: status = %d", name, res.StatusCode)
+		}
+	}
+
+	env.clock.Advance(env.manager.CookieLifetime)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Errorf("status after padded refresh = %d, want 200", status)
+	}
+}
+
+func TestRefreshUnknownSession(t *testing.T) {
+	env := newTestEnv(t)
+	res := post(t, http.DefaultClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": "unknown"})
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("Sec-Session-Challenge") != "" {
+		t.Errorf("status = %d, challenge = %q", res.StatusCode, res.Header.Get("Sec-Session-Challenge"))
+	}
+}
+
+func TestRefreshKeyMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	otherKey, err := dbscclient.GenerateKey(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := env.refreshChallenge(t, client.HTTPClient, session.ID)
+	res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id": session.ID,
+		"Sec-Session-Response": env.signProof(t, otherKey, dbscclient.ProofClaims{
+			Audience: env.url(dbsc.EndpointDBSCRefresh),
+			JTI:      challenge,
+			Subject:  session.ID,
+		}),
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestRefreshChallengeOfAnotherSession(t *testing.T) {
+	env := newTestEnv(t)
+	clientA := env.newClient(t, dbscclient.AlgorithmES256)
+	sessionA := env.login(t, clientA)
+	clientB := env.newClient(t, dbscclient.AlgorithmES256)
+	sessionB := env.login(t, clientB)
+
+	challenge := env.refreshChallenge(t, clientB.HTTPClient, sessionB.ID)
+	res := post(t, clientA.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{
+		"Sec-Session-Id": sessionA.ID,
+		"Sec-Session-Response": env.signProof(t, sessionA.Key, dbscclient.ProofClaims{
+			Audience: env.url(dbsc.EndpointDBSCRefresh),
+			JTI:      challenge,
+			Subject:  sessionA.ID,
+		}),
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestExpiredSession(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	session := env.login(t, client)
+
+	var events []dbsc.Event
+	env.dbsc.Observer = dbsc.ObserverFunc(func(event dbsc.Event) {
+		events = append(events, event)
+	})
+	env.clock.Advance(env.manager.SessionLifetime)
+
+	res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": session.ID})
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("Sec-Session-Challenge") != "" {
+		t.Fatalf("status = %d, challenge = %q", res.StatusCode, res.Header.Get("Sec-Session-Challenge"))
+	}
+
+	// 期限切れの終了は一度だけ通知し、以降は未知のセッションとして拒否する
+	post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCRefresh), map[string]string{"Sec-Session-Id": session.ID})
+	if len(events) != 2 || events[0].Type != dbsc.EventTerminated || events[0].TerminateReason != dbsc.TerminateExpired ||
+		events[1].Type != dbsc.EventProofRejected || events[1].RejectReason != dbsc.ReasonUnknownSession {
+		t.Fatalf("events = %+v", events)
+	}
+
+	// クライアントはセッション終了として扱い、保護されたリソースにはアクセスできない
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", status)
+	}
+	if len(client.Sessions()) != 0 {
+		t.Errorf("client must drop the terminated session")
+	}
+}
+
+func TestSessionRefreshedBeforeExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	env.login(t, client)
+
+	// クッキーの期限ごとにリフレッシュしながら、セッションの期限まではアクセスできる
+	lifetime := env.manager.CookieLifetime
+	for elapsed := lifetime; elapsed < env.manager.SessionLifetime; elapsed += lifetime {
+		env.clock.Advance(lifetime)
+		if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+			t.Fatalf("status after %v = %d, want 200", elapsed, status)
+		}
+	}
+}
+
+func TestSessionPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	policies := &dbsc.SessionPolicies{
+		Policies: map[string]dbsc.SessionPolicy{
+			"high-risk": {Name: "high-risk", CookieLifetime: 10 * time.Second, SessionLifetime: time.Minute, Sliding: true, MaxLifetime: 3 * time.Minute},
+		},
+		Users: map[string]string{"alice": "high-risk"},
+	}
+	env.dbsc.PolicySelector = policies.Select
+	addTestUser(t, env.traditional.Users, "alice", "alice")
+
+	// 既定のユーザーはストアの既定値
+	if session, _ := env.manager.GetSession(env.login(t, env.newClient(t, dbscclient.AlgorithmES256)).ID); session.Policy.CookieLifetime != env.manager.CookieLifetime || session.Policy.Sliding {
+		t.Errorf("default policy = %+v", session.Policy)
+	}
+
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	registered := env.loginAs(t, client, "alice", "alice")
+	session, _ := env.manager.GetSession(registered.ID)
+	if session.Policy.Name != "high-risk" || !session.ExpiresAt.Equal(session.CreatedAt.Add(time.Minute)) {
+		t.Fatalf("session policy = %+v, expires after %v", session.Policy, session.ExpiresAt.Sub(session.CreatedAt))
+	}
+
+	// リフレッシュのたびに延長され、セッションの期限 (1 分) を過ぎても上限 (3 分) まではアクセスできる
+	for elapsed := 10 * time.Second; elapsed < 3*time.Minute; elapsed += 10 * time.Second {
+		env.clock.Advance(10 * time.Second)
+		if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+			t.Fatalf("status after %v = %d, want 200", elapsed, status)
+		}
+	}
+	env.clock.Advance(10 * time.Second)
+	if status := getStatus(t, client, env.url("/api/check_dbsc_session")); status != http.StatusUnauthorized {
+		t.Errorf("status after the max lifetime = %d, want 401", status)
+	}
+}
+
+func TestProactiveRefresh(t *testing.T) {
+	env := newTestEnv(t)
+	policies := &dbsc.SessionPolicies{
+		Default: dbsc.SessionPolicy{Name: "proactive", CookieLifetime: 10 * time.Second, RefreshBefore: 3 * time.Second},
+	}
+	env.dbsc.PolicySelector = policies.Select
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	registered := env.login(t, client)
+	expiresAt := registered.CredentialsExpireAt
+	check := func() *http.Response {
+		t.Helper()
+		res, err := client.Get(env.url("/api/check_dbsc_session"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", res.StatusCode)
+		}
+		return res
+	}
+
+	env.clock.Advance(5 * time.Second)
+	if res := check(); res.Header.Get("Sec-Session-Challenge") != "" {
+		t.Errorf("challenge sent 5s before the cookie expires")
+	}
+
+	// 期限の 3 秒前からは応答にチャレンジが付き、クライアントは次のリクエストの前にリフレッシュする
+	env.clock.Advance(3 * time.Second)
+	if res := check(); res.Header.Get("Sec-Session-Challenge") == "" {
+		t.Fatal("no challenge 2s before the cookie expires")
+	}
+	check()
+	if session, _ := client.Session(registered.ID); session.Challenge != "" || !session.CredentialsExpireAt.After(expiresAt) {
+		t.Errorf("session not refreshed: challenge %q, credentials expire at %v", session.Challenge, session.CredentialsExpireAt.Sub(expiresAt))
+	}
+
+	// 元の Cookie の期限を過ぎても、リフレッシュせずにアクセスできる
+	env.clock.Advance(5 * time.Second)
+	if status := getStatus(t, client.HTTPClient, env.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Errorf("status after the original expiry = %d, want 200", status)
+	}
+}
+
+func TestRegistrationChallengeExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	// チャレンジ以外が先に失効しないようにする
+	lifetime := env.manager.ChallengeLifetime
+	env.traditional.SessionManager.IdleTimeout = 2 * lifetime
+	env.manager.AuthorizationLifetime = 2 * lifetime
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	entry := env.rawLogin(t, client.HTTPClient)
+
+	env.clock.Advance(lifetime)
+
+	res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCStart), map[string]string{
+		"Sec-Session-Response": env.signProof(t, client.Key, dbscclient.ProofClaims{
+			Audience:      env.url(dbsc.EndpointDBSCStart),
+			JTI:           entry.Params.Challenge,
+			IssuedAt:      env.clock.Now().Unix(),
+			Authorization: entry.Params.Authorization,
+		}),
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestRandomSourceFailure(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+
+	// 乱数の取得に失敗した場合は空の ID を発行せずにエラーを返す
+	env.manager.Random = failingReader{}
+	res, err := client.HTTPClient.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("login status = %d, want 500", res.StatusCode)
+	}
+	if res.Header.Get("Sec-Session-Registration") != "" {
+		t.Errorf("registration header must not be sent")
+	}
+
+	env.manager.Random = random.System
+	env.traditional.SessionManager.Random = failingReader{}
+	res, err = client.HTTPClient.PostForm(env.url("/login"), url.Values{"username": {"test"}, "password": {"test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("login status = %d, want 500", res.StatusCode)
+	}
+}
+
+func TestDeterministicIdentifiers(t *testing.T) {
+	identifiers := func() []string {
+		env := newTestEnv(t)
+		env.manager.Random = random.NewDeterministic(1)
+		client := env.newClient(t, dbscclient.AlgorithmES256)
+		entry := env.rawLogin(t, client.HTTPClient)
+		return []string{entry.Params.Authorization, entry.Params.Challenge}
+	}
+	first, second := identifiers(), identifiers()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("identifier %d differs between runs with the same seed: %q, %q", i, first[i], second[i])
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestRegistrationReplay(t *testing.T) {
+	env := newTestEnv(t)
+	client := env.newClient(t, dbscclient.AlgorithmES256)
+	entry := env.rawLogin(t, client.HTTPClient)
+
+	proof := env.signProof(t, client.Key, dbscclient.ProofClaims{
+		Audience:      env.url(dbsc.EndpointDBSCStart),
+		JTI:           entry.Params.Challenge,
+		Authorization: entry.Params.Authorization,
+	})
+	headers := map[string]string{"Sec-Session-Response": proof}
+	if res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCStart), headers); res.StatusCode != http.StatusOK {
+		t.Fatalf("registration status = %d, want 200", res.StatusCode)
+	}
+	if res := post(t, client.HTTPClient, env.url(dbsc.EndpointDBSCStart), headers); res.StatusCode == http.StatusOK {
+		t.Errorf("replayed registration must be rejected")
+	}
+}
+
+func TestRegistrationFromAnotherLogin(t *testing.T) {
+	env := newTestEnv(t)
+	clientA := env.newClient(t, dbscclient.AlgorithmES256)
+	entryA := env.rawLogin(t, clientA.HTTPClient)
+	clientB := env.newClient(t, dbscclient.AlgorithmES256)
+	entryB := env.rawLogin(t, clientB.HTTPClient)
+
+	// A の authorization を B のログインで使うことはできない (同じユーザーでも別のログイン)
+	res := post(t, clientB.HTTPClient, env.url(dbsc.EndpointDBSCStart), map[string]string{
+		"Sec-Session-Response": env.signProof(t, clientB.Key, dbscclient.ProofClaims{
+			Audience:      env.url(dbsc.EndpointDBSCStart),
+			JTI:           entryB.Params.Challenge,
+			Authorization: entryA.Params.Authorization,
+		}),
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", res.StatusCode)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	provider := newTestEnv(t, func(config *dbsc.Config) {
+		config.FederationRole = dbsc.FederationProvider
+	})
+	rp := newTestEnv(t, func(config *dbsc.Config) {
+		config.FederationRole = dbsc.FederationRelyingParty
+		config.ProviderURL = provider.server.URL
+	})
+	provider.dbsc.Config.RelyingOrigins = []string{rp.server.URL}
+
+	client := provider.newClient(t, dbscclient.AlgorithmES256)
+	providerSession := provider.login(t, client)
+
+	// RP から IdP を経由して、IdP セッションの ID を持って RP のログインに戻る
+	noRedirect := &http.Client{
+		Jar:           client.HTTPClient.Jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	location := rp.url(dbsc.EndpointFederationStart)
+	for i := 0; i < 2; i++ {
+		res, err := noRedirect.Get(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound {
+			t.Fatalf("GET %s: status = %d, want 302", location, res.StatusCode)
+		}
+		location = res.Header.Get("Location")
+	}
+	returnTo, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, rp.url("/login?")) {
+		t.Fatalf("handoff returned to %q", location)
+	}
+	providerID := returnTo.Query().Get("provider_id")
+	if providerID != providerSession.ID {
+		t.Fatalf("provider_id = %q, want %q", providerID, providerSession.ID)
+	}
+
+	rpLogin := url.Values{"username": {"test"}, "password": {"test"}, "provider_id": {providerID}}
+	res, err := client.HTTPClient.PostForm(rp.url("/login"), rpLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	header, err := formats.ParseSecureSessionRegistrationHeader(res.Header.Get("Sec-Session-Registration"))
+	if err != nil {
+		t.Fatalf("registration header: %v", err)
+	}
+
+	// RP は IdP からセッションキーを取得して登録ヘッダーに載せる
+	params := header[0].Params
+	thumbprint, err := dbsc_proof.Thumbprint(providerSession.Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.ProviderID != providerID || params.ProviderKey != thumbprint || params.ProviderURL != provider.server.URL {
+		t.Fatalf("federated registration params = %+v", params)
+	}
+
+	// IdP は設定された RP 以外にはセッションキーを渡さない
+	for origin, want := range map[string]int{rp.server.URL: http.StatusOK, "https://evil.example": http.StatusForbidden, "": http.StatusForbidden} {
+		req, err := http.NewRequest(http.MethodGet, provider.url(dbsc.EndpointFederationSessionKey+"?id="+url.QueryEscape(providerID)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("session key for origin %q: status = %d, want %d", origin, res.StatusCode, want)
+		}
+	}
+
+	// IdP セッションと異なるキーでは登録できない
+	var rejected []dbsc.RejectReason
+	observer := rp.dbsc.Observer
+	rp.dbsc.Observer = dbsc.ObserverFunc(func(event dbsc.Event) {
+		if event.Type == dbsc.EventProofRejected {
+			rejected = append(rejected, event.RejectReason)
+		}
+		if observer != nil {
+			observer.OnEvent(event)
+		}
+	})
+	otherKey, err := dbscclient.GenerateKey(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = post(t, client.HTTPClient, rp.url(dbsc.EndpointDBSCStart), map[string]string{
+		"Sec-Session-Response": rp.signProof(t, otherKey, dbscclient.ProofClaims{
+			Audience:      rp.url(dbsc.EndpointDBSCStart),
+			JTI:           params.Challenge,
+			Authorization: params.Authorization,
+		}),
+	})
+	if res.StatusCode != http.StatusBadRequest || len(rejected) != 1 || rejected[0] != dbsc.ReasonFederation {
+		t.Fatalf("registration with a mismatched key: status = %d, rejected = %v", res.StatusCode, rejected)
+	}
+
+	// ブラウザは IdP セッションのキーで RP のセッションを登録する
+	res, err = client.PostForm(rp.url("/login"), rpLogin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	var rpSession *dbscclient.Session
+	for _, session := range client.Sessions() {
+		if session.ID != providerSession.ID {
+			rpSession = session
+		}
+	}
+	if rpSession == nil {
+		t.Fatal("no session registered on the relying party")
+	}
+	stored, ok := rp.manager.GetSession(rpSession.ID)
+	if !ok {
+		t.Fatal("relying party session not stored")
+	}
+	providerStored, _ := provider.manager.GetSession(providerID)
+	if stored.ProviderID != providerID || stored.PublicKeyPEM != providerStored.PublicKeyPEM {
+		t.Errorf("relying party session = provider %q, key shared = %v", stored.ProviderID, stored.PublicKeyPEM == providerStored.PublicKeyPEM)
+	}
+	if status := getStatus(t, client, rp.url("/api/check_dbsc_session")); status != http.StatusOK {
+		t.Errorf("protected resource on the relying party: status = %d", status)
+	}
+}
+
+func TestRegistrationRejectsInvalidProofs(t *testing.T) {
+	env := newTestEnv(t)
+	key, err := dbscclient.GenerateKey(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		proof func(entry *formats.SecureSessionRegistrationEntry) string
+	}{
+		{
+			name: "malformed JWS",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return "not-a-jws"
+			},
+		},
+		{
+			name: "wrong typ",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return env.signWithType(t, key, "JWT", dbscclient.ProofClaims{
+					Audience:      env.url(dbsc.EndpointDBSCStart),
+					JTI:           entry.Params.Challenge,
+					Authorization: entry.Params.Authorization,
+				})
+			},
+		},
+		{
+			name: "wrong aud",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return env.signProof(t, key, dbscclient.ProofClaims{
+					Audience:      "https://evil.example" + dbsc.EndpointDBSCStart,
+					JTI:           entry.Params.Challenge,
+					Authorization: entry.Params.Authorization,
+				})
+			},
+		},
+		{
+			name: "unknown challenge",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return env.signProof(t, key, dbscclient.ProofClaims{
+					Audience:      env.url(dbsc.EndpointDBSCStart),
+					JTI:           "unknown",
+					Authorization: entry.Params.Authorization,
+				})
+			},
+		},
+		{
+			name: "future iat",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return env.signProof(t, key, dbscclient.ProofClaims{
+					Audience:      env.url(dbsc.EndpointDBSCStart),
+					JTI:           entry.Params.Challenge,
+					IssuedAt:      env.clock.Now().Add(10 * time.Minute).Unix(),
+					Authorization: entry.Params.Authorization,
+				})
+			},
+		},
+		{
+			name: "missing authorization",
+			proof: func(entry *formats.SecureSessionRegistrationEntry) string {
+				return env.signProof(t, key, dbscclient.ProofClaims{
+					Audience: env.url(dbsc.EndpointDBSCStart),
+					JTI:      entry.Params.Challenge,
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := env.newClient(t, dbscclient.AlgorithmES256)
+			entry := env.rawLogin(t, client.HTTPClient)
+			req, err := http.NewRequest(http.MethodPost, env.url(dbsc.EndpointDBSCStart), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Sec-Session-Response", tt.proof(entry))
+			res, err := client.HTTPClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			// どの検査で拒否したかはレスポンスから分からない
+			if res.StatusCode != http.StatusBadRequest || string(body) != "Invalid DBSC proof\n" {
+				t.Errorf("response = %d %q, want 400 %q", res.StatusCode, body, "Invalid DBSC proof\n")
+			}
+		})
+	}
+}
+
+func TestRegistrationRequiresLogin(t *testing.T) {
+	env := newTestEnv(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res := post(t, client, env.url(dbsc.EndpointDBSCStart), map[string]string{"Sec-Session-Response": "x"})
+	if res.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want 302", res.StatusCode)
+	}
+}
+
+// signWithType signs claims like dbscclient.SignProof but with an arbitrary typ header
+func (e *testEnv) signWithType(t *testing.T, key crypto.Signer, typ string, claims dbscclient.ProofClaims) string {
+	t.Helper()
+	jwkMap, err := dbscclient.PublicJWK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.Key = jwkMap
+	claims.IssuedAt = e.clock.Now().Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := jws.NewHeaders()
+	headers.Set(jws.TypeKey, typ)
+	signed, err := jws.Sign(payload, jws.WithKey(jwa.ES256, key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed)
+}
+
+func TestConformance(t *testing.T) {
+	env := newTestEnv(t)
+	// チェックごとに同じ IP からログインし、時計は止まっている
+	for _, name := range []string{limitLoginIP, limitLoginUser, limitDBSCStartIP, limitDBSCStartUser} {
+		env.limiter.Rates[name] = ratelimit.PerPeriod(1000, time.Minute)
+	}
+	// キットの証明は実際の時計で iat を付ける
+	env.dbsc.DBSCProofVerifier.Clock = clock.System
+
+	for _, algorithm := range []string{dbscclient.AlgorithmES256, dbscclient.AlgorithmRS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			config := conformance.DefaultConfig(env.server.URL)
+			config.Algorithm = algorithm
+			report := conformance.Run(context.Background(), config)
+			for _, result := range report.Failed() {
+				t.Errorf("%s: %s", result.Name, result.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("requests_total", "Requests.\nSecond line.")
+	counter.Add(2)
+	vec := registry.NewCounterVec("errors_total", "Errors.", "phase", "reason")
+	vec.Inc("refresh", `bad "quote"`)
+	vec.Inc("registration", "x")
+	vec.Inc("registration", "x")
+	registry.NewGaugeFunc("live", "Live entries.", func() float64 { return 3 })
+	histogram := registry.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 0.1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.3)
+	histogram.Observe(2)
+
+	var b strings.Builder
+	if _, err := registry.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Requests.\nSecond line.
+# TYPE requests_total counter
+requests_total 2
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total{phase="refresh",reason="bad \"quote\""} 1
+errors_total{phase="registration",reason="x"} 2
+# HELP live Live entries.
+# TYPE live gauge
+live 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="0.5"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.35
+latency_seconds_count 3
+`
+	if got := b.String(); got != want {
+		t.Errorf("exposition mismatch:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("up", "Up.").Inc()
+	res := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	if res.Header().Get("Content-Type") != ContentType || !strings.Contains(res.Body.String(), "up 1\n") {
+		t.Errorf("response = %q %q", res.Header().Get("Content-Type"), res.Body.String())
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for name, register := range map[string]func(r *Registry){
+		"invalid name":  func(r *Registry) { r.NewCounter("bad-name", "") },
+		"invalid label": func(r *Registry) { r.NewCounterVec("ok", "", "__reserved") },
+		"duplicate": func(r *Registry) {
+			r.NewCounter("dup", "")
+			r.NewCounter("dup", "")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			register(NewRegistry())
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package random
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"sync"
+)
+
+// idLength is the number of random bytes of an identifier
+const idLength = 32
+
+// System is the cryptographically secure random source
+var System io.Reader = rand.Reader
+
+// NewID returns a base64url encoded identifier read from source
+func NewID(source io.Reader) (string, error) {
+	bytes := make([]byte, idLength)
+	if _, err := io.ReadFull(source, bytes); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+// NewDeterministic returns a reproducible random source for tests. It must never be used in production.
+func NewDeterministic(seed uint64) io.Reader {
+	var key [32]byte
+	for i := 0; i < 8; i++ {
+		key[i] = byte(seed >> (8 * i))
+	}
+	return &lockedReader{reader: mathrand.NewChaCha8(key)}
+}
+
+// lockedReader makes a reader safe for concurrent use
+type lockedReader struct {
+	mu     sync.Mutex
+	reader io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reader.Read(p)
+}
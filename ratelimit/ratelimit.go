@@ -0,0 +1,156 @@
+// Package ratelimit limits request rates with token buckets.
+//
+// A Limiter checks every request against a list of Limits. Each Limit derives a key from the
+// request (the client IP, the DBSC session, the user) and takes a token from the bucket of that
+// key; requests finding an empty bucket are answered with 429 Too Many Requests and Retry-After.
+// The budgets are configured by limit name in Limiter.Rates, and the buckets are kept in a
+// Store, so that several instances can share them.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/logging"
+)
+
+// Rate allows Burst requests at once, refilled by one every Interval
+type Rate struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// PerPeriod returns the rate of n requests per period, all of which may come at once
+func PerPeriod(n int, period time.Duration) Rate {
+	return Rate{Burst: n, Interval: period / time.Duration(n)}
+}
+
+// ParseRate parses "n/period" such as "30/1m" into PerPeriod(n, period)
+func ParseRate(value string) (Rate, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q: want n/period, e.g. 30/1m", value)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: count must be a positive integer", value)
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: period must be a positive duration", value)
+	}
+	return PerPeriod(n, duration), nil
+}
+
+// ParseRates parses comma-separated "name=n/period" entries. "name=off" disables a limit,
+// which is returned as the zero Rate.
+func ParseRates(value string) (map[string]Rate, error) {
+	rates := map[string]Rate{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rateValue, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid rate limit %q: want name=n/period", entry)
+		}
+		if rateValue == "off" {
+			rates[name] = Rate{}
+			continue
+		}
+		rate, err := ParseRate(rateValue)
+		if err != nil {
+			return nil, err
+		}
+		rates[name] = rate
+	}
+	return rates, nil
+}
+
+func (r Rate) enabled() bool {
+	return r.Burst > 0 && r.Interval > 0
+}
+
+// KeyFunc returns the bucket key of a request, or "" to leave it out of the limit
+type KeyFunc func(r *http.Request) string
+
+// ByIP keys requests by the client IP address
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader keys requests by a request header, such as Sec-Session-Id
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// ByFormValue keys requests by a form field, such as the user name of a login
+func ByFormValue(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.PostFormValue(name)
+	}
+}
+
+// Limit applies the budget Limiter.Rates[Name] to the requests of each key
+type Limit struct {
+	Name string
+	Key  KeyFunc
+}
+
+type Limiter struct {
+	// Rates are the budgets by limit name. Limits without a rate are not enforced.
+	Rates map[string]Rate
+	Store Store
+	Clock clock.Clock
+}
+
+// NewLimiter returns a limiter without budgets, keeping its buckets in memory
+func NewLimiter() *Limiter {
+	return &Limiter{
+		Rates: map[string]Rate{},
+		Store: NewMemoryStore(),
+		Clock: clock.System,
+	}
+}
+
+// Handler answers requests exceeding any of limits with 429 Too Many Requests
+func (l *Limiter) Handler(next http.Handler, limits ...Limit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, limit := range limits {
+			rate := l.Rates[limit.Name]
+			if !rate.enabled() {
+				continue
+			}
+			key := limit.Key(r)
+			if key == "" {
+				continue
+			}
+			allowed, retryAfter, err := l.Store.Take(limit.Name+"\x00"+key, rate, l.Clock.Now())
+			if err != nil {
+				// 制限のためにサービスを止めないよう、ストアの障害時は通す
+				logging.Logger.ErrorContext(r.Context(), "rate limit store failed", "limit", limit.Name, "error", err)
+				continue
+			}
+			if !allowed {
+				logging.Logger.WarnContext(r.Context(), "rate limit exceeded", "limit", limit.Name)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,124 @@
+package ratelimit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/ratelimit"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	rate := ratelimit.PerPeriod(3, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := store.Take("a", rate, now); !allowed {
+			t.Fatalf("request %d was rejected within the burst", i+1)
+		}
+	}
+	allowed, retryAfter, err := store.Take("a", rate, now)
+	if err != nil || allowed {
+		t.Fatalf("Take = %v, %v, want rejected", allowed, err)
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("retry after = %v, want 20s", retryAfter)
+	}
+	// キーごとに別のバケツ
+	if allowed, _, _ := store.Take("b", rate, now); !allowed {
+		t.Error("another key was rejected")
+	}
+
+	// 1 トークン分待てば 1 回だけ通る
+	now = now.Add(20 * time.Second)
+	if allowed, _, _ := store.Take("a", rate, now); !allowed {
+		t.Error("refilled token was rejected")
+	}
+	if allowed, _, _ := store.Take("a", rate, now); allowed {
+		t.Error("more than the refill was allowed")
+	}
+}
+
+func TestMemoryStoreMaxKeys(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	store.MaxKeys = 2
+	rate := ratelimit.PerPeriod(1, time.Minute)
+	now := time.Now()
+
+	store.Take("a", rate, now)
+	store.Take("b", rate, now)
+	// 満杯になったバケツから捨てる
+	now = now.Add(time.Minute)
+	store.Take("c", rate, now.Add(-time.Second))
+	store.Take("d", rate, now)
+	if allowed, _, _ := store.Take("c", rate, now); allowed {
+		t.Error("the drained bucket of c was dropped")
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ratelimit.ParseRates("login=5/1m, refresh=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates["login"] != (ratelimit.Rate{Burst: 5, Interval: 12 * time.Second}) {
+		t.Errorf("login = %+v", rates["login"])
+	}
+	if rate, ok := rates["refresh"]; !ok || rate != (ratelimit.Rate{}) {
+		t.Errorf("refresh = %+v, %v, want off", rate, ok)
+	}
+	for _, value := range []string{"login", "login=5", "login=0/1m", "login=5/0s", "=5/1m"} {
+		if _, err := ratelimit.ParseRates(value); err == nil {
+			t.Errorf("ParseRates(%q) succeeded", value)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	limiter := ratelimit.NewLimiter()
+	limiter.Clock = fake
+	limiter.Rates["ip"] = ratelimit.PerPeriod(2, time.Minute)
+	limiter.Rates["session"] = ratelimit.PerPeriod(1, time.Minute)
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ratelimit.Limit{Name: "ip", Key: ratelimit.ByIP},
+		ratelimit.Limit{Name: "session", Key: ratelimit.ByHeader("Sec-Session-Id")},
+		ratelimit.Limit{Name: "unconfigured", Key: ratelimit.ByIP},
+	)
+	serve := func(remoteAddr, sessionID string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/dbsc_refresh", nil)
+		request.RemoteAddr = remoteAddr
+		if sessionID != "" {
+			request.Header.Set("Sec-Session-Id", sessionID)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if res := serve("192.0.2.1:1000", "s1"); res.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d", res.Code)
+	}
+	res := serve("192.0.2.1:1001", "s1")
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("session over budget: status = %d, want 429", res.Code)
+	}
+	if retryAfter := res.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Retry-After = %q, want 60", retryAfter)
+	}
+	// ポートが違っても同じ IP として数える
+	if res := serve("192.0.2.1:1002", ""); res.Code != http.StatusTooManyRequests {
+		t.Errorf("IP over budget: status = %d, want 429", res.Code)
+	}
+	if res := serve("192.0.2.2:1000", "s2"); res.Code != http.StatusOK {
+		t.Errorf("another client: status = %d", res.Code)
+	}
+
+	fake.Advance(time.Minute)
+	if res := serve("192.0.2.1:1003", "s1"); res.Code != http.StatusOK {
+		t.Errorf("after refill: status = %d", res.Code)
+	}
+}
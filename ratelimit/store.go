@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps the token buckets of a Limiter. MemoryStore is the in-memory implementation;
+// services running several instances can provide a shared one.
+type Store interface {
+	// Take removes a token from the bucket of key, refilled at rate, and reports whether one
+	// was available. If not, it returns how long until the next token.
+	Take(key string, rate Rate, now time.Time) (bool, time.Duration, error)
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// DefaultMaxKeys bounds the number of buckets of a MemoryStore
+const DefaultMaxKeys = 100000
+
+type MemoryStore struct {
+	// MaxKeys is the number of buckets kept. Full buckets are dropped first; beyond that
+	// arbitrary buckets are, which resets their budget.
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket is refilled completely and can be forgotten
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		MaxKeys: DefaultMaxKeys,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (s *MemoryStore) Take(key string, rate Rate, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, exists := s.buckets[key]
+	if !exists {
+		if len(s.buckets) >= s.MaxKeys {
+			s.prune(now)
+		}
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(float64(rate.Burst), b.tokens+float64(elapsed)/float64(rate.Interval))
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(rate.Interval)), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(rate.Burst) - b.tokens) * float64(rate.Interval)))
+	return true, 0, nil
+}
+
+// prune makes room for a new bucket. s.mu must be held.
+func (s *MemoryStore) prune(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	for key := range s.buckets {
+		if len(s.buckets) < s.MaxKeys {
+			break
+		}
+		delete(s.buckets, key)
+	}
+}
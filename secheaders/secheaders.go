@@ -0,0 +1,134 @@
+// Package secheaders sets security response headers according to per-route policies.
+package secheaders
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"dbsc-demo/logging"
+	"dbsc-demo/random"
+)
+
+// NoncePlaceholder in Policy.ContentSecurityPolicy is replaced by a nonce generated for each
+// request. Pages read it with Nonce and put it on their <script> and <style> elements.
+const NoncePlaceholder = "{nonce}"
+
+// Policy is the set of security headers of a route. Empty fields are not sent.
+// X-Content-Type-Options: nosniff is always sent and Access-Control-Allow-Credentials is
+// always removed, so that no route lets other origins make credentialed requests.
+type Policy struct {
+	ContentSecurityPolicy string
+	// FrameOptions is sent as X-Frame-Options for browsers without CSP frame-ancestors
+	FrameOptions   string
+	ReferrerPolicy string
+	// AllowOrigin is sent as Access-Control-Allow-Origin
+	AllowOrigin               string
+	CrossOriginOpenerPolicy   string
+	CrossOriginResourcePolicy string
+	CacheControl              string
+}
+
+// Default is for the responses of routes without a specific policy, which render nothing
+var Default = Policy{
+	ContentSecurityPolicy:     "default-src 'none'; frame-ancestors 'none'",
+	FrameOptions:              "DENY",
+	ReferrerPolicy:            "no-referrer",
+	CrossOriginResourcePolicy: "same-origin",
+}
+
+// Page is for the HTML pages. Scripts and styles must carry the request's nonce.
+var Page = Policy{
+	ContentSecurityPolicy: "default-src 'none'; script-src 'nonce-" + NoncePlaceholder + "'; style-src 'nonce-" + NoncePlaceholder + "'; " +
+		"connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'",
+	FrameOptions:              "DENY",
+	ReferrerPolicy:            "same-origin",
+	CrossOriginOpenerPolicy:   "same-origin",
+	CrossOriginResourcePolicy: "same-origin",
+}
+
+// Admin is for the admin dashboard and API, which must never be cached
+var Admin = Page.WithCacheControl("no-store")
+
+// DBSC returns the policy of the registration and refresh endpoints. The browser calls them
+// itself, so they never need CORS; only origin, the server's own origin, is allowed to read
+// the responses. "null" is avoided because it is the origin of every sandboxed document.
+func DBSC(origin string) Policy {
+	return Policy{
+		ContentSecurityPolicy:     "default-src 'none'; frame-ancestors 'none'",
+		FrameOptions:              "DENY",
+		ReferrerPolicy:            "no-referrer",
+		AllowOrigin:               origin,
+		CrossOriginResourcePolicy: "same-origin",
+		CacheControl:              "no-store",
+	}
+}
+
+// WithCacheControl returns a copy of p sending Cache-Control
+func (p Policy) WithCacheControl(value string) Policy {
+	p.CacheControl = value
+	return p
+}
+
+type nonceKey struct{}
+
+// Nonce returns the CSP nonce of the request, or "" when its policy has none
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey{}).(string)
+	return nonce
+}
+
+// Handler sets the headers of p on every response of next. Headers of an outer policy are
+// replaced, so a route policy takes precedence over one applied to the whole router.
+func (p Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		csp := p.ContentSecurityPolicy
+		if strings.Contains(csp, NoncePlaceholder) {
+			nonce, err := random.NewID(random.System)
+			if err != nil {
+				logging.Logger.ErrorContext(r.Context(), "failed to generate CSP nonce", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			csp = strings.ReplaceAll(csp, NoncePlaceholder, nonce)
+			r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+		}
+		for name, value := range map[string]string{
+			"Content-Security-Policy":      csp,
+			"X-Frame-Options":              p.FrameOptions,
+			"Referrer-Policy":              p.ReferrerPolicy,
+			"Access-Control-Allow-Origin":  p.AllowOrigin,
+			"Cross-Origin-Opener-Policy":   p.CrossOriginOpenerPolicy,
+			"Cross-Origin-Resource-Policy": p.CrossOriginResourcePolicy,
+			"Cache-Control":                p.CacheControl,
+		} {
+			if value != "" {
+				header.Set(name, value)
+			} else {
+				header.Del(name)
+			}
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(&credentialsStripper{ResponseWriter: w}, r)
+	})
+}
+
+// credentialsStripper removes Access-Control-Allow-Credentials set by the handler
+type credentialsStripper struct {
+	http.ResponseWriter
+}
+
+func (w *credentialsStripper) WriteHeader(status int) {
+	w.Header().Del("Access-Control-Allow-Credentials")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *credentialsStripper) Write(data []byte) (int, error) {
+	w.Header().Del("Access-Control-Allow-Credentials")
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *credentialsStripper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,69 @@
+package secheaders_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dbsc-demo/secheaders"
+)
+
+func TestHandler(t *testing.T) {
+	var nonce string
+	handler := secheaders.Default.Handler(secheaders.Page.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = secheaders.Nonce(r.Context())
+		// ハンドラが設定しても資格情報付きの CORS は許可しない
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Write([]byte("ok"))
+	})))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/userpage", nil))
+	header := recorder.Result().Header
+	if nonce == "" {
+		t.Fatal("no nonce in the request context")
+	}
+	csp := header.Get("Content-Security-Policy")
+	if !strings.Contains(csp, "script-src 'nonce-"+nonce+"'") || strings.Contains(csp, secheaders.NoncePlaceholder) {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	for name, want := range map[string]string{
+		"X-Frame-Options":                  "DENY",
+		"X-Content-Type-Options":           "nosniff",
+		"Referrer-Policy":                  secheaders.Page.ReferrerPolicy,
+		"Cross-Origin-Opener-Policy":       "same-origin",
+		"Access-Control-Allow-Credentials": "",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// リクエストごとに別の nonce
+	first := nonce
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/userpage", nil))
+	if nonce == first {
+		t.Error("nonce reused")
+	}
+}
+
+func TestRoutePolicyReplacesDefault(t *testing.T) {
+	handler := secheaders.Page.Handler(secheaders.DBSC("https://rp.example").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/dbsc_refresh", nil))
+	header := recorder.Result().Header
+	for name, want := range map[string]string{
+		"Content-Security-Policy":          "default-src 'none'; frame-ancestors 'none'",
+		"Access-Control-Allow-Origin":      "https://rp.example",
+		"Access-Control-Allow-Credentials": "",
+		"Cache-Control":                    "no-store",
+		"Cross-Origin-Opener-Policy":       "",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+
+	"dbsc-demo/logging"
+	"dbsc-demo/secheaders"
+)
+
+//go:embed dashboard.html
+var assets embed.FS
+
+var dashboard = template.Must(template.ParseFS(assets, "dashboard.html"))
+
+type dashboardData struct {
+	CSRFToken string
+	// Nonce is the CSP nonce of the inline script and style
+	Nonce string
+}
+
+// dashboardHandler serves the operator dashboard, which calls the JSON endpoints from the browser
+func (s *AdminServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	data := dashboardData{Nonce: secheaders.Nonce(r.Context())}
+	if s.CSRF != nil {
+		token, err := s.CSRF.Token(w, r)
+		if err != nil {
+			logging.Logger.ErrorContext(r.Context(), "failed to issue CSRF token", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		data.CSRFToken = token
+	}
+	var buf bytes.Buffer
+	if err := dashboard.Execute(&buf, data); err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to render dashboard", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	buf.WriteTo(w)
+}
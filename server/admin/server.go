@@ -0,0 +1,287 @@
+// Package admin serves an authenticated JSON API for operators to inspect and revoke
+// DBSC sessions.
+//
+//	GET    /admin/                                              HTML dashboard
+//	GET    /admin/sessions?user=&thumbprint=&min_age=&max_age=  list sessions
+//	GET    /admin/sessions/{id}                                 one session and its history
+//	DELETE /admin/sessions/{id}                                 revoke a session
+//	POST   /admin/sessions/{id}/rechallenge                     force a re-challenge on the next refresh
+//	DELETE /admin/users/{user}/sessions                         revoke every session of a user
+//	GET    /admin/failures                                      recently rejected proofs
+//
+// Requests are authenticated with HTTP Basic authentication. Because browsers resend Basic
+// credentials on their own, state-changing requests are also checked by AdminServer.CSRF.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/csrf"
+	"dbsc-demo/logging"
+	"dbsc-demo/server/dbsc"
+)
+
+// EndpointPrefix is the path prefix of every admin endpoint
+const EndpointPrefix = "/admin/"
+
+type AdminServer struct {
+	DBSC *dbsc.DBSCServer
+	// History provides the per-session events. It has to be registered as an observer of DBSC.
+	History  *dbsc.History
+	Username string
+	Password string
+	Clock    clock.Clock
+	// CSRF rejects cross-site requests and issues the token of the dashboard. Nil disables the check.
+	CSRF *csrf.Protection
+}
+
+// NewAdminServer returns an admin server authenticating username and password
+func NewAdminServer(dbscServer *dbsc.DBSCServer, history *dbsc.History, username, password string) *AdminServer {
+	return &AdminServer{
+		DBSC:     dbscServer,
+		History:  history,
+		Username: username,
+		Password: password,
+		Clock:    clock.System,
+		CSRF:     csrf.New(),
+	}
+}
+
+// Handler returns the admin endpoints behind authentication
+func (s *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/{$}", s.dashboardHandler)
+	mux.HandleFunc("GET /admin/sessions", s.listSessionsHandler)
+	mux.HandleFunc("GET /admin/sessions/{id}", s.sessionHandler)
+	mux.HandleFunc("DELETE /admin/sessions/{id}", s.revokeSessionHandler)
+	mux.HandleFunc("POST /admin/sessions/{id}/rechallenge", s.rechallengeHandler)
+	mux.HandleFunc("DELETE /admin/users/{user}/sessions", s.revokeUserSessionsHandler)
+	mux.HandleFunc("GET /admin/failures", s.failuresHandler)
+	if s.CSRF == nil {
+		return s.authenticate(mux)
+	}
+	return s.CSRF.Handler(s.authenticate(mux))
+}
+
+func (s *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// パスワード未設定の場合は常に拒否する
+		usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+		if !ok || s.Password == "" || !usernameOK || !passwordOK {
+			logging.Logger.WarnContext(r.Context(), "admin authentication failed")
+			w.Header().Set("WWW-Authenticate", `Basic realm="dbsc admin", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		logging.AddAttrs(r.Context(), slog.String("admin", username))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionView is the JSON representation of a session
+type sessionView struct {
+	ID                   string     `json:"id"`
+	User                 string     `json:"user"`
+	KeyThumbprint        string     `json:"key_thumbprint"`
+	ProviderID           string     `json:"provider_id,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	ExpiresAt            time.Time  `json:"expires_at"`
+	RefreshCount         int        `json:"refresh_count"`
+	LastRefreshedAt      *time.Time `json:"last_refreshed_at,omitempty"`
+	LastRefreshInitiator string     `json:"last_refresh_initiator,omitempty"`
+	RechallengeRequired  bool       `json:"rechallenge_required"`
+	Policy               string     `json:"policy,omitempty"`
+	CookieLifetime       string     `json:"cookie_lifetime"`
+	Sliding              bool       `json:"sliding"`
+}
+
+func newSessionView(session *dbsc.DBSCSession) sessionView {
+	view := sessionView{
+		ID:                   session.Identifier,
+		User:                 session.User,
+		KeyThumbprint:        session.KeyThumbprint,
+		ProviderID:           session.ProviderID,
+		CreatedAt:            session.CreatedAt,
+		ExpiresAt:            session.ExpiresAt,
+		RefreshCount:         session.RefreshCount,
+		LastRefreshInitiator: session.LastRefreshInitiator,
+		RechallengeRequired:  session.RechallengeRequired,
+		Policy:               session.Policy.Name,
+		CookieLifetime:       session.Policy.CookieLifetime.String(),
+		Sliding:              session.Policy.Sliding,
+	}
+	if !session.LastRefreshedAt.IsZero() {
+		view.LastRefreshedAt = &session.LastRefreshedAt
+	}
+	return view
+}
+
+// eventView is the JSON representation of a history event
+type eventView struct {
+	Type       dbsc.EventType `json:"type"`
+	Time       time.Time      `json:"time"`
+	SessionID  string         `json:"session_id,omitempty"`
+	User       string         `json:"user,omitempty"`
+	Phase      dbsc.Phase     `json:"phase,omitempty"`
+	Initiator  string         `json:"initiator,omitempty"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	UserAgent  string         `json:"user_agent,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func newEventView(event dbsc.Event) eventView {
+	view := eventView{
+		Type:       event.Type,
+		Time:       event.Time,
+		SessionID:  event.SessionIdentifier,
+		User:       event.User,
+		Phase:      event.Phase,
+		Initiator:  event.Initiator,
+		RemoteAddr: event.RemoteAddr,
+		UserAgent:  event.UserAgent,
+	}
+	switch {
+	case event.RejectReason != "":
+		view.Reason = string(event.RejectReason)
+	case event.TerminateReason != "":
+		view.Reason = string(event.TerminateReason)
+	}
+	if event.Err != nil {
+		view.Error = event.Err.Error()
+	}
+	return view
+}
+
+func (s *AdminServer) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := dbsc.SessionFilter{
+		User:          query.Get("user"),
+		KeyThumbprint: query.Get("thumbprint"),
+	}
+	now := s.Clock.Now()
+	// min_age / max_age はセッション作成からの経過時間 (例: 10m)
+	if value := query.Get("min_age"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid min_age")
+			return
+		}
+		filter.CreatedBefore = now.Add(-age)
+	}
+	if value := query.Get("max_age"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid max_age")
+			return
+		}
+		filter.CreatedAfter = now.Add(-age)
+	}
+
+	sessions, err := s.DBSC.ListSessions(filter)
+	if err != nil {
+		s.storeError(w, r, err)
+		return
+	}
+	views := make([]sessionView, 0, len(sessions))
+	for i := range sessions {
+		views = append(views, newSessionView(&sessions[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": views})
+}
+
+func (s *AdminServer) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	identifier := r.PathValue("id")
+	events := []eventView{}
+	if s.History != nil {
+		for _, event := range s.History.Events(identifier) {
+			events = append(events, newEventView(event))
+		}
+	}
+	response := map[string]any{"history": events}
+	if session, ok := s.DBSC.Store.GetSession(identifier); ok {
+		response["session"] = newSessionView(session)
+	} else if len(events) == 0 {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	// 失効済みのセッションは履歴のみを返す
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *AdminServer) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	revoked, err := s.DBSC.RevokeSession(r, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, r, err)
+		return
+	}
+	if !revoked {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	logging.Logger.InfoContext(r.Context(), "revoked DBSC session", logging.SessionID(r.PathValue("id")))
+	writeJSON(w, http.StatusOK, map[string]any{"revoked": []string{r.PathValue("id")}})
+}
+
+func (s *AdminServer) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("user")
+	identifiers, err := s.DBSC.RevokeUserSessions(r, user)
+	if err != nil {
+		s.storeError(w, r, err)
+		return
+	}
+	logging.Logger.InfoContext(r.Context(), "revoked DBSC sessions of user", "user", user, "count", len(identifiers))
+	writeJSON(w, http.StatusOK, map[string]any{"revoked": identifiers})
+}
+
+func (s *AdminServer) rechallengeHandler(w http.ResponseWriter, r *http.Request) {
+	required, err := s.DBSC.RequireRechallenge(r, r.PathValue("id"))
+	if err != nil {
+		s.storeError(w, r, err)
+		return
+	}
+	if !required {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	logging.Logger.InfoContext(r.Context(), "required DBSC re-challenge", logging.SessionID(r.PathValue("id")))
+	writeJSON(w, http.StatusOK, map[string]any{"rechallenge_required": r.PathValue("id")})
+}
+
+func (s *AdminServer) failuresHandler(w http.ResponseWriter, r *http.Request) {
+	failures := []eventView{}
+	if s.History != nil {
+		for _, event := range s.History.Failures() {
+			failures = append(failures, newEventView(event))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"failures": failures})
+}
+
+func (s *AdminServer) storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, dbsc.ErrAdminNotSupported) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	logging.Logger.ErrorContext(r.Context(), "admin request failed", "error", err)
+	writeError(w, http.StatusInternalServerError, "internal server error")
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
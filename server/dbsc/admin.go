@@ -0,0 +1,112 @@
+package dbsc
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrAdminNotSupported is returned by the session administration methods when the store
+// does not implement SessionAdmin
+var ErrAdminNotSupported = errors.New("dbsc: store does not support session administration")
+
+func (s *DBSCServer) sessionAdmin() (SessionAdmin, error) {
+	admin, ok := s.Store.(SessionAdmin)
+	if !ok {
+		return nil, ErrAdminNotSupported
+	}
+	return admin, nil
+}
+
+// ListSessions returns the unexpired sessions matching filter, newest first
+func (s *DBSCServer) ListSessions(filter SessionFilter) ([]DBSCSession, error) {
+	admin, err := s.sessionAdmin()
+	if err != nil {
+		return nil, err
+	}
+	return admin.ListSessions(filter), nil
+}
+
+// RevokeSession terminates a session and invalidates its cookies.
+// r is the administrator's request, reported with the event.
+func (s *DBSCServer) RevokeSession(r *http.Request, identifier string) (bool, error) {
+	return s.revokeSession(r, identifier, TerminateRevoked)
+}
+
+func (s *DBSCServer) revokeSession(r *http.Request, identifier string, reason TerminateReason) (bool, error) {
+	admin, err := s.sessionAdmin()
+	if err != nil {
+		return false, err
+	}
+	session, _ := s.Store.GetSession(identifier)
+	if !admin.RevokeSession(identifier) {
+		return false, nil
+	}
+	event := Event{
+		Type:              EventTerminated,
+		SessionIdentifier: identifier,
+		TerminateReason:   reason,
+	}
+	if session != nil {
+		event.User = session.User
+		event.ProviderID = session.ProviderID
+		event.KeyThumbprint = session.KeyThumbprint
+	}
+	s.emit(r, event)
+	return true, nil
+}
+
+// EndLoginSession terminates the sessions registered from loginSession and removes the bound
+// cookie from the browser. It has the signature of traditional.LogoutHook.
+func (s *DBSCServer) EndLoginSession(w http.ResponseWriter, r *http.Request, username string, loginSession string) error {
+	sessions, err := s.ListSessions(SessionFilter{User: username, LoginSession: loginSession})
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if _, err := s.revokeSession(r, session.Identifier, TerminateLogout); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: s.CookieName, Path: "/", MaxAge: -1, SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// RevokeUserSessions terminates every session of user and returns their identifiers
+func (s *DBSCServer) RevokeUserSessions(r *http.Request, user string) ([]string, error) {
+	admin, err := s.sessionAdmin()
+	if err != nil {
+		return nil, err
+	}
+	identifiers := admin.RevokeUserSessions(user)
+	for _, identifier := range identifiers {
+		s.emit(r, Event{
+			Type:              EventTerminated,
+			SessionIdentifier: identifier,
+			User:              user,
+			TerminateReason:   TerminateRevoked,
+		})
+	}
+	return identifiers, nil
+}
+
+// RequireRechallenge invalidates the session's cookies and outstanding challenges, so that the
+// browser has to refresh with a new challenge before its next request is accepted
+func (s *DBSCServer) RequireRechallenge(r *http.Request, identifier string) (bool, error) {
+	admin, err := s.sessionAdmin()
+	if err != nil {
+		return false, err
+	}
+	if !admin.RequireRechallenge(identifier) {
+		return false, nil
+	}
+	event := Event{
+		Type:              EventRechallengeRequired,
+		SessionIdentifier: identifier,
+	}
+	if session, ok := s.Store.GetSession(identifier); ok {
+		event.User = session.User
+		event.KeyThumbprint = session.KeyThumbprint
+	}
+	s.emit(r, event)
+	return true, nil
+}
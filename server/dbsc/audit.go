@@ -0,0 +1,60 @@
+package dbsc
+
+import (
+	"unicode/utf8"
+
+	"dbsc-demo/audit"
+	"dbsc-demo/logging"
+)
+
+// maxAuditFieldLength caps the fields of a record taken from the request, which anyone can
+// send to the refresh endpoint without logging in, so that a huge User-Agent cannot produce a
+// record longer than the audit log accepts
+const maxAuditFieldLength = 1024
+
+// NewAuditObserver is an Observer recording registrations, refreshes, rejected proofs
+// (including key mismatches and replayed challenges) and terminations to an audit log.
+// Issued challenges are not recorded.
+func NewAuditObserver(log *audit.Log) Observer {
+	return ObserverFunc(func(event Event) {
+		if event.Type == EventChallengeIssued {
+			return
+		}
+		record := audit.Record{
+			Time:          event.Time,
+			Type:          string(event.Type),
+			Phase:         string(event.Phase),
+			SessionID:     event.SessionIdentifier,
+			User:          event.User,
+			KeyThumbprint: event.KeyThumbprint,
+			RemoteAddr:    event.RemoteAddr,
+			UserAgent:     truncate(event.UserAgent, maxAuditFieldLength),
+			ProviderID:    event.ProviderID,
+			Initiator:     truncate(event.Initiator, maxAuditFieldLength),
+		}
+		switch event.Type {
+		case EventProofRejected:
+			record.Reason = string(event.RejectReason)
+		case EventTerminated:
+			record.Reason = string(event.TerminateReason)
+		}
+		if event.Err != nil {
+			record.Error = truncate(event.Err.Error(), maxAuditFieldLength)
+		}
+		if err := log.Append(record); err != nil {
+			logging.Logger.Error("failed to write audit record", "type", record.Type, "error", err)
+		}
+	})
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence, marking the cut with "..."
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n - len("...")
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
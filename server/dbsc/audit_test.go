@@ -0,0 +1,113 @@
+package dbsc_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dbsc-demo/audit"
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc"
+)
+
+func TestAuditObserver(t *testing.T) {
+	dir := t.TempDir()
+	auditLog, err := audit.Open(audit.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newApp(t, dbsc.NewAuditObserver(auditLog))
+	client, err := dbscclient.New(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get(t, client, server.URL+"/login?user=alice")
+	get(t, client, server.URL+"/app")
+	session := client.Sessions()[0]
+	if err := client.Refresh(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	// 別のキーで署名した proof は拒否される
+	other, err := dbscclient.GenerateKey(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Key = other
+	if err := client.Refresh(context.Background(), session); err == nil {
+		t.Fatal("refresh with another key succeeded")
+	}
+	postHeaders(t, server.URL+dbsc.EndpointDBSCRefresh, map[string]string{"Sec-Session-Id": "unknown"})
+	auditLog.Close()
+
+	report, err := audit.Verify(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems = %v", report.Problems)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "audit-000001.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	var types []string
+	for _, record := range records {
+		types = append(types, record.Type+"/"+record.Reason)
+	}
+	if got, want := strings.Join(types, ","), "registered/,refreshed/,proof_rejected/key_mismatch,proof_rejected/unknown_session"; got != want {
+		t.Fatalf("records = %s, want %s", got, want)
+	}
+
+	registered, rejected := records[0], records[2]
+	if registered.User != "alice" || registered.SessionID != session.ID || registered.KeyThumbprint == "" ||
+		registered.RemoteAddr == "" || registered.UserAgent == "" {
+		t.Errorf("registered record = %+v", registered)
+	}
+	// 拒否された proof にはセッションに登録されたキーのサムプリントを記録する
+	if rejected.SessionID != session.ID || rejected.KeyThumbprint != registered.KeyThumbprint || rejected.Error == "" {
+		t.Errorf("rejected record = %+v", rejected)
+	}
+}
+
+func TestAuditObserverCapsRequestFields(t *testing.T) {
+	dir := t.TempDir()
+	auditLog, err := audit.Open(audit.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newApp(t, dbsc.NewAuditObserver(auditLog))
+
+	// JSON で 6 バイトにエスケープされる文字で、上限を超えるレコードを作ろうとする
+	postHeaders(t, server.URL+dbsc.EndpointDBSCRefresh, map[string]string{
+		"Sec-Session-Id": "unknown",
+		"User-Agent":     strings.Repeat("<", 500<<10),
+	})
+	auditLog.Close()
+
+	report, err := audit.Verify(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	// 再起動しても監査ログを開ける
+	auditLog, err = audit.Open(audit.Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	auditLog.Close()
+}
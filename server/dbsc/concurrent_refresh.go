@@ -0,0 +1,175 @@
+package dbsc
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 同じセッションの同時リフレッシュ (複数のタブなど) をまとめる仕組み。
+//
+//   - Config.RefreshGracePeriod 以内に続けて届いたチャレンジ要求には、ストアが未使用のチャレンジを再び返す。
+//     同時に届いた要求は challengeFlights で 1 回の発行にまとめる
+//   - チャレンジを消費して Cookie を発行した結果は Config.RefreshGracePeriod の間 redeemedRefreshes に残り、
+//     同じチャレンジに対する別の正しい証明は新しい Cookie を発行せずに同じ結果を受け取る
+//   - 同じ証明の再送はリプレイとして拒否する
+//
+// いずれもこのプロセス内での重複排除で、チャレンジの単一使用はストアが保証する。
+
+var errChallengeReused = errors.New("challenge already used or issued for another session")
+
+// flightGroup runs one call per key at a time and hands its result to the callers arriving
+// while it runs, like golang.org/x/sync/singleflight. The zero value is ready to use.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// do runs fn unless a call for key is already running, in which case it waits for that call.
+// shared reports whether the result came from another caller.
+func (g *flightGroup[T]) do(key string, fn func() (T, error)) (value T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	if call, running := g.calls[key]; running {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	call := &flightCall[T]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
+
+// refreshOutcome is the result of redeeming a refresh challenge
+type refreshOutcome struct {
+	sessionID string
+	cookie    *DBSCCookie
+	// proofs are the hashes of the Sec-Session-Response headers that received the outcome
+	proofs map[[sha256.Size]byte]bool
+	// sharedUntil is the end of the grace period in which other proofs get the same cookie
+	sharedUntil time.Time
+}
+
+// redeemedRefreshes keeps the outcomes of the refresh challenges redeemed within the grace period.
+// The zero value is ready to use.
+type redeemedRefreshes struct {
+	mu       sync.Mutex
+	outcomes map[string]*refreshOutcome
+}
+
+// get returns the outcome of the challenge if its grace period has not ended
+func (c *redeemedRefreshes) get(challenge string, now time.Time) (*refreshOutcome, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	outcome, exists := c.outcomes[challenge]
+	if !exists || !now.Before(outcome.sharedUntil) {
+		return nil, false
+	}
+	return outcome, true
+}
+
+// claim records that proof received the outcome and reports whether it had not before
+func (c *redeemedRefreshes) claim(outcome *refreshOutcome, proof string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash := sha256.Sum256([]byte(proof))
+	if outcome.proofs[hash] {
+		return false
+	}
+	outcome.proofs[hash] = true
+	return true
+}
+
+func (c *redeemedRefreshes) add(challenge string, outcome *refreshOutcome, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outcomes == nil {
+		c.outcomes = make(map[string]*refreshOutcome)
+	}
+	for value, previous := range c.outcomes {
+		if !now.Before(previous.sharedUntil) {
+			delete(c.outcomes, value)
+		}
+	}
+	if now.Before(outcome.sharedUntil) {
+		c.outcomes[challenge] = outcome
+	}
+}
+
+// redeemRefresh returns the outcome of the refresh challenge, redeeming it unless another
+// request did within the grace period. redeemed reports whether this call redeemed it.
+func (s *DBSCServer) redeemRefresh(sessionID, challengeValue, proof string) (outcome *refreshOutcome, redeemed bool, err error) {
+	outcome, err, _ = s.refreshFlights.do(challengeValue, func() (*refreshOutcome, error) {
+		now := s.Clock.Now()
+		if outcome, ok := s.redeemedRefreshes.get(challengeValue, now); ok {
+			return outcome, nil
+		}
+		if challenge, ok := s.Store.ConsumeChallenge(challengeValue); !ok || !equalSecret(challenge.SessionIdentifier, sessionID) {
+			return nil, errChallengeReused
+		}
+		cookie, err := s.Store.RotateCookie(sessionID, s.Config.RefreshGracePeriod)
+		if err != nil {
+			return nil, err
+		}
+		redeemed = true
+		outcome := &refreshOutcome{
+			sessionID:   sessionID,
+			cookie:      cookie,
+			proofs:      map[[sha256.Size]byte]bool{sha256.Sum256([]byte(proof)): true},
+			sharedUntil: now.Add(s.Config.RefreshGracePeriod),
+		}
+		s.redeemedRefreshes.add(challengeValue, outcome, now)
+		return outcome, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !redeemed {
+		// 別のセッションのチャレンジや、同じ証明の再送は受け付けない
+		if !equalSecret(outcome.sessionID, sessionID) || !s.redeemedRefreshes.claim(outcome, proof) {
+			return nil, false, errChallengeReused
+		}
+		// 猶予期間中に管理者が失効させた Cookie は渡さない
+		if _, ok := s.Store.GetCookie(outcome.cookie.Value); !ok {
+			return nil, false, errChallengeReused
+		}
+	}
+	return outcome, redeemed, nil
+}
+
+// proofSessions is the view of the store used by the proof verifier. A refresh challenge
+// redeemed within the grace period still counts as valid, so that the concurrent refreshes
+// signing it reach redeemRefresh and share its outcome.
+type proofSessions struct {
+	server *DBSCServer
+}
+
+func (p proofSessions) VerifyChallenge(value string) bool {
+	if p.server.Store.VerifyChallenge(value) {
+		return true
+	}
+	_, ok := p.server.redeemedRefreshes.get(value, p.server.Clock.Now())
+	return ok
+}
+
+func (p proofSessions) VerifySession(identifier string, pem string) bool {
+	return p.server.Store.VerifySession(identifier, pem)
+}
@@ -0,0 +1,273 @@
+package dbsc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+	"dbsc-demo/server/dbsc/wellknown"
+)
+
+// FederationRole is the role of this server in a federated DBSC deployment
+type FederationRole string
+
+const (
+	FederationNone         FederationRole = ""
+	FederationProvider     FederationRole = "provider"
+	FederationRelyingParty FederationRole = "relying"
+)
+
+// Config holds the deployment specific settings of the DBSC server
+type Config struct {
+	// このサーバのオリジン (セッションスコープの origin として利用)
+	Origin string
+
+	// セッションインストラクションの allowed_refresh_initiators に載せるホストパターン
+	// (例: "example.com", "*.example.com")
+	AllowedRefreshInitiators []string
+	// true の場合、許可リスト外のサイトから開始されたリフレッシュを拒否する
+	EnforceRefreshInitiators bool
+
+	// フェデレーションでの役割 (provider: IdP, relying: RP)
+	FederationRole FederationRole
+	// RP の場合: プロバイダー (IdP) のベース URL
+	ProviderURL string
+	// IdP の場合: セッションキーの共有を許可する RP のオリジン
+	RelyingOrigins []string
+	// このサイトのセッションをクロスオリジンで登録できるオリジン
+	RegisteringOrigins []string
+
+	// 0 より大きい場合、リフレッシュエンドポイントのレスポンスを受信からこの時間が経つまで遅らせる
+	// (タイミングサイドチャネル対策, PadLatency を参照)
+	RefreshLatencyFloor time.Duration
+	// リフレッシュ後も前の Cookie を有効にしておく時間 (ローテーション中に送られたリクエストのため)。
+	// 0 の場合は新しい Cookie の発行と同時に無効にする
+	RefreshGracePeriod time.Duration
+	// 証明の iat, exp, nbf でクライアントの時計のずれを許容する幅。
+	// 0 の場合は dbsc_proof.DefaultMaxClockSkew
+	ProofClockSkew time.Duration
+}
+
+// DefaultConfig returns the configuration used by the demo server
+func DefaultConfig() Config {
+	return Config{
+		Origin:             "http://localhost:8080",
+		RefreshGracePeriod: 2 * time.Second,
+		ProofClockSkew:     dbsc_proof.DefaultMaxClockSkew,
+	}
+}
+
+// Validate checks the configuration values and normalizes host patterns
+func (c *Config) Validate() error {
+	origin, err := normalizeOrigin(c.Origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q: %w", c.Origin, err)
+	}
+	c.Origin = origin
+
+	if c.RefreshLatencyFloor < 0 {
+		return fmt.Errorf("refresh latency floor must not be negative")
+	}
+	if c.RefreshGracePeriod < 0 {
+		return fmt.Errorf("refresh grace period must not be negative")
+	}
+	if c.ProofClockSkew < 0 {
+		return fmt.Errorf("proof clock skew must not be negative")
+	}
+
+	switch c.FederationRole {
+	case FederationNone:
+	case FederationProvider:
+		for i, o := range c.RelyingOrigins {
+			normalized, err := normalizeOrigin(o)
+			if err != nil {
+				return fmt.Errorf("invalid relying origin %q: %w", o, err)
+			}
+			c.RelyingOrigins[i] = normalized
+		}
+	case FederationRelyingParty:
+		if c.ProviderURL == "" {
+			return fmt.Errorf("provider URL is required for the relying federation role")
+		}
+		providerURL, err := normalizeOrigin(c.ProviderURL)
+		if err != nil {
+			return fmt.Errorf("invalid provider URL %q: %w", c.ProviderURL, err)
+		}
+		c.ProviderURL = providerURL
+	default:
+		return fmt.Errorf("unknown federation role %q", c.FederationRole)
+	}
+
+	for i, o := range c.RegisteringOrigins {
+		normalized, err := normalizeOrigin(o)
+		if err != nil {
+			return fmt.Errorf("invalid registering origin %q: %w", o, err)
+		}
+		c.RegisteringOrigins[i] = normalized
+	}
+
+	for i, pattern := range c.AllowedRefreshInitiators {
+		normalized, err := normalizeHostPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid allowed refresh initiator %q: %w", pattern, err)
+		}
+		c.AllowedRefreshInitiators[i] = normalized
+	}
+	return nil
+}
+
+// normalizeOrigin validates an origin such as "https://example.com:8443" and strips a trailing slash
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("must be scheme://host[:port]")
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// originHost returns the host name part of the configured origin
+func (c *Config) originHost() string {
+	u, err := url.Parse(c.Origin)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// wellKnownDocument builds the /.well-known/device-bound-sessions document of this server
+func (c *Config) wellKnownDocument() wellknown.Document {
+	doc := wellknown.Document{
+		RegisteringOrigins: c.RegisteringOrigins,
+	}
+	switch c.FederationRole {
+	case FederationProvider:
+		doc.RelyingOrigins = c.RelyingOrigins
+	case FederationRelyingParty:
+		doc.ProviderOrigin = c.ProviderURL
+	}
+	return doc
+}
+
+// isRegisteringOrigin reports whether origin may register sessions for this server
+func (c *Config) isRegisteringOrigin(origin string) bool {
+	if strings.EqualFold(origin, c.Origin) {
+		return true
+	}
+	for _, o := range c.RegisteringOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRelyingOrigin reports whether origin may use sessions of this provider
+func (c *Config) isRelyingOrigin(origin string) bool {
+	for _, o := range c.RelyingOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHostPattern validates a host pattern such as "example.com" or "*.example.com"
+func normalizeHostPattern(pattern string) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(pattern))
+	if p == "" {
+		return "", fmt.Errorf("empty pattern")
+	}
+	if strings.Contains(p, "://") || strings.ContainsAny(p, "/?#@") {
+		return "", fmt.Errorf("must be a host pattern, not a URL")
+	}
+
+	host := p
+	if strings.HasPrefix(p, "*.") {
+		host = p[2:]
+	}
+	if strings.Contains(host, "*") {
+		return "", fmt.Errorf("wildcard is only allowed as the leading label")
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		if host != p {
+			return "", fmt.Errorf("wildcard cannot be combined with an IP address")
+		}
+		return p, nil
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("invalid label in host")
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return "", fmt.Errorf("invalid character %q in host", r)
+			}
+		}
+	}
+	return p, nil
+}
+
+// matchHostPattern reports whether host matches the (normalized) pattern
+func matchHostPattern(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// unknownInitiator is recorded when Sec-Fetch-Site reports another site that neither Origin
+// nor Referer names. It is not a host, so it never matches AllowedRefreshInitiators.
+const unknownInitiator = "(unknown)"
+
+// refreshInitiator determines the site that initiated a refresh request.
+// It returns an empty string when the request is same-origin or user initiated.
+func refreshInitiator(r *http.Request) string {
+	fetchSite := r.Header.Get("Sec-Fetch-Site")
+	switch fetchSite {
+	case "same-origin", "none":
+		return ""
+	}
+
+	for _, source := range []string{r.Header.Get("Origin"), r.Header.Get("Referer")} {
+		if source == "" || source == "null" {
+			continue
+		}
+		u, err := url.Parse(source)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return ""
+		}
+		return strings.ToLower(u.Hostname())
+	}
+	if fetchSite == "cross-site" || fetchSite == "same-site" {
+		// 別サイトからの開始だが発信元が分からない
+		return unknownInitiator
+	}
+	return ""
+}
+
+// isAllowedRefreshInitiator checks the initiator against AllowedRefreshInitiators
+func (c *Config) isAllowedRefreshInitiator(initiator string) bool {
+	if initiator == "" {
+		return true
+	}
+	for _, pattern := range c.AllowedRefreshInitiators {
+		if matchHostPattern(pattern, initiator) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package dbsc
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+)
+
+// EventType identifies a DBSC session lifecycle event
+type EventType string
+
+const (
+	EventRegistered      EventType = "registered"
+	EventChallengeIssued EventType = "challenge_issued"
+	EventRefreshed       EventType = "refreshed"
+	EventProofRejected   EventType = "proof_rejected"
+	EventTerminated      EventType = "terminated"
+	// EventRechallengeRequired is reported when an administrator forces the next refresh
+	// to prove possession of the session key with a new challenge
+	EventRechallengeRequired EventType = "rechallenge_required"
+)
+
+// RejectReason explains why a registration or refresh was rejected
+type RejectReason string
+
+const (
+	ReasonMalformedProof       RejectReason = "malformed_proof"
+	ReasonProofTooLarge        RejectReason = "proof_too_large"
+	ReasonInvalidHeader        RejectReason = "invalid_header"
+	ReasonInvalidSignature     RejectReason = "invalid_signature"
+	ReasonInvalidAudience      RejectReason = "invalid_audience"
+	ReasonInvalidChallenge     RejectReason = "invalid_challenge"
+	ReasonChallengeReused      RejectReason = "challenge_reused"
+	ReasonInvalidIssuedAt      RejectReason = "invalid_iat"
+	ReasonInvalidLifetime      RejectReason = "invalid_lifetime"
+	ReasonKeyMismatch          RejectReason = "key_mismatch"
+	ReasonInvalidAuthorization RejectReason = "invalid_authorization"
+	ReasonOriginNotAllowed     RejectReason = "origin_not_allowed"
+	ReasonInitiatorNotAllowed  RejectReason = "initiator_not_allowed"
+	ReasonFederation           RejectReason = "federation"
+	ReasonUnknownSession       RejectReason = "unknown_session"
+	ReasonUnknown              RejectReason = "unknown"
+)
+
+// TerminateReason explains why a session ended
+type TerminateReason string
+
+const (
+	// TerminateExpired is reported when a refresh is attempted for an expired session
+	TerminateExpired TerminateReason = "expired"
+	// TerminateRevoked is reported when an administrator revokes the session
+	TerminateRevoked TerminateReason = "revoked"
+	// TerminateLogout is reported when the login the session was registered from ends
+	TerminateLogout TerminateReason = "logout"
+)
+
+// Phase is the DBSC exchange an event belongs to
+type Phase string
+
+const (
+	PhaseRegistration Phase = "registration"
+	PhaseRefresh      Phase = "refresh"
+)
+
+// Event describes something that happened to a DBSC session.
+// Fields that do not apply to the event type are left empty.
+type Event struct {
+	Type              EventType
+	Time              time.Time
+	Phase             Phase
+	SessionIdentifier string
+	User              string
+	ProviderID        string
+	// Initiator is the site that initiated a refresh (empty for same-origin)
+	Initiator string
+	// KeyThumbprint is the JWK thumbprint of the session key (when known)
+	KeyThumbprint string
+	RemoteAddr    string
+	UserAgent     string
+	// Duration is the time spent handling the request (EventRefreshed)
+	Duration time.Duration
+
+	// EventProofRejected
+	RejectReason RejectReason
+	Err          error
+
+	// EventTerminated
+	TerminateReason TerminateReason
+}
+
+// Observer receives DBSC lifecycle events. OnEvent is called on the request goroutine,
+// so slow observers should be wrapped with NewAsyncDispatcher.
+type Observer interface {
+	OnEvent(event Event)
+}
+
+// ObserverFunc adapts a function to Observer
+type ObserverFunc func(event Event)
+
+func (f ObserverFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// MultiObserver delivers events to every observer in order
+func MultiObserver(observers ...Observer) Observer {
+	return ObserverFunc(func(event Event) {
+		for _, observer := range observers {
+			observer.OnEvent(event)
+		}
+	})
+}
+
+// AsyncDispatcher delivers events to an observer from a background goroutine.
+// Events are dropped (and counted) when the buffer is full so that requests never block.
+type AsyncDispatcher struct {
+	observer Observer
+	events   chan Event
+	done     chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+// NewAsyncDispatcher starts a dispatcher buffering up to size events
+func NewAsyncDispatcher(observer Observer, size int) *AsyncDispatcher {
+	d := &AsyncDispatcher{
+		observer: observer,
+		events:   make(chan Event, size),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *AsyncDispatcher) run() {
+	defer close(d.done)
+	for event := range d.events {
+		d.observer.OnEvent(event)
+	}
+}
+
+func (d *AsyncDispatcher) OnEvent(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.dropped++
+		return
+	}
+	select {
+	case d.events <- event:
+	default:
+		d.dropped++
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full or the dispatcher closed
+func (d *AsyncDispatcher) Dropped() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dropped
+}
+
+// Close stops accepting events and waits until the buffered ones are delivered
+func (d *AsyncDispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.events)
+	}
+	d.mu.Unlock()
+	<-d.done
+}
+
+// rejectReason classifies a proof verification error
+func rejectReason(err error) RejectReason {
+	switch {
+	case errors.Is(err, dbsc_proof.ErrProofTooLarge):
+		return ReasonProofTooLarge
+	case errors.Is(err, dbsc_proof.ErrInvalidHeader):
+		return ReasonInvalidHeader
+	case errors.Is(err, dbsc_proof.ErrInvalidSignature):
+		return ReasonInvalidSignature
+	case errors.Is(err, dbsc_proof.ErrInvalidAudience):
+		return ReasonInvalidAudience
+	case errors.Is(err, dbsc_proof.ErrInvalidChallenge):
+		return ReasonInvalidChallenge
+	case errors.Is(err, dbsc_proof.ErrInvalidIssuedAt):
+		return ReasonInvalidIssuedAt
+	case errors.Is(err, dbsc_proof.ErrInvalidLifetime):
+		return ReasonInvalidLifetime
+	case errors.Is(err, dbsc_proof.ErrKeyMismatch):
+		return ReasonKeyMismatch
+	case errors.Is(err, dbsc_proof.ErrMalformedProof):
+		return ReasonMalformedProof
+	default:
+		return ReasonUnknown
+	}
+}
+
+// emit delivers an event to the observer, stamping it with the server clock and the client of r
+func (s *DBSCServer) emit(r *http.Request, event Event) {
+	if s.Observer == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = s.Clock.Now()
+	}
+	event.RemoteAddr = r.RemoteAddr
+	event.UserAgent = r.UserAgent()
+	s.Observer.OnEvent(event)
+}
@@ -0,0 +1,136 @@
+package dbsc_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []dbsc.Event
+}
+
+func (r *recorder) OnEvent(event dbsc.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) take() []dbsc.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func postHeaders(t *testing.T, rawURL string, headers map[string]string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	events := &recorder{}
+	server := newApp(t, events)
+	client, err := dbscclient.New(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get(t, client, server.URL+"/login?user=alice")
+	get(t, client, server.URL+"/app")
+	got := events.take()
+	if len(got) != 2 || got[0].Type != dbsc.EventChallengeIssued || got[0].Phase != dbsc.PhaseRegistration {
+		t.Fatalf("registration events = %+v", got)
+	}
+	if got[1].Type != dbsc.EventRegistered || got[1].User != "alice" || got[1].SessionIdentifier == "" {
+		t.Fatalf("registered event = %+v", got[1])
+	}
+	sessionID := got[1].SessionIdentifier
+
+	if err := client.Refresh(context.Background(), client.Sessions()[0]); err != nil {
+		t.Fatal(err)
+	}
+	got = events.take()
+	if len(got) != 2 || got[0].Type != dbsc.EventChallengeIssued || got[1].Type != dbsc.EventRefreshed {
+		t.Fatalf("refresh events = %+v", got)
+	}
+	if got[1].SessionIdentifier != sessionID || got[1].User != "alice" || got[1].Time.IsZero() {
+		t.Errorf("refreshed event = %+v", got[1])
+	}
+
+	postHeaders(t, server.URL+dbsc.EndpointDBSCRefresh, map[string]string{
+		"Sec-Session-Id":       sessionID,
+		"Sec-Session-Response": "not-a-proof",
+	})
+	got = events.take()
+	if len(got) != 1 || got[0].Type != dbsc.EventProofRejected || got[0].RejectReason != dbsc.ReasonMalformedProof || got[0].Err == nil {
+		t.Fatalf("rejection events = %+v", got)
+	}
+
+	// 存在しないセッションは終了ではなく拒否として通知する
+	postHeaders(t, server.URL+dbsc.EndpointDBSCRefresh, map[string]string{"Sec-Session-Id": "unknown"})
+	got = events.take()
+	if len(got) != 1 || got[0].Type != dbsc.EventProofRejected || got[0].RejectReason != dbsc.ReasonUnknownSession {
+		t.Fatalf("unknown session events = %+v", got)
+	}
+}
+
+func TestAsyncDispatcher(t *testing.T) {
+	events := &recorder{}
+	dispatcher := dbsc.NewAsyncDispatcher(events, 16)
+	for i := 0; i < 10; i++ {
+		dispatcher.OnEvent(dbsc.Event{Type: dbsc.EventRefreshed})
+	}
+	dispatcher.Close()
+	if got := len(events.take()); got != 10 {
+		t.Errorf("delivered %d events, want 10", got)
+	}
+
+	dispatcher.OnEvent(dbsc.Event{Type: dbsc.EventRefreshed})
+	if dispatcher.Dropped() != 1 {
+		t.Errorf("events after Close must be dropped")
+	}
+}
+
+func TestAsyncDispatcherDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	dispatcher := dbsc.NewAsyncDispatcher(dbsc.ObserverFunc(func(dbsc.Event) { <-release }), 1)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			dispatcher.OnEvent(dbsc.Event{Type: dbsc.EventRefreshed})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("OnEvent blocked on a slow observer")
+	}
+	close(release)
+	dispatcher.Close()
+
+	// 1 件は処理中、1 件はバッファ内、残りは破棄される
+	if dropped := dispatcher.Dropped(); dropped < 3 {
+		t.Errorf("dropped = %d, want at least 3", dropped)
+	}
+}
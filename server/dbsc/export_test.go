@@ -0,0 +1,8 @@
+package dbsc
+
+// StoredEntries counts the entries held by the manager, including expired ones
+func (s *DBSCSessionManager) StoredEntries() (challenges, cookies, authorizations, refreshChallenges int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.challenges), len(s.cookies), len(s.authorizations), len(s.refreshChallenges)
+}
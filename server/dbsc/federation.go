@@ -0,0 +1,174 @@
+package dbsc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"dbsc-demo/logging"
+	"dbsc-demo/server/dbsc/wellknown"
+)
+
+const (
+	EndpointFederationStart      = "/dbsc_federation/start"
+	EndpointFederationHandoff    = "/dbsc_federation/handoff"
+	EndpointFederationSessionKey = "/dbsc_federation/session_key"
+)
+
+// ProviderSessionKey is the response of the provider's session key endpoint
+type ProviderSessionKey struct {
+	SessionIdentifier string `json:"session_identifier"`
+	PublicKeyPEM      string `json:"public_key_pem"`
+}
+
+// ProviderClient fetches session keys from a federation provider (IdP) instance
+type ProviderClient struct {
+	ProviderURL string
+	HTTPClient  *http.Client
+	WellKnown   *wellknown.Client
+}
+
+func NewProviderClient(providerURL string, wellKnownClient *wellknown.Client) *ProviderClient {
+	return &ProviderClient{
+		ProviderURL: providerURL,
+		HTTPClient:  &http.Client{Timeout: 5 * time.Second},
+		WellKnown:   wellKnownClient,
+	}
+}
+
+// CheckRelyingOrigin verifies that the provider lists origin in its relying_origins
+func (c *ProviderClient) CheckRelyingOrigin(ctx context.Context, origin string) error {
+	doc, err := c.WellKnown.Fetch(ctx, c.ProviderURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch provider well-known document: %w", err)
+	}
+	if !doc.HasRelyingOrigin(origin) {
+		return fmt.Errorf("origin not allowed for federation: %s", origin)
+	}
+	return nil
+}
+
+// FetchSessionKey retrieves the public key bound to the provider session for the relying party at origin
+func (c *ProviderClient) FetchSessionKey(ctx context.Context, origin string, providerID string) (*ProviderSessionKey, error) {
+	endpoint := c.ProviderURL + EndpointFederationSessionKey + "?id=" + url.QueryEscape(providerID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Origin", origin)
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider session key: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider returned status %d", res.StatusCode)
+	}
+
+	var key ProviderSessionKey
+	if err := json.NewDecoder(res.Body).Decode(&key); err != nil {
+		return nil, fmt.Errorf("failed to decode provider session key: %w", err)
+	}
+	if key.SessionIdentifier != providerID || key.PublicKeyPEM == "" {
+		return nil, fmt.Errorf("provider returned an unexpected session key")
+	}
+	return &key, nil
+}
+
+// WellKnownHandler serves /.well-known/device-bound-sessions
+func (s *DBSCServer) WellKnownHandler(w http.ResponseWriter, r *http.Request) {
+	wellknown.Handler(s.Config.wellKnownDocument(), time.Hour).ServeHTTP(w, r)
+}
+
+// FederationStartHandler (RP) sends the user to the provider to obtain its session identifier
+func (s *DBSCServer) FederationStartHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Config.FederationRole != FederationRelyingParty {
+		http.NotFound(w, r)
+		return
+	}
+	returnTo := s.Config.Origin + "/login"
+	http.Redirect(w, r, s.Config.ProviderURL+EndpointFederationHandoff+"?return_to="+url.QueryEscape(returnTo), http.StatusFound)
+}
+
+// FederationHandoffHandler (IdP) returns the user to the RP with the identifier of the bound session
+func (s *DBSCServer) FederationHandoffHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Config.FederationRole != FederationProvider {
+		http.NotFound(w, r)
+		return
+	}
+
+	returnTo, err := url.Parse(r.URL.Query().Get("return_to"))
+	if err != nil || returnTo.Scheme == "" || returnTo.Host == "" {
+		http.Error(w, "return_to must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+	if !s.Config.isRelyingOrigin(returnTo.Scheme + "://" + returnTo.Host) {
+		logging.Logger.WarnContext(r.Context(), "federation handoff to non relying origin", "host", returnTo.Host)
+		http.Error(w, "Origin not allowed for federation", http.StatusForbidden)
+		return
+	}
+
+	cookie, err := r.Cookie(s.CookieName)
+	if err != nil {
+		http.Error(w, "DBSC session cookie not found", http.StatusUnauthorized)
+		return
+	}
+	session, ok := s.Store.GetSessionByCookie(cookie.Value)
+	if !ok {
+		http.Error(w, "DBSC session not found or expired", http.StatusUnauthorized)
+		return
+	}
+
+	query := returnTo.Query()
+	query.Set("provider_id", session.Identifier)
+	returnTo.RawQuery = query.Encode()
+
+	logging.Logger.InfoContext(r.Context(), "handing off provider session", logging.SessionID(session.Identifier), "host", returnTo.Host)
+	http.Redirect(w, r, returnTo.String(), http.StatusFound)
+}
+
+// FederationSessionKeyHandler (IdP) shares the public key bound to a provider session with
+// the relying origins of the configuration, identified by the Origin header
+func (s *DBSCServer) FederationSessionKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Config.FederationRole != FederationProvider {
+		http.NotFound(w, r)
+		return
+	}
+	if origin := r.Header.Get("Origin"); !s.Config.isRelyingOrigin(origin) {
+		logging.Logger.WarnContext(r.Context(), "session key requested by non relying origin", "origin", origin)
+		http.Error(w, "Origin not allowed for federation", http.StatusForbidden)
+		return
+	}
+
+	session, ok := s.Store.GetSession(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "DBSC session not found or expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProviderSessionKey{
+		SessionIdentifier: session.Identifier,
+		PublicKeyPEM:      session.PublicKeyPEM,
+	})
+}
+
+// validateFederatedSession (RP) checks that the registered key is the key of the provider session
+func (s *DBSCServer) validateFederatedSession(ctx context.Context, challenge *DBSCChallenge, proofPEM string) error {
+	if err := s.providerClient.CheckRelyingOrigin(ctx, s.Config.Origin); err != nil {
+		return err
+	}
+	providerKey, err := s.providerClient.FetchSessionKey(ctx, s.Config.Origin, challenge.ProviderID)
+	if err != nil {
+		return fmt.Errorf("provider session not available: %w", err)
+	}
+	if providerKey.PublicKeyPEM != challenge.ProviderKeyPEM || proofPEM != providerKey.PublicKeyPEM {
+		return fmt.Errorf("provider key mismatch")
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package dbsc_proof
 
 import (
-	"dbsc-demo/logging"
 	"errors"
 	"fmt"
 	"time"
@@ -35,7 +34,6 @@ func ParseDBSCProofPayload(claims map[string]interface{}) (*DBSCProof, error) {
 	case []string:
 		audienceArr = v
 	default:
-		logging.Logger.Printf("aud params: %v", aud)
 		return nil, fmt.Errorf("invalid aud claim: unexpected type(%T)", aud)
 	}
 
@@ -0,0 +1,183 @@
+package dbsc_proof_test
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+)
+
+const seedAudience = "http://localhost:8080/dbsc_start"
+
+// seedIssuedAt is the iat of the seed proofs and the time of the verifier clock
+var seedIssuedAt = time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+
+// acceptAll accepts every challenge and session so that only parsing and signature checks run
+type acceptAll struct{}
+
+func (acceptAll) VerifyChallenge(string) bool       { return true }
+func (acceptAll) VerifySession(string, string) bool { return true }
+
+// chromeShapedProofs returns proofs shaped like the ones sent by Chrome for registration and refresh
+func chromeShapedProofs(f *testing.F) []string {
+	f.Helper()
+	var proofs []string
+	for _, algorithm := range []string{dbscclient.AlgorithmES256, dbscclient.AlgorithmRS256} {
+		key, err := dbscclient.GenerateKey(algorithm)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, claims := range []dbscclient.ProofClaims{
+			{Audience: seedAudience, JTI: "bHH4RpDSE6PyMydNeqmAUEugKH5cLK28vsQD_4_GD5k=", Authorization: "7q4ulYufRHGjidHUjwWBEMnnLtPQoPL5SA9fHjqFcJM="},
+			{Audience: seedAudience, JTI: "CAP9e2Jj9Di2axH9NNjV-dncAVPv3KnT4knyJAz0ifQ=", Subject: "Gme8epvBHJnQRaGVvM2A21H3ZUEaCFLNXMFjqXT0oDI="},
+		} {
+			proofs = append(proofs, signSeed(f, key, claims))
+		}
+	}
+	return proofs
+}
+
+func signSeed(f *testing.F, key crypto.Signer, claims dbscclient.ProofClaims) string {
+	f.Helper()
+	claims.IssuedAt = seedIssuedAt.Unix()
+	proof, err := dbscclient.SignProof(key, claims)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return proof
+}
+
+// payloadOf extracts the JSON payload of a compact JWS
+func payloadOf(f *testing.F, proof string) []byte {
+	f.Helper()
+	claims, err := base64.RawURLEncoding.DecodeString(strings.Split(proof, ".")[1])
+	if err != nil {
+		f.Fatal(err)
+	}
+	return claims
+}
+
+func FuzzParseDBSCProofPayload(f *testing.F) {
+	for _, proof := range chromeShapedProofs(f) {
+		f.Add(payloadOf(f, proof))
+	}
+	f.Add([]byte(`{"aud":["a","b"],"jti":"x","iat":1,"key":{"kty":"EC"}}`))
+	f.Add([]byte(`{"aud":1,"jti":"x","iat":"1","key":[]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var claims map[string]interface{}
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return
+		}
+		proof, err := dbsc_proof.ParseDBSCProofPayload(claims)
+		if err != nil {
+			return
+		}
+		if proof.PublicKey == nil || proof.PEM == "" || proof.IssuedAt == nil {
+			t.Fatalf("accepted claims without key or iat: %s", data)
+		}
+
+		again, err := dbsc_proof.ParseDBSCProofPayload(claims)
+		if err != nil || again.PEM != proof.PEM || !reflect.DeepEqual(again.Audience, proof.Audience) || again.JTI != proof.JTI {
+			t.Fatalf("parsing is not deterministic for %s", data)
+		}
+	})
+}
+
+func FuzzParseJwk(f *testing.F) {
+	for _, proof := range chromeShapedProofs(f) {
+		var claims struct {
+			Key json.RawMessage `json:"key"`
+		}
+		if err := json.Unmarshal(payloadOf(f, proof), &claims); err != nil {
+			f.Fatal(err)
+		}
+		f.Add([]byte(claims.Key))
+	}
+	f.Add([]byte(`{"kty":"EC","crv":"P-256","x":"AAAA","y":"AAAA"}`))
+	f.Add([]byte(`{"kty":"RSA","n":"AQAB","e":"AQAB"}`))
+	f.Add([]byte(`{"kty":"oct","k":"AAAA"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var jwk map[string]interface{}
+		if err := json.Unmarshal(data, &jwk); err != nil {
+			return
+		}
+		publicKey, pem, err := dbsc_proof.ParseJwk(jwk)
+		if err != nil {
+			return
+		}
+
+		// 受理したキーは PEM を経由しても同じキーになる
+		parsed, err := dbsc_proof.ParsePEM(pem)
+		if err != nil {
+			t.Fatalf("accepted key does not round trip through PEM: %v", err)
+		}
+		if !reflect.DeepEqual(parsed, publicKey) {
+			if equal, ok := parsed.(interface{ Equal(crypto.PublicKey) bool }); !ok || !equal.Equal(publicKey) {
+				t.Fatalf("PEM round trip changed the key for %s", data)
+			}
+		}
+		if _, err := dbsc_proof.Thumbprint(publicKey); err != nil {
+			t.Fatalf("accepted key has no thumbprint: %v", err)
+		}
+	})
+}
+
+func FuzzVerifyDBSCProof(f *testing.F) {
+	verifier := dbsc_proof.NewDBSCProofVerifier(acceptAll{})
+	verifier.Clock = clock.NewFake(seedIssuedAt)
+
+	for _, proof := range chromeShapedProofs(f) {
+		// 正しいシードが受理されないと再検証の確認まで届かない
+		if _, err := verifier.VerifyDBSCProof(proof, seedAudience); err != nil {
+			f.Fatalf("seed proof rejected: %v", err)
+		}
+		f.Add(proof)
+	}
+	f.Add("eyJhbGciOiJub25lIn0.e30.")
+	f.Add("a.b.c")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, token string) {
+		proof, err := verifier.VerifyDBSCProof(token, seedAudience)
+		if len(token) > dbsc_proof.MaxProofSize && err == nil {
+			t.Fatalf("accepted a proof of %d bytes", len(token))
+		}
+		if err != nil {
+			return
+		}
+
+		// 受理した proof は再検証しても同じ結果になる
+		again, err := verifier.VerifyDBSCProof(token, seedAudience)
+		if err != nil {
+			t.Fatalf("accepted proof failed verification the second time: %v", err)
+		}
+		if again.PEM != proof.PEM || again.JTI != proof.JTI || again.Subject != proof.Subject || again.Authorization != proof.Authorization {
+			t.Fatalf("verification is not deterministic")
+		}
+	})
+}
+
+func TestVerifyDBSCProofRejectsOversizedProof(t *testing.T) {
+	verifier := dbsc_proof.NewDBSCProofVerifier(acceptAll{})
+	token := strings.Repeat("a", dbsc_proof.MaxProofSize+1)
+	if _, err := verifier.VerifyDBSCProof(token, seedAudience); err == nil {
+		t.Fatal("expected an error for an oversized proof")
+	}
+
+	// 巨大な入力は解析前に拒否され、入力サイズに比例したアロケーションは発生しない
+	allocs := testing.AllocsPerRun(10, func() {
+		verifier.VerifyDBSCProof(token, seedAudience)
+	})
+	if allocs > 5 {
+		t.Errorf("oversized proof allocated %v times", allocs)
+	}
+}
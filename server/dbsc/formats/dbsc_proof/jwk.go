@@ -10,6 +10,14 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const (
+	// RSA 公開キーの許容サイズ (bit)
+	minRSAKeySize = 2048
+	maxRSAKeySize = 8192
 )
 
 // JWKToPublicKey converts JWK to crypto.PublicKey
@@ -76,11 +84,19 @@ func jwkToECDSAPublicKey(jwk map[string]interface{}) (*ecdsa.PublicKey, error) {
 		return nil, fmt.Errorf("unsupported curve: %s", crv)
 	}
 
+	byteLen := (curve.Params().BitSize + 7) / 8
+	if len(xBytes) != byteLen || len(yBytes) != byteLen {
+		return nil, fmt.Errorf("invalid coordinate length for %s", crv)
+	}
+
 	pub := ecdsa.PublicKey{
 		Curve: curve,
 		X:     new(big.Int).SetBytes(xBytes),
 		Y:     new(big.Int).SetBytes(yBytes),
 	}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", crv)
+	}
 	return &pub, nil
 }
 
@@ -110,6 +126,13 @@ func jwkToRSAPublicKey(jwk map[string]interface{}) (*rsa.PublicKey, error) {
 	nInt.SetBytes(nBytes)
 	eInt.SetBytes(eBytes)
 
+	if bits := nInt.BitLen(); bits < minRSAKeySize || bits > maxRSAKeySize {
+		return nil, fmt.Errorf("unsupported modulus size: %d bits", bits)
+	}
+	if !eInt.IsInt64() || eInt.Int64() < 3 || eInt.Int64() > 1<<31-1 || eInt.Bit(0) == 0 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+
 	return &rsa.PublicKey{
 		N: &nInt,
 		E: int(eInt.Int64()),
@@ -127,3 +150,38 @@ func PublicKeyToPEM(publicKey crypto.PublicKey) (string, error) {
 	}
 	return string(pem.EncodeToMemory(pemBlock)), nil
 }
+
+// ParsePEM parses a PEM encoded public key
+func ParsePEM(pemString string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("invalid PEM public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return publicKey, nil
+}
+
+// Thumbprint returns the base64url encoded JWK SHA-256 thumbprint (RFC 7638) of the public key
+func Thumbprint(publicKey crypto.PublicKey) (string, error) {
+	key, err := jwk.FromRaw(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert public key to JWK: %w", err)
+	}
+	sum, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
+
+// PEMThumbprint returns the JWK thumbprint of a PEM encoded public key
+func PEMThumbprint(pemString string) (string, error) {
+	publicKey, err := ParsePEM(pemString)
+	if err != nil {
+		return "", err
+	}
+	return Thumbprint(publicKey)
+}
@@ -2,15 +2,41 @@ package dbsc_proof
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
-	"dbsc-demo/logging"
+	"dbsc-demo/clock"
 
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
+// MaxProofSize bounds the size of a DBSC proof accepted for parsing (RSA 8192 keys fit comfortably)
+const MaxProofSize = 16 * 1024
+
+// DefaultMaxClockSkew is how far the clock of a client may run ahead of the server's
+// when NewDBSCProofVerifier creates a verifier
+const DefaultMaxClockSkew = 5 * time.Second
+
+// Errors returned by the verifier, wrapped with details, to classify rejected proofs
+var (
+	ErrProofTooLarge    = errors.New("proof too large")
+	ErrMalformedProof   = errors.New("malformed proof")
+	ErrInvalidHeader    = errors.New("invalid proof header")
+	ErrInvalidSignature = errors.New("invalid proof signature")
+	ErrInvalidAudience  = errors.New("invalid audience")
+	ErrInvalidChallenge = errors.New("invalid challenge")
+	ErrInvalidIssuedAt  = errors.New("iat in the future")
+	ErrInvalidLifetime  = errors.New("proof expired or not yet valid")
+	ErrKeyMismatch      = errors.New("public key does not match session")
+)
+
 type DBSCProofVerifier struct {
+	Clock clock.Clock
+	// MaxClockSkew is the tolerance for iat, exp and nbf against Clock
+	MaxClockSkew time.Duration
+
 	sessionManager SessionManager
 }
 
@@ -21,20 +47,26 @@ type SessionManager interface {
 
 func NewDBSCProofVerifier(sessionManager SessionManager) *DBSCProofVerifier {
 	return &DBSCProofVerifier{
+		Clock:          clock.System,
+		MaxClockSkew:   DefaultMaxClockSkew,
 		sessionManager: sessionManager,
 	}
 }
 
 // VerifyDBSCProof verifies a DBSC Proof JWT using lestrrat-go/jwx
 func (v *DBSCProofVerifier) VerifyDBSCProof(tokenString, expectedAud string) (*DBSCProof, error) {
+	if len(tokenString) > MaxProofSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrProofTooLarge, len(tokenString))
+	}
+
 	// Parse JWS message to extract header and payload without verification
 	msg, err := jws.Parse([]byte(tokenString))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse JWS: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse JWS: %w", ErrMalformedProof, err)
 	}
 
 	if len(msg.Signatures()) == 0 {
-		return nil, fmt.Errorf("no signatures found")
+		return nil, fmt.Errorf("%w: no signatures found", ErrMalformedProof)
 	}
 
 	sig := msg.Signatures()[0]
@@ -42,35 +74,39 @@ func (v *DBSCProofVerifier) VerifyDBSCProof(tokenString, expectedAud string) (*D
 
 	// Verify header
 	if err := v.verifyJWSHeader(headers); err != nil {
-		return nil, fmt.Errorf("header validation failed: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
 	}
 
-	// Parse payload as JWT to get claims
-	token, err := jwt.Parse(msg.Payload(), jwt.WithVerify(false))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse JWT payload: %w", err)
+	// Parse payload as JWT to get claims, validating iat, exp and nbf against the verifier clock
+	token, err := jwt.Parse(msg.Payload(), jwt.WithVerify(false), jwt.WithClock(v.Clock), jwt.WithAcceptableSkew(v.MaxClockSkew))
+	switch {
+	case errors.Is(err, jwt.ErrInvalidIssuedAt()):
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIssuedAt, err)
+	case errors.Is(err, jwt.ErrTokenExpired()), errors.Is(err, jwt.ErrTokenNotYetValid()):
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLifetime, err)
+	case err != nil:
+		return nil, fmt.Errorf("%w: failed to parse JWT payload: %w", ErrMalformedProof, err)
 	}
 
 	// Convert to map for our existing parsing logic
 	claimsMap, err := token.AsMap(context.TODO())
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert claims to map: %w", err)
+		return nil, fmt.Errorf("%w: failed to convert claims to map: %w", ErrMalformedProof, err)
 	}
 
 	// Parse DBSC-specific claims
 	claims, err := ParseDBSCProofPayload(claimsMap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse claims: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse claims: %w", ErrMalformedProof, err)
 	}
 
 	// Verify signature using the public key from claims
 	if _, err := jws.Verify([]byte(tokenString), jws.WithKey(headers.Algorithm(), claims.PublicKey)); err != nil {
-		return nil, fmt.Errorf("signature verification failed: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSignature, err)
 	}
 
 	// Verify DBSC-specific requirements
 	if err := v.verifyDBSCClaims(claims, expectedAud); err != nil {
-		logging.Logger.Printf("DBSC claims validation failed: %v", err)
 		return nil, fmt.Errorf("DBSC validation failed: %w", err)
 	}
 
@@ -105,27 +141,26 @@ func (v *DBSCProofVerifier) verifyDBSCClaims(claims *DBSCProof, expectedAud stri
 		}
 	}
 	if !correctAud {
-		return fmt.Errorf("invalid audience: expected '%s', got '%s'", expectedAud, claims.Audience)
+		return fmt.Errorf("%w: expected '%s', got '%s'", ErrInvalidAudience, expectedAud, claims.Audience)
 	}
 
 	// Verify challenge
 	if claims.JTI == "" {
-		return fmt.Errorf("missing jti (challenge)")
+		return fmt.Errorf("%w: missing jti (challenge)", ErrMalformedProof)
 	}
 
 	if !v.sessionManager.VerifyChallenge(claims.JTI) {
-		logging.Logger.Printf("Invalid challenge: %s", claims.JTI)
-		return fmt.Errorf("invalid challenge: %s", claims.JTI)
+		return ErrInvalidChallenge
 	}
 
-	// Verify issued at time
+	// Verify issued at time (a future iat is rejected when parsing)
 	if claims.IssuedAt == nil {
-		return fmt.Errorf("missing iat")
+		return fmt.Errorf("%w: missing iat", ErrMalformedProof)
 	}
 
 	// Verify public key exists
 	if len(claims.Key) == 0 {
-		return fmt.Errorf("missing public key")
+		return fmt.Errorf("%w: missing public key", ErrMalformedProof)
 	}
 
 	return nil
@@ -149,8 +184,7 @@ func (v *DBSCProofVerifier) VerifyRefreshProof(tokenString, expectedAud, session
 
 	// Verify the public key matches the session's registered key
 	if !v.sessionManager.VerifySession(sessionID, claims.PEM) {
-		logging.Logger.Printf("Public key does not match session for session ID: %s", sessionID)
-		return nil, fmt.Errorf("public key does not match session")
+		return nil, ErrKeyMismatch
 	}
 
 	return claims, nil
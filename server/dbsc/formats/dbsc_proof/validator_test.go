@@ -0,0 +1,67 @@
+package dbsc_proof_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+func TestVerifyDBSCProofTimeClaims(t *testing.T) {
+	key, err := dbscclient.GenerateKey(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicJWK, err := dbscclient.PublicJWK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := seedIssuedAt
+	verifier := dbsc_proof.NewDBSCProofVerifier(acceptAll{})
+	verifier.Clock = clock.NewFake(now)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   error
+	}{
+		{"iat now", map[string]interface{}{"iat": now.Unix()}, nil},
+		{"iat within skew", map[string]interface{}{"iat": now.Add(3 * time.Second).Unix()}, nil},
+		{"iat beyond skew", map[string]interface{}{"iat": now.Add(time.Minute).Unix()}, dbsc_proof.ErrInvalidIssuedAt},
+		{"exp in the future", map[string]interface{}{"iat": now.Unix(), "exp": now.Add(time.Minute).Unix()}, nil},
+		{"expired", map[string]interface{}{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-time.Minute).Unix()}, dbsc_proof.ErrInvalidLifetime},
+		{"not yet valid", map[string]interface{}{"iat": now.Unix(), "nbf": now.Add(time.Minute).Unix()}, dbsc_proof.ErrInvalidLifetime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["aud"] = seedAudience
+			tt.claims["jti"] = "challenge"
+			tt.claims["key"] = publicJWK
+			payload, err := json.Marshal(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := jws.NewHeaders()
+			headers.Set(jws.TypeKey, "dbsc+jwt")
+			proof, err := jws.Sign(payload, jws.WithKey(jwa.ES256, key, jws.WithProtectedHeaders(headers)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = verifier.VerifyDBSCProof(string(proof), seedAudience)
+			if tt.want == nil && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
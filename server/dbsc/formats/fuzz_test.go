@@ -0,0 +1,100 @@
+package formats
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var tokenPattern = regexp.MustCompile("^[A-Za-z*][A-Za-z0-9!#$%&'*+\\-.^_`|~:/]*$")
+
+func FuzzParseSecureSessionRegistrationHeader(f *testing.F) {
+	// Chrome M139 までの実装が受け取る形式
+	f.Add(`(ES256 RS256); path="/dbsc_start"; challenge="bHH4RpDSE6PyMydNeqmAUEugKH5cLK28vsQD_4_GD5k="; authorization="7q4ulYufRHGjidHUjwWBEMnnLtPQoPL5SA9fHjqFcJM="`)
+	f.Add(`(ES256);path="/reg";challenge="abc"`)
+	f.Add(`(RS256 ES256); path="/dbsc_start"; challenge="c"; provider_key="ytc_E-qAeowoA0dwr4TzqxmvB_CnP3m48XeMRPlG_aM"; provider_id="id"; provider_url="http://localhost:8080"`)
+	f.Add(`(ES256); path="/a", (RS256); path="/b"; challenge="x\"y\\z"`)
+	f.Add(`("ES256"); path=token; flag`)
+	f.Add(`(ES256`)
+
+	f.Fuzz(func(t *testing.T, value string) {
+		header, err := ParseSecureSessionRegistrationHeader(value)
+		if len(value) > MaxHeaderSize && err == nil {
+			t.Fatalf("accepted a header of %d bytes", len(value))
+		}
+		if err != nil {
+			return
+		}
+
+		for _, entry := range header {
+			if entry.Params.Path == "" {
+				t.Fatalf("accepted an entry without path: %q", value)
+			}
+			tokens := true
+			for _, algorithm := range entry.Algorithms {
+				tokens = tokens && tokenPattern.MatchString(algorithm)
+			}
+			serialized := entry.ToSFV()
+			if !tokens || len(serialized) > MaxHeaderSize {
+				continue
+			}
+
+			// 受理した入力はシリアライズ後も同じ内容に解析される
+			reparsed, err := ParseSecureSessionRegistrationHeader(serialized)
+			if err != nil {
+				t.Fatalf("failed to reparse %q: %v", serialized, err)
+			}
+			if !reflect.DeepEqual(reparsed[0], entry) {
+				t.Fatalf("round trip mismatch: %+v != %+v", reparsed[0].Params, entry.Params)
+			}
+		}
+	})
+}
+
+func FuzzParseSecureSessionChallengeHeader(f *testing.F) {
+	f.Add(`"CAP9e2Jj9Di2axH9NNjV-dncAVPv3KnT4knyJAz0ifQ=";id="Gme8epvBHJnQRaGVvM2A21H3ZUEaCFLNXMFjqXT0oDI="`)
+	f.Add(`"challenge"`)
+	f.Add(`"a";id="1", "b";id="2"`)
+	f.Add(`"unterminated`)
+	f.Add(`token;id=?1`)
+
+	f.Fuzz(func(t *testing.T, value string) {
+		header, err := ParseSecureSessionChallengeHeader(value)
+		if len(value) > MaxHeaderSize && err == nil {
+			t.Fatalf("accepted a header of %d bytes", len(value))
+		}
+		if err != nil {
+			return
+		}
+
+		serialized := header.ToSFV()
+		if len(serialized) > MaxHeaderSize {
+			return
+		}
+		reparsed, err := ParseSecureSessionChallengeHeader(serialized)
+		if err != nil {
+			t.Fatalf("failed to reparse %q: %v", serialized, err)
+		}
+		if !reflect.DeepEqual(reparsed, header) {
+			t.Fatalf("round trip mismatch: %+v != %+v", reparsed, header)
+		}
+	})
+}
+
+func TestParseSecureSessionRegistrationHeaderTooLarge(t *testing.T) {
+	value := `(ES256); path="/dbsc_start"; challenge="` + strings.Repeat("a", MaxHeaderSize) + `"`
+	if _, err := ParseSecureSessionRegistrationHeader(value); err == nil {
+		t.Fatal("expected an error for an oversized header")
+	}
+
+	if raceEnabled {
+		return
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		ParseSecureSessionRegistrationHeader(value)
+	})
+	if allocs > 5 {
+		t.Errorf("oversized header allocated %v times", allocs)
+	}
+}
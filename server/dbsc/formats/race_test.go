@@ -0,0 +1,6 @@
+//go:build race
+
+package formats
+
+// raceEnabled reports whether the race detector, which adds allocations, is enabled
+const raceEnabled = true
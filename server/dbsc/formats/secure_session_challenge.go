@@ -19,10 +19,10 @@ func (h SecureSessionChallengeHeader) ToSFV() string {
 	var entries []string
 
 	for _, challenge := range h {
-		entry := fmt.Sprintf(`"%s"`, challenge.Challenge)
+		entry := quoteSFVString(challenge.Challenge)
 
 		if challenge.ID != "" {
-			entry += fmt.Sprintf(`;id="%s"`, challenge.ID)
+			entry += ";id=" + quoteSFVString(challenge.ID)
 		}
 
 		entries = append(entries, entry)
@@ -31,6 +31,26 @@ func (h SecureSessionChallengeHeader) ToSFV() string {
 	return strings.Join(entries, ", ")
 }
 
+// ParseSecureSessionChallengeHeader parses a Sec-Session-Challenge header value
+func ParseSecureSessionChallengeHeader(value string) (SecureSessionChallengeHeader, error) {
+	items, err := parseSFVList(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid challenge header: %w", err)
+	}
+
+	var header SecureSessionChallengeHeader
+	for _, item := range items {
+		if item.IsList || item.Value == "" {
+			return nil, fmt.Errorf("invalid challenge header: challenge string expected")
+		}
+		header = append(header, SecureSessionChallenge{
+			Challenge: item.Value,
+			ID:        item.Params["id"],
+		})
+	}
+	return header, nil
+}
+
 // CreateSingle creates a single challenge header
 func NewSecureSessionChallengeHeader(challenge, sessionID string) SecureSessionChallengeHeader {
 	return SecureSessionChallengeHeader{
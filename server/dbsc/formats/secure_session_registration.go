@@ -32,23 +32,54 @@ func (e *SecureSessionRegistrationEntry) ToSFV() string {
 	var params []string
 
 	// path は必須
-	params = append(params, fmt.Sprintf(`path="%s"`, e.Params.Path))
+	params = append(params, "path="+quoteSFVString(e.Params.Path))
 
 	if e.Params.Challenge != "" {
-		params = append(params, fmt.Sprintf(`challenge="%s"`, e.Params.Challenge))
+		params = append(params, "challenge="+quoteSFVString(e.Params.Challenge))
 	}
 	if e.Params.Authorization != "" {
-		params = append(params, fmt.Sprintf(`authorization="%s"`, e.Params.Authorization))
+		params = append(params, "authorization="+quoteSFVString(e.Params.Authorization))
 	}
 	if e.Params.ProviderKey != "" {
-		params = append(params, fmt.Sprintf(`provider_key="%s"`, e.Params.ProviderKey))
+		params = append(params, "provider_key="+quoteSFVString(e.Params.ProviderKey))
 	}
 	if e.Params.ProviderID != "" {
-		params = append(params, fmt.Sprintf(`provider_id="%s"`, e.Params.ProviderID))
+		params = append(params, "provider_id="+quoteSFVString(e.Params.ProviderID))
 	}
 	if e.Params.ProviderURL != "" {
-		params = append(params, fmt.Sprintf(`provider_url="%s"`, e.Params.ProviderURL))
+		params = append(params, "provider_url="+quoteSFVString(e.Params.ProviderURL))
 	}
 
 	return algList + "; " + strings.Join(params, "; ")
 }
+
+// ParseSecureSessionRegistrationHeader parses a Sec-Session-Registration header value
+func ParseSecureSessionRegistrationHeader(value string) (SecureSessionRegistrationHeader, error) {
+	items, err := parseSFVList(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration header: %w", err)
+	}
+
+	var header SecureSessionRegistrationHeader
+	for _, item := range items {
+		if !item.IsList {
+			return nil, fmt.Errorf("invalid registration header: algorithm list expected")
+		}
+		path, ok := item.Params["path"]
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid registration header: path is required")
+		}
+		header = append(header, &SecureSessionRegistrationEntry{
+			Algorithms: item.InnerList,
+			Params: &SecureSessionRegistrationParams{
+				Path:          path,
+				Challenge:     item.Params["challenge"],
+				Authorization: item.Params["authorization"],
+				ProviderKey:   item.Params["provider_key"],
+				ProviderID:    item.Params["provider_id"],
+				ProviderURL:   item.Params["provider_url"],
+			},
+		})
+	}
+	return header, nil
+}
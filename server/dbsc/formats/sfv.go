@@ -0,0 +1,241 @@
+package formats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sfvItem is a parsed member of a Structured Field list (RFC 8941).
+// Only the subset used by DBSC headers is supported: sf-strings, tokens and inner lists of tokens,
+// with string, token, integer or boolean parameters.
+type sfvItem struct {
+	Value     string   // sf-string / token の値
+	InnerList []string // inner list の場合の要素
+	IsList    bool
+	Params    map[string]string
+}
+
+type sfvParser struct {
+	input string
+	pos   int
+}
+
+// MaxHeaderSize bounds the size of a DBSC header value accepted for parsing
+const MaxHeaderSize = 8 * 1024
+
+// parseSFVList parses a Structured Field list header value
+func parseSFVList(input string) ([]sfvItem, error) {
+	if len(input) > MaxHeaderSize {
+		return nil, fmt.Errorf("header too large: %d bytes", len(input))
+	}
+	p := &sfvParser{input: input}
+	var items []sfvItem
+
+	p.skipSpaces()
+	if p.eof() {
+		return nil, fmt.Errorf("empty list")
+	}
+	for {
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		p.skipSpaces()
+		if p.eof() {
+			return items, nil
+		}
+		if p.input[p.pos] != ',' {
+			return nil, fmt.Errorf("expected ',' at %d", p.pos)
+		}
+		p.pos++
+		p.skipSpaces()
+		if p.eof() {
+			return nil, fmt.Errorf("trailing ','")
+		}
+	}
+}
+
+func (p *sfvParser) parseItem() (sfvItem, error) {
+	var item sfvItem
+	if p.peek() == '(' {
+		list, err := p.parseInnerList()
+		if err != nil {
+			return item, err
+		}
+		item.InnerList = list
+		item.IsList = true
+	} else {
+		value, err := p.parseBareItem()
+		if err != nil {
+			return item, err
+		}
+		item.Value = value
+	}
+
+	params, err := p.parseParams()
+	if err != nil {
+		return item, err
+	}
+	item.Params = params
+	return item, nil
+}
+
+func (p *sfvParser) parseInnerList() ([]string, error) {
+	p.pos++ // '('
+	list := []string{}
+	for {
+		for p.peek() == ' ' {
+			p.pos++
+		}
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated inner list")
+		}
+		if p.peek() == ')' {
+			p.pos++
+			return list, nil
+		}
+		value, err := p.parseBareItem()
+		if err != nil {
+			return nil, err
+		}
+		// inner list の要素のパラメータは DBSC では使われないので読み飛ばす
+		if _, err := p.parseParams(); err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return nil, fmt.Errorf("expected ' ' or ')' at %d", p.pos)
+		}
+	}
+}
+
+func (p *sfvParser) parseParams() (map[string]string, error) {
+	params := map[string]string{}
+	for {
+		// DBSC の実装では "; " の形式も使われるため空白を許容する
+		save := p.pos
+		p.skipSpaces()
+		if p.peek() != ';' {
+			p.pos = save
+			return params, nil
+		}
+		p.pos++
+		p.skipSpaces()
+
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		value := "?1"
+		if p.peek() == '=' {
+			p.pos++
+			value, err = p.parseBareItem()
+			if err != nil {
+				return nil, err
+			}
+		}
+		params[key] = value
+	}
+}
+
+func (p *sfvParser) parseKey() (string, error) {
+	start := p.pos
+	if c := p.peek(); !(c >= 'a' && c <= 'z' || c == '*') {
+		return "", fmt.Errorf("invalid key at %d", p.pos)
+	}
+	for !p.eof() {
+		c := p.input[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *sfvParser) parseBareItem() (string, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseString()
+	case c == '?':
+		if p.pos+1 < len(p.input) && (p.input[p.pos+1] == '0' || p.input[p.pos+1] == '1') {
+			p.pos += 2
+			return p.input[p.pos-2 : p.pos], nil
+		}
+		return "", fmt.Errorf("invalid boolean at %d", p.pos)
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		p.pos++
+		for !p.eof() && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+			p.pos++
+		}
+		if p.pos-start > 16 {
+			return "", fmt.Errorf("integer too long at %d", start)
+		}
+		return p.input[start:p.pos], nil
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '*':
+		start := p.pos
+		for !p.eof() && isTokenChar(p.input[p.pos]) {
+			p.pos++
+		}
+		return p.input[start:p.pos], nil
+	default:
+		return "", fmt.Errorf("unexpected character at %d", p.pos)
+	}
+}
+
+func (p *sfvParser) parseString() (string, error) {
+	p.pos++ // '"'
+	var b strings.Builder
+	for !p.eof() {
+		c := p.input[p.pos]
+		p.pos++
+		switch {
+		case c == '\\':
+			if p.eof() || (p.input[p.pos] != '"' && p.input[p.pos] != '\\') {
+				return "", fmt.Errorf("invalid escape at %d", p.pos)
+			}
+			b.WriteByte(p.input[p.pos])
+			p.pos++
+		case c == '"':
+			return b.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", fmt.Errorf("invalid character in string at %d", p.pos-1)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *sfvParser) skipSpaces() {
+	for !p.eof() && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *sfvParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *sfvParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~:/", c) >= 0
+}
+
+// quoteSFVString serializes s as an sf-string
+func quoteSFVString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -1,18 +1,44 @@
 package dbsc
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"time"
 
+	"dbsc-demo/clock"
 	"dbsc-demo/logging"
 	"dbsc-demo/server/dbsc/formats"
 	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+	"dbsc-demo/server/dbsc/wellknown"
 )
 
 type DBSCServer struct {
-	DBSCSessionManager *DBSCSessionManager
-	DBSCProofVerifier  *dbsc_proof.DBSCProofVerifier
+	Config            Config
+	Store             Store
+	DBSCProofVerifier *dbsc_proof.DBSCProofVerifier
+	// UserResolver returns the user and the login session of the request (used to bind registrations)
+	UserResolver UserResolver
+	// PolicySelector chooses the lifetimes of a registering session (the store defaults when nil)
+	PolicySelector PolicySelector
+	// CookieName is the name of the cookie bound to DBSC sessions
+	CookieName string
+	// ExcludedPaths are left out of the session scope so that they work without a bound cookie
+	ExcludedPaths []string
+	// Observer receives session lifecycle events (nil disables them)
+	Observer Observer
+	Clock    clock.Clock
+
+	providerClient  *ProviderClient
+	wellKnownClient *wellknown.Client
+
+	// 同じセッションの同時リフレッシュをまとめる (concurrent_refresh.go)
+	challengeFlights  flightGroup[string]
+	refreshFlights    flightGroup[*refreshOutcome]
+	redeemedRefreshes redeemedRefreshes
 }
 
 const (
@@ -20,179 +46,450 @@ const (
 	EndpointDBSCRefresh = "/dbsc_refresh"
 )
 
-func NewDBSCServer() *DBSCServer {
-	sessionManager := NewDBSCSessionManager()
-	return &DBSCServer{
-		DBSCSessionManager: sessionManager,
-		DBSCProofVerifier:  dbsc_proof.NewDBSCProofVerifier(sessionManager),
-	}
+// NewDBSCServer creates the server used by this demo, with an in-memory store
+func NewDBSCServer(config Config) (*DBSCServer, error) {
+	return New(Options{
+		Config:        config,
+		ExcludedPaths: []string{"/login", "/debug/check_dbsc_session"},
+	})
 }
 
-func (s *DBSCServer) InitRegistrationDBSCSessionMiddleware(next http.Handler) http.Handler {
-	logging.Logger.Printf("==== Initializing DBSC session registration middleware ====")
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		type statusWriter struct {
-			http.ResponseWriter
-			status int
-		}
-
-		sw := &statusWriter{ResponseWriter: w, status: 200}
-
-		logging.Logger.Printf("Sending DBSC session registration challenge")
-		secureSessionRegistration := &formats.SecureSessionRegistrationEntry{
-			Algorithms: []string{"ES256", "RS256"},
-			Params: &formats.SecureSessionRegistrationParams{
-				Path:      EndpointDBSCStart,
-				Challenge: s.DBSCSessionManager.GenerateChallenge(),
-			},
+// StartRegistration sends the Sec-Session-Registration header for the logged-in user.
+// It is meant to be called from the login handler after the user has been authenticated.
+func (s *DBSCServer) StartRegistration(w http.ResponseWriter, r *http.Request, username string, loginSession string) error {
+	logging.Logger.DebugContext(r.Context(), "sending DBSC session registration")
+	authorization, err := s.Store.GenerateAuthorization(username, loginSession)
+	if err != nil {
+		return fmt.Errorf("failed to generate authorization: %w", err)
+	}
+	secureSessionRegistration := &formats.SecureSessionRegistrationEntry{
+		Algorithms: []string{"ES256", "RS256"},
+		Params: &formats.SecureSessionRegistrationParams{
+			Path:          EndpointDBSCStart,
+			Authorization: authorization,
+		},
+	}
+	if providerID := r.FormValue("provider_id"); providerID != "" && s.providerClient != nil {
+		s.setFederatedRegistrationParams(r, secureSessionRegistration.Params, providerID)
+	}
+	if secureSessionRegistration.Params.Challenge == "" {
+		challenge, err := s.Store.GenerateChallenge()
+		if err != nil {
+			return fmt.Errorf("failed to generate challenge: %w", err)
 		}
-		w.Header().Set("Sec-Session-Registration", secureSessionRegistration.ToSFV())
-
-		next.ServeHTTP(sw, r)
+		secureSessionRegistration.Params.Challenge = challenge
+	}
+	w.Header().Set("Sec-Session-Registration", secureSessionRegistration.ToSFV())
+	s.emit(r, Event{
+		Type:       EventChallengeIssued,
+		Phase:      PhaseRegistration,
+		User:       username,
+		ProviderID: secureSessionRegistration.Params.ProviderID,
 	})
+	return nil
 }
 
 func (s *DBSCServer) DBSCRegisterHandler(w http.ResponseWriter, r *http.Request) {
-	logging.Logger.Printf("==== DBSC Registration Handler ====")
 	secureSessionResponse := r.Header.Get("Sec-Session-Response")
 	if secureSessionResponse == "" {
-		logging.Logger.Println("Secure-Session-Response header required")
+		logging.Logger.InfoContext(r.Context(), "registration without Sec-Session-Response")
 		http.Error(w, "Secure-Session-Response header required", http.StatusBadRequest)
 		return
 	}
 
-	logging.Logger.Printf("Received DBSC registration request with proof: %s", secureSessionResponse)
+	logging.Logger.DebugContext(r.Context(), "received DBSC registration", "proof", secureSessionResponse)
+
+	if origin := r.Header.Get("Origin"); origin != "" && !s.Config.isRegisteringOrigin(origin) {
+		logging.Logger.WarnContext(r.Context(), "registration from origin not listed in registering_origins", "origin", origin)
+		s.reject(r, PhaseRegistration, "", "", ReasonOriginNotAllowed, fmt.Errorf("origin %s not allowed", origin))
+		http.Error(w, "Origin not allowed to register sessions", http.StatusForbidden)
+		return
+	}
 
 	dbscProof, err := s.DBSCProofVerifier.VerifyDBSCProof(secureSessionResponse, s.getOrigin(r)+EndpointDBSCStart)
 	if err != nil {
-		logging.Logger.Printf("Failed to verify DBSC proof: %v", err)
-		http.Error(w, fmt.Sprintf("Invalid DBSC proof: %v", err), http.StatusBadRequest)
+		logging.Logger.WarnContext(r.Context(), "failed to verify DBSC registration proof", "error", err)
+		s.reject(r, PhaseRegistration, "", "", rejectReason(err), err)
+		invalidProof(w)
 		return
 	}
 
-	logging.Logger.Printf("Successfully verified DBSC proof for registration")
+	thumbprint := keyThumbprint(dbscProof.PEM)
+	logging.AddAttrs(r.Context(), slog.String("key_thumbprint", thumbprint))
+	logging.Logger.DebugContext(r.Context(), "verified DBSC registration proof")
 
-	session := s.DBSCSessionManager.GenerateSession(dbscProof.PEM)
-	logging.Logger.Printf("Generated new session with ID: %s", session.Identifier)
+	authorization, err := s.verifyAuthorization(r, dbscProof.Authorization)
+	if err != nil {
+		logging.Logger.WarnContext(r.Context(), "failed to verify DBSC authorization", "error", err)
+		s.reject(r, PhaseRegistration, "", thumbprint, ReasonInvalidAuthorization, err)
+		invalidProof(w)
+		return
+	}
 
-	cookie := s.DBSCSessionManager.GenerateCookie()
+	challenge, ok := s.Store.ConsumeChallenge(dbscProof.JTI)
+	if !ok || challenge.SessionIdentifier != "" {
+		logging.Logger.WarnContext(r.Context(), "registration challenge already used or not a registration challenge")
+		s.reject(r, PhaseRegistration, "", thumbprint, ReasonChallengeReused, fmt.Errorf("challenge already used"))
+		invalidProof(w)
+		return
+	}
 
+	var providerID string
+	if challenge.ProviderID != "" {
+		if s.providerClient == nil {
+			s.reject(r, PhaseRegistration, "", thumbprint, ReasonFederation, fmt.Errorf("federation is not enabled"))
+			invalidProof(w)
+			return
+		}
+		if err := s.validateFederatedSession(r.Context(), challenge, dbscProof.PEM); err != nil {
+			logging.Logger.WarnContext(r.Context(), "failed to validate federated session", "error", err)
+			s.reject(r, PhaseRegistration, "", thumbprint, ReasonFederation, err)
+			invalidProof(w)
+			return
+		}
+		providerID = challenge.ProviderID
+		logging.Logger.DebugContext(r.Context(), "validated federated session", "provider_id_hash", logging.Hash(providerID))
+	}
+
+	var policy SessionPolicy
+	if s.PolicySelector != nil {
+		policy = s.PolicySelector(r, authorization.User)
+	}
+	session, err := s.Store.GenerateSession(dbscProof.PEM, authorization.User, authorization.LoginSession, providerID, policy)
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to generate session", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	logging.AddAttrs(r.Context(), logging.SessionID(session.Identifier))
+
+	cookie, err := s.Store.GenerateCookie(session.Identifier)
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to generate cookie", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	domain := s.Config.originHost()
+	scopeSpecification := []formats.SessionInstructionScopeSpecification{}
+	for _, path := range s.ExcludedPaths {
+		scopeSpecification = append(scopeSpecification, formats.SessionInstructionScopeSpecification{
+			Type:   "exclude",
+			Domain: domain,
+			Path:   path,
+		})
+	}
 	response := formats.SessionInstructionResponse{
 		Continue:          true,
 		SessionIdentifier: session.Identifier,
 		RefreshURL:        EndpointDBSCRefresh,
 		Scope: formats.SessionInstructionScope{
-			Origin:      "http://localhost:8080",
-			IncludeSite: true,
-			ScopeSpecification: []formats.SessionInstructionScopeSpecification{
-				{
-					Type:   "exclude",
-					Domain: "localhost",
-					Path:   "/login",
-				},
-				{
-					Type:   "exclude",
-					Domain: "localhost",
-					Path:   "/debug/check_dbsc_session",
-				},
-			},
+			Origin:             s.Config.Origin,
+			IncludeSite:        true,
+			ScopeSpecification: scopeSpecification,
 		},
 		Credentials: []formats.SessionInstructionCredential{
 			{
 				Type:       "cookie",
-				Name:       "dbsc_cookie",
+				Name:       s.CookieName,
 				Attributes: "SameSite=Lax",
 			},
 		},
+		AllowedRefreshInitiators: s.Config.AllowedRefreshInitiators,
 	}
 
 	cookieHeader := http.Cookie{
-		Name:     "dbsc_cookie",
+		Name:     s.CookieName,
 		Value:    cookie.Value,
 		SameSite: http.SameSiteLaxMode,
 		Expires:  cookie.ExpiresAt,
 	}
 	http.SetCookie(w, &cookieHeader)
 
-	logging.Logger.Printf("Sending session instruction response: %s", cookieHeader.String())
+	logging.Logger.InfoContext(r.Context(), "registered DBSC session", "user", session.User, "policy", session.Policy.Name, "set_cookie", cookieHeader.String())
+	s.emit(r, Event{
+		Type:              EventRegistered,
+		Phase:             PhaseRegistration,
+		SessionIdentifier: session.Identifier,
+		User:              session.User,
+		ProviderID:        session.ProviderID,
+		KeyThumbprint:     thumbprint,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// VerifyDBSCSessionMiddleware rejects requests without a valid bound cookie.
+// The session is available to next through SessionFromContext.
 func (s *DBSCServer) VerifyDBSCSessionMiddleware(next http.Handler) http.Handler {
-	logging.Logger.Printf("==== Verifying DBSC session ====")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("dbsc_cookie")
+		cookie, err := r.Cookie(s.CookieName)
 		if err != nil || cookie == nil {
 			http.Error(w, "DBSC session cookie not found", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		session, ok := s.Store.GetSessionByCookie(cookie.Value)
+		if !ok {
+			// 無効になった Cookie を削除し、ブラウザに次のリクエストでリフレッシュさせる
+			http.SetCookie(w, &http.Cookie{Name: s.CookieName, Path: "/", MaxAge: -1, SameSite: http.SameSiteLaxMode})
+			http.Error(w, "Invalid DBSC session cookie", http.StatusUnauthorized)
+			return
+		}
+
+		// 期限が近い Cookie には次のリフレッシュのチャレンジを先に渡し、期限切れを待たずにリフレッシュさせる
+		if before := session.Policy.RefreshBefore; before > 0 {
+			if bound, ok := s.Store.GetCookie(cookie.Value); ok && !s.Clock.Now().Before(bound.ExpiresAt.Add(-before)) {
+				s.issueRefreshChallenge(w, r, session.Identifier, "")
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
 	})
 }
 
+// DBSCRefreshHandler serves the refresh endpoint. With Config.RefreshLatencyFloor set, every
+// response is delayed to that floor (see PadLatency).
 func (s *DBSCServer) DBSCRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Config.RefreshLatencyFloor > 0 {
+		PadLatency(s.Config.RefreshLatencyFloor, http.HandlerFunc(s.refresh)).ServeHTTP(w, r)
+		return
+	}
+	s.refresh(w, r)
+}
+
+func (s *DBSCServer) refresh(w http.ResponseWriter, r *http.Request) {
+	start := s.Clock.Now()
 	secureSessionId := r.Header.Get("Sec-Session-Id")
 	secureSessionResponse := r.Header.Get("Sec-Session-Response")
+
+	logging.AddAttrs(r.Context(), logging.SessionID(secureSessionId))
+	initiator := refreshInitiator(r)
+	if initiator != "" {
+		logging.Logger.InfoContext(r.Context(), "DBSC refresh initiated by another site", "initiator", initiator)
+	}
+	if s.Config.EnforceRefreshInitiators && !s.Config.isAllowedRefreshInitiator(initiator) {
+		logging.Logger.WarnContext(r.Context(), "refresh initiator not allowed", "initiator", initiator)
+		s.reject(r, PhaseRefresh, secureSessionId, "", ReasonInitiatorNotAllowed, fmt.Errorf("initiator %s not allowed", initiator))
+		http.Error(w, "Refresh initiator not allowed", http.StatusUnauthorized)
+		return
+	}
 	if secureSessionResponse == "" {
 		// If no Sec-Session-Response header, issue a new challenge
-		s.dbscRefreshChallengeHandler(w, r, secureSessionId)
+		s.dbscRefreshChallengeHandler(w, r, secureSessionId, initiator)
 		return
 	}
 
 	// If Sec-Session-Response header is present, verify and refresh the session
-	s.dbscRefreshHandler(w, r, secureSessionResponse, secureSessionId)
+	s.dbscRefreshHandler(w, r, secureSessionResponse, secureSessionId, initiator, start)
 }
 
-func (s *DBSCServer) dbscRefreshChallengeHandler(w http.ResponseWriter, r *http.Request, sessionID string) {
-	logging.Logger.Printf("==== DBSC Refresh(Challenge) Handler ====")
-
-	if !s.DBSCSessionManager.IsExistSession(sessionID) {
-		logging.Logger.Printf("DBSC session not found or expired")
+func (s *DBSCServer) dbscRefreshChallengeHandler(w http.ResponseWriter, r *http.Request, sessionID, initiator string) {
+
+	if !s.Store.IsExistSession(sessionID) {
+		// 存在した期限切れのセッションだけを終了として報告する (一度だけ)
+		if s.Store.EndExpiredSession(sessionID) {
+			logging.Logger.InfoContext(r.Context(), "DBSC session expired")
+			s.emit(r, Event{
+				Type:              EventTerminated,
+				Phase:             PhaseRefresh,
+				SessionIdentifier: sessionID,
+				TerminateReason:   TerminateExpired,
+			})
+		} else {
+			logging.Logger.InfoContext(r.Context(), "DBSC session not found")
+			s.reject(r, PhaseRefresh, sessionID, "", ReasonUnknownSession, errors.New("unknown session"))
+		}
 		http.Error(w, "DBSC session not found or expired", http.StatusUnauthorized)
 		return
 	}
 
-	challenge := s.DBSCSessionManager.GenerateChallenge()
+	if !s.issueRefreshChallenge(w, r, sessionID, initiator) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// issueRefreshChallenge sets the Sec-Session-Challenge header for the session and reports
+// whether a challenge was available
+func (s *DBSCServer) issueRefreshChallenge(w http.ResponseWriter, r *http.Request, sessionID, initiator string) bool {
+	// 続けて届いたチャレンジ要求 (複数のタブなど) には、猶予期間内に発行した未使用のチャレンジを返す。
+	// ストアでの再利用に加えて、同時に届いた要求はこのプロセス内で 1 回の発行にまとめる
+	var reused bool
+	challenge, err, shared := s.challengeFlights.do(sessionID, func() (string, error) {
+		value, wasReused, err := s.Store.GenerateRefreshChallenge(sessionID, s.Config.RefreshGracePeriod)
+		reused = wasReused
+		return value, err
+	})
+	shared = shared || reused
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to generate refresh challenge", "error", err)
+		return false
+	}
 	secureSessionChallengeHeader := formats.NewSecureSessionChallengeHeader(challenge, sessionID)
 	w.Header().Set("Sec-Session-Challenge", secureSessionChallengeHeader.ToSFV())
 
-	logging.Logger.Printf("Issuing DBSC session challenge: %s", w.Header().Values("Sec-Session-Challenge")[0])
-	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	logging.Logger.DebugContext(r.Context(), "issued DBSC refresh challenge", "challenge", challenge, "shared", shared)
+	if !shared {
+		s.emit(r, Event{
+			Type:              EventChallengeIssued,
+			Phase:             PhaseRefresh,
+			SessionIdentifier: sessionID,
+			Initiator:         initiator,
+		})
+	}
+	return true
 }
 
-func (s *DBSCServer) dbscRefreshHandler(w http.ResponseWriter, r *http.Request, sessionResponse, sessionID string) {
-	logging.Logger.Printf("==== DBSC Refresh Handler ====")
-	_, err := s.DBSCProofVerifier.VerifyRefreshProof(sessionResponse, s.getOrigin(r)+EndpointDBSCRefresh, sessionID)
+func (s *DBSCServer) dbscRefreshHandler(w http.ResponseWriter, r *http.Request, sessionResponse, sessionID, initiator string, start time.Time) {
+	dbscProof, err := s.DBSCProofVerifier.VerifyRefreshProof(sessionResponse, s.getOrigin(r)+EndpointDBSCRefresh, sessionID)
 	if err != nil {
-		logging.Logger.Printf("Failed to verify DBSC refresh proof: %v", err)
-		http.Error(w, fmt.Sprintf("Invalid DBSC proof: %v", err), http.StatusBadRequest)
+		logging.Logger.WarnContext(r.Context(), "failed to verify DBSC refresh proof", "error", err)
+		s.reject(r, PhaseRefresh, sessionID, "", rejectReason(err), err)
+		invalidProof(w)
 		return
 	}
-
-	cookie := s.DBSCSessionManager.GenerateCookie()
+	thumbprint := keyThumbprint(dbscProof.PEM)
+	logging.AddAttrs(r.Context(), slog.String("key_thumbprint", thumbprint))
+
+	outcome, redeemed, err := s.redeemRefresh(sessionID, dbscProof.JTI, sessionResponse)
+	if errors.Is(err, errChallengeReused) {
+		logging.Logger.WarnContext(r.Context(), "refresh challenge already used or issued for another session")
+		s.reject(r, PhaseRefresh, sessionID, thumbprint, ReasonChallengeReused, err)
+		invalidProof(w)
+		return
+	}
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to generate cookie", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cookie := outcome.cookie
 
 	cookieHeader := http.Cookie{
-		Name:     "dbsc_cookie",
+		Name:     s.CookieName,
 		Value:    cookie.Value,
 		SameSite: http.SameSiteLaxMode,
 		Expires:  cookie.ExpiresAt,
 	}
 	http.SetCookie(w, &cookieHeader)
-	logging.Logger.Printf("successfully refreshed DBSC session: %s", cookieHeader.String())
+	if !redeemed {
+		logging.Logger.InfoContext(r.Context(), "shared the cookie of a concurrent DBSC refresh", "set_cookie", cookieHeader.String())
+		return
+	}
+	s.Store.RecordRefresh(sessionID)
+	// 証明を検証したリフレッシュだけを記録し、同一オリジンからのリフレッシュでは消す
+	s.Store.RecordRefreshInitiator(sessionID, initiator)
+	logging.Logger.InfoContext(r.Context(), "refreshed DBSC session", "set_cookie", cookieHeader.String())
+
+	event := Event{
+		Type:              EventRefreshed,
+		Phase:             PhaseRefresh,
+		SessionIdentifier: sessionID,
+		Initiator:         initiator,
+		KeyThumbprint:     thumbprint,
+		Duration:          s.Clock.Now().Sub(start),
+	}
+	if session, ok := s.Store.GetSession(sessionID); ok {
+		event.User = session.User
+		event.ProviderID = session.ProviderID
+	}
+	s.emit(r, event)
 }
 
-func (s *DBSCServer) getOrigin(r *http.Request) string {
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
+// invalidProof answers every rejected proof the same way so that the response does not tell
+// which check failed. The reason is logged and reported by reject.
+func invalidProof(w http.ResponseWriter) {
+	http.Error(w, "Invalid DBSC proof", http.StatusBadRequest)
+}
+
+// reject reports a rejected registration or refresh to the observer.
+// thumbprint identifies the key of the proof; when the proof could not be verified
+// the key bound to sessionID is reported instead.
+func (s *DBSCServer) reject(r *http.Request, phase Phase, sessionID, thumbprint string, reason RejectReason, err error) {
+	event := Event{
+		Type:              EventProofRejected,
+		Phase:             phase,
+		SessionIdentifier: sessionID,
+		KeyThumbprint:     thumbprint,
+		RejectReason:      reason,
+		Err:               err,
+	}
+	if sessionID != "" {
+		if session, ok := s.Store.GetSession(sessionID); ok {
+			event.User = session.User
+			if event.KeyThumbprint == "" {
+				event.KeyThumbprint = session.KeyThumbprint
+			}
 		}
-		origin = fmt.Sprintf("%s://%s", scheme, r.Host)
 	}
-	return origin
+	s.emit(r, event)
+}
+
+// verifyAuthorization checks that the proof's authorization claim was issued to the current user
+func (s *DBSCServer) verifyAuthorization(r *http.Request, code string) (*DBSCAuthorization, error) {
+	if code == "" {
+		return nil, fmt.Errorf("missing authorization claim")
+	}
+	authorization, ok := s.Store.ConsumeAuthorization(code)
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired authorization code")
+	}
+	if s.UserResolver == nil {
+		return nil, fmt.Errorf("no user resolver configured")
+	}
+	user, loginSession, ok := s.UserResolver(r)
+	if !ok || user != authorization.User || !equalSecret(loginSession, authorization.LoginSession) {
+		return nil, fmt.Errorf("authorization code was issued to a different login")
+	}
+	return authorization, nil
+}
+
+// setFederatedRegistrationParams (RP) binds the registration challenge to the provider session
+func (s *DBSCServer) setFederatedRegistrationParams(r *http.Request, params *formats.SecureSessionRegistrationParams, providerID string) {
+	if err := s.providerClient.CheckRelyingOrigin(r.Context(), s.Config.Origin); err != nil {
+		logging.Logger.WarnContext(r.Context(), "falling back to non-federated registration", "error", err)
+		return
+	}
+	providerKey, err := s.providerClient.FetchSessionKey(r.Context(), s.Config.Origin, providerID)
+	if err != nil {
+		logging.Logger.WarnContext(r.Context(), "falling back to non-federated registration", "error", err)
+		return
+	}
+	thumbprint, err := dbsc_proof.PEMThumbprint(providerKey.PublicKeyPEM)
+	if err != nil {
+		logging.Logger.WarnContext(r.Context(), "falling back to non-federated registration", "error", err)
+		return
+	}
+
+	challenge, err := s.Store.GenerateFederatedChallenge(providerID, providerKey.PublicKeyPEM)
+	if err != nil {
+		logging.Logger.WarnContext(r.Context(), "falling back to non-federated registration", "error", err)
+		return
+	}
+	params.Challenge = challenge
+	params.ProviderKey = thumbprint
+	params.ProviderID = providerID
+	params.ProviderURL = s.Config.ProviderURL
+	logging.Logger.DebugContext(r.Context(), "requesting federated registration", "provider_id_hash", logging.Hash(providerID))
+}
+
+// keyThumbprint identifies a session key in logs and events
+func keyThumbprint(pem string) string {
+	thumbprint, err := dbsc_proof.PEMThumbprint(pem)
+	if err != nil {
+		return ""
+	}
+	return thumbprint
+}
+
+func (s *DBSCServer) getOrigin(r *http.Request) string {
+	// Origin ヘッダーはリフレッシュを開始したサイトを示すことがあるので、証明の aud には使わない
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
 }
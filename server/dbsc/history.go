@@ -0,0 +1,87 @@
+package dbsc
+
+import (
+	"slices"
+	"sync"
+)
+
+// History is an Observer keeping the latest events of each session for operators.
+// Only sessions whose registration it observed are tracked, so that refresh attempts for
+// made-up session identifiers cannot fill it. It keeps at most MaxEvents per session and
+// MaxSessions sessions, forgetting the sessions that have been inactive the longest.
+// The latest MaxFailures rejected proofs are kept separately, including those of registrations.
+type History struct {
+	MaxEvents   int
+	MaxSessions int
+	MaxFailures int
+
+	mu       sync.Mutex
+	sessions map[string][]Event
+	failures []Event
+}
+
+// NewHistory returns a History keeping 50 events for up to 10000 sessions and 100 failures
+func NewHistory() *History {
+	return &History{
+		MaxEvents:   50,
+		MaxSessions: 10000,
+		MaxFailures: 100,
+		sessions:    make(map[string][]Event),
+	}
+}
+
+func (h *History) OnEvent(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.Type == EventProofRejected {
+		h.failures = append(h.failures, event)
+		if len(h.failures) > h.MaxFailures {
+			h.failures = slices.Delete(h.failures, 0, len(h.failures)-h.MaxFailures)
+		}
+	}
+	if event.SessionIdentifier == "" {
+		return
+	}
+
+	events, exists := h.sessions[event.SessionIdentifier]
+	if !exists {
+		if event.Type != EventRegistered {
+			return
+		}
+		if len(h.sessions) >= h.MaxSessions {
+			h.evictOldest()
+		}
+	}
+	events = append(events, event)
+	if len(events) > h.MaxEvents {
+		events = slices.Delete(events, 0, len(events)-h.MaxEvents)
+	}
+	h.sessions[event.SessionIdentifier] = events
+}
+
+// Events returns the recorded events of a session, oldest first
+func (h *History) Events(sessionIdentifier string) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.sessions[sessionIdentifier])
+}
+
+// Failures returns the latest rejected proofs, newest first
+func (h *History) Failures() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failures := slices.Clone(h.failures)
+	slices.Reverse(failures)
+	return failures
+}
+
+// evictOldest forgets the session whose latest event is the oldest. h.mu must be held.
+func (h *History) evictOldest() {
+	var oldest string
+	for identifier, events := range h.sessions {
+		if oldest == "" || events[len(events)-1].Time.Before(h.sessions[oldest][len(h.sessions[oldest])-1].Time) {
+			oldest = identifier
+		}
+	}
+	delete(h.sessions, oldest)
+}
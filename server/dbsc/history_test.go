@@ -0,0 +1,49 @@
+package dbsc_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"dbsc-demo/server/dbsc"
+)
+
+func TestHistory(t *testing.T) {
+	history := dbsc.NewHistory()
+	history.MaxEvents = 3
+	history.MaxSessions = 2
+	history.MaxFailures = 2
+	start := time.Unix(0, 0)
+	event := func(eventType dbsc.EventType, session string, minute int) {
+		history.OnEvent(dbsc.Event{Type: eventType, SessionIdentifier: session, Time: start.Add(time.Duration(minute) * time.Minute)})
+	}
+
+	// 登録を観測していないセッションは記録しない
+	event(dbsc.EventTerminated, "made-up", 0)
+	if events := history.Events("made-up"); len(events) != 0 {
+		t.Errorf("untracked session recorded: %v", events)
+	}
+
+	event(dbsc.EventRegistered, "a", 1)
+	for i := 0; i < 5; i++ {
+		event(dbsc.EventRefreshed, "a", 2+i)
+	}
+	if events := history.Events("a"); len(events) != 3 || events[2].Time != start.Add(6*time.Minute) {
+		t.Errorf("events of a = %v, want the latest 3", events)
+	}
+
+	// 最も長く更新のないセッションから忘れる
+	event(dbsc.EventRegistered, "b", 10)
+	event(dbsc.EventRegistered, "c", 11)
+	if len(history.Events("a")) != 0 || len(history.Events("b")) != 1 || len(history.Events("c")) != 1 {
+		t.Error("the least recently active session was not evicted")
+	}
+
+	for i := 0; i < 3; i++ {
+		event(dbsc.EventProofRejected, fmt.Sprint("failure-", i), 20+i)
+	}
+	failures := history.Failures()
+	if len(failures) != 2 || failures[0].SessionIdentifier != "failure-2" || failures[1].SessionIdentifier != "failure-1" {
+		t.Errorf("failures = %v, want the latest 2, newest first", failures)
+	}
+}
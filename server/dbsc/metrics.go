@@ -0,0 +1,55 @@
+package dbsc
+
+import "dbsc-demo/metrics"
+
+// Metrics is an Observer counting lifecycle events into a metrics registry
+type Metrics struct {
+	Registrations   *metrics.Counter
+	Refreshes       *metrics.Counter
+	Challenges      *metrics.CounterVec
+	Rejections      *metrics.CounterVec
+	Terminations    *metrics.CounterVec
+	RefreshDuration *metrics.Histogram
+}
+
+// NewMetrics registers the DBSC metrics. When store implements StatsReporter,
+// gauges of its live sessions, challenges and cookies are registered as well.
+func NewMetrics(registry *metrics.Registry, store Store) *Metrics {
+	m := &Metrics{
+		Registrations:   registry.NewCounter("dbsc_registrations_total", "DBSC sessions registered."),
+		Refreshes:       registry.NewCounter("dbsc_refreshes_total", "DBSC sessions refreshed."),
+		Challenges:      registry.NewCounterVec("dbsc_challenges_issued_total", "Challenges issued.", "phase"),
+		Rejections:      registry.NewCounterVec("dbsc_proof_rejections_total", "Registrations and refreshes rejected.", "phase", "reason"),
+		Terminations:    registry.NewCounterVec("dbsc_sessions_terminated_total", "DBSC sessions terminated.", "reason"),
+		RefreshDuration: registry.NewHistogram("dbsc_refresh_duration_seconds", "Time to verify a refresh proof and issue the cookie.", metrics.DefaultBuckets),
+	}
+
+	if reporter, ok := store.(StatsReporter); ok {
+		registry.NewGaugeFunc("dbsc_live_sessions", "Unexpired DBSC sessions.", func() float64 {
+			return float64(reporter.Stats().Sessions)
+		})
+		registry.NewGaugeFunc("dbsc_live_challenges", "Unexpired challenges.", func() float64 {
+			return float64(reporter.Stats().Challenges)
+		})
+		registry.NewGaugeFunc("dbsc_live_cookies", "Unexpired bound cookies.", func() float64 {
+			return float64(reporter.Stats().Cookies)
+		})
+	}
+	return m
+}
+
+func (m *Metrics) OnEvent(event Event) {
+	switch event.Type {
+	case EventRegistered:
+		m.Registrations.Inc()
+	case EventRefreshed:
+		m.Refreshes.Inc()
+		m.RefreshDuration.Observe(event.Duration.Seconds())
+	case EventChallengeIssued:
+		m.Challenges.Inc(string(event.Phase))
+	case EventProofRejected:
+		m.Rejections.Inc(string(event.Phase), string(event.RejectReason))
+	case EventTerminated:
+		m.Terminations.Inc(string(event.TerminateReason))
+	}
+}
@@ -0,0 +1,132 @@
+// Package dbsc adds Device Bound Session Credentials to a net/http application.
+//
+// New returns a DBSCServer providing the registration and refresh endpoint handlers,
+// a middleware offering registration to logged-in users and a middleware protecting
+// handlers with the bound cookie:
+//
+//	server, err := dbsc.New(dbsc.Options{
+//		Config:       dbsc.Config{Origin: "https://app.example"},
+//		UserResolver: currentUser,
+//	})
+//	mux.HandleFunc("POST "+dbsc.EndpointDBSCStart, server.DBSCRegisterHandler)
+//	mux.HandleFunc("POST "+dbsc.EndpointDBSCRefresh, server.DBSCRefreshHandler)
+//	mux.Handle("/app/", server.RegistrationMiddleware(app))
+//	mux.Handle("/api/", server.VerifyDBSCSessionMiddleware(api))
+//
+// Applications that control their login handler can call StartRegistration right after
+// authenticating the user instead of using RegistrationMiddleware.
+package dbsc
+
+import (
+	"context"
+	"net/http"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/logging"
+	"dbsc-demo/server/dbsc/formats/dbsc_proof"
+	"dbsc-demo/server/dbsc/wellknown"
+)
+
+// DefaultCookieName is the bound cookie name used when Options.CookieName is empty
+const DefaultCookieName = "dbsc_cookie"
+
+// UserResolver returns the logged-in user of the request and an identifier of the login session.
+// The login session ties a registration to the login it was offered to.
+type UserResolver func(r *http.Request) (user string, loginSession string, ok bool)
+
+// Options configures New
+type Options struct {
+	Config Config
+	// UserResolver identifies the logged-in user. Registrations fail without it.
+	UserResolver UserResolver
+	// PolicySelector chooses the session policy at registration (the store defaults when nil)
+	PolicySelector PolicySelector
+	// CookieName is the cookie bound to the session (DefaultCookieName when empty)
+	CookieName string
+	// ExcludedPaths are left out of the session scope, typically the login page
+	ExcludedPaths []string
+	// Store keeps the DBSC state (an in-memory DBSCSessionManager when nil)
+	Store Store
+	// Observer receives session lifecycle events, see NewAsyncDispatcher for slow observers
+	Observer Observer
+	// Clock stamps the events (the system clock when nil)
+	Clock clock.Clock
+}
+
+// New validates the options and creates a DBSCServer
+func New(options Options) (*DBSCServer, error) {
+	if err := options.Config.Validate(); err != nil {
+		return nil, err
+	}
+	if options.Store == nil {
+		options.Store = NewDBSCSessionManager()
+	}
+	if options.CookieName == "" {
+		options.CookieName = DefaultCookieName
+	}
+	if options.Clock == nil {
+		options.Clock = clock.System
+	}
+
+	server := &DBSCServer{
+		Config:          options.Config,
+		Store:           options.Store,
+		UserResolver:    options.UserResolver,
+		PolicySelector:  options.PolicySelector,
+		CookieName:      options.CookieName,
+		ExcludedPaths:   options.ExcludedPaths,
+		Observer:        options.Observer,
+		Clock:           options.Clock,
+		wellKnownClient: wellknown.NewClient(),
+	}
+	server.DBSCProofVerifier = dbsc_proof.NewDBSCProofVerifier(proofSessions{server: server})
+	if options.Config.ProofClockSkew > 0 {
+		server.DBSCProofVerifier.MaxClockSkew = options.Config.ProofClockSkew
+	}
+	if options.Config.FederationRole == FederationRelyingParty {
+		server.providerClient = NewProviderClient(options.Config.ProviderURL, server.wellKnownClient)
+	}
+	return server, nil
+}
+
+// RegistrationMiddleware sends Sec-Session-Registration on responses to logged-in users
+// whose login session has neither a bound session nor a pending registration.
+func (s *DBSCServer) RegistrationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.UserResolver != nil {
+			if user, loginSession, ok := s.UserResolver(r); ok && !s.Store.IsRegistered(loginSession) {
+				if err := s.StartRegistration(w, r, user, loginSession); err != nil {
+					logging.Logger.ErrorContext(r.Context(), "failed to start DBSC registration", "error", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type sessionContextKey struct{}
+
+// SessionFromContext returns the session verified by VerifyDBSCSessionMiddleware
+func SessionFromContext(ctx context.Context) (*DBSCSession, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(*DBSCSession)
+	return session, ok
+}
+
+// CurrentSession returns the session and the cookie of the request's valid bound cookie
+func (s *DBSCServer) CurrentSession(r *http.Request) (*DBSCSession, *DBSCCookie, bool) {
+	value, err := r.Cookie(s.CookieName)
+	if err != nil {
+		return nil, nil, false
+	}
+	cookie, ok := s.Store.GetCookie(value.Value)
+	if !ok {
+		return nil, nil, false
+	}
+	session, ok := s.Store.GetSession(cookie.SessionIdentifier)
+	if !ok {
+		return nil, nil, false
+	}
+	return session, cookie, true
+}
@@ -0,0 +1,114 @@
+package dbsc_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dbsc-demo/dbscclient"
+	"dbsc-demo/server/dbsc"
+)
+
+// newApp wires the package into a plain net/http app whose login is a "user" cookie
+func newApp(t *testing.T, observer dbsc.Observer) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(nil)
+
+	dbscServer, err := dbsc.New(dbsc.Options{
+		Config: dbsc.Config{Origin: "http://" + server.Listener.Addr().String()},
+		UserResolver: func(r *http.Request) (string, string, bool) {
+			cookie, err := r.Cookie("user")
+			if err != nil {
+				return "", "", false
+			}
+			return cookie.Value, "login-" + cookie.Value, true
+		},
+		CookieName:    "bound",
+		ExcludedPaths: []string{"/login"},
+		Observer:      observer,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "user", Value: r.URL.Query().Get("user")})
+	})
+	mux.HandleFunc("POST "+dbsc.EndpointDBSCStart, dbscServer.DBSCRegisterHandler)
+	mux.HandleFunc("POST "+dbsc.EndpointDBSCRefresh, dbscServer.DBSCRefreshHandler)
+	mux.Handle("/app", dbscServer.RegistrationMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	mux.Handle("/api", dbscServer.VerifyDBSCSessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := dbsc.SessionFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no session in context", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, session.User)
+	})))
+
+	server.Config.Handler = mux
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, client *dbscclient.Client, rawURL string) (*http.Response, string) {
+	t.Helper()
+	res, err := client.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestMiddlewareWithServeMux(t *testing.T) {
+	server := newApp(t, nil)
+	client, err := dbscclient.New(dbscclient.AlgorithmES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.OnRegistrationError = func(err error) {
+		t.Errorf("registration failed: %v", err)
+	}
+
+	// ログイン前は登録を提示しない
+	if res, _ := get(t, client, server.URL+"/app"); res.Header.Get("Sec-Session-Registration") != "" {
+		t.Fatal("registration offered before login")
+	}
+
+	get(t, client, server.URL+"/login?user=alice")
+	res, _ := get(t, client, server.URL+"/app")
+	if res.Header.Get("Sec-Session-Registration") == "" {
+		t.Fatal("registration not offered to the logged-in user")
+	}
+	sessions := client.Sessions()
+	if len(sessions) != 1 || sessions[0].Instruction.Credentials[0].Name != "bound" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	// 登録済みのログインセッションには再度提示しない
+	if res, _ := get(t, client, server.URL+"/app"); res.Header.Get("Sec-Session-Registration") != "" {
+		t.Error("registration offered again after the session was bound")
+	}
+
+	res, body := get(t, client, server.URL+"/api")
+	if res.StatusCode != http.StatusOK || body != "alice" {
+		t.Errorf("protected response = %d %q, want 200 \"alice\"", res.StatusCode, body)
+	}
+}
+
+func TestProtectionRequiresBoundCookie(t *testing.T) {
+	server := newApp(t, nil)
+	res, err := http.Get(server.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", res.StatusCode)
+	}
+}
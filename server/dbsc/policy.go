@@ -0,0 +1,252 @@
+package dbsc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+)
+
+// SessionPolicy sets the lifetimes of a session. It is chosen at registration by the
+// PolicySelector and kept with the session, so that sessions of high-risk users can be bound
+// more often than others without changing the store defaults.
+type SessionPolicy struct {
+	// Name identifies the policy in logs and the admin API
+	Name string
+	// CookieLifetime is the lifetime of each bound cookie, i.e. how often the browser has to
+	// prove possession of the key (the store default when 0)
+	CookieLifetime time.Duration
+	// SessionLifetime is the lifetime of the session (the store default when 0).
+	// With Sliding it is counted from the last successful refresh instead of the registration.
+	SessionLifetime time.Duration
+	Sliding         bool
+	// MaxLifetime caps a sliding session, counted from the registration (unlimited when 0)
+	MaxLifetime time.Duration
+	// RefreshBefore is how long before a bound cookie expires the responses start to carry
+	// the next refresh challenge, so that the browser refreshes proactively instead of
+	// waiting for the cookie to expire (disabled when 0)
+	RefreshBefore time.Duration
+}
+
+// Validate rejects negative lifetimes and inconsistent settings
+func (p SessionPolicy) Validate() error {
+	if p.CookieLifetime < 0 || p.SessionLifetime < 0 || p.MaxLifetime < 0 || p.RefreshBefore < 0 {
+		return fmt.Errorf("session policy %q: lifetimes must not be negative", p.Name)
+	}
+	if p.CookieLifetime > 0 && p.RefreshBefore >= p.CookieLifetime {
+		return fmt.Errorf("session policy %q: refresh before must be shorter than the cookie lifetime", p.Name)
+	}
+	if p.MaxLifetime > 0 && !p.Sliding {
+		return fmt.Errorf("session policy %q: max lifetime requires a sliding session", p.Name)
+	}
+	return nil
+}
+
+// expiresAt returns the expiry of a session created at createdAt and last refreshed at now
+func (p SessionPolicy) expiresAt(createdAt, now time.Time) time.Time {
+	if !p.Sliding {
+		return createdAt.Add(p.SessionLifetime)
+	}
+	expiresAt := now.Add(p.SessionLifetime)
+	if p.MaxLifetime > 0 && expiresAt.After(createdAt.Add(p.MaxLifetime)) {
+		expiresAt = createdAt.Add(p.MaxLifetime)
+	}
+	return expiresAt
+}
+
+// PolicySelector chooses the policy of a session registered by user, for example by the
+// user's group or the risk level of the request
+type PolicySelector func(r *http.Request, user string) SessionPolicy
+
+// NetworkPolicy assigns a policy to the requests from a network
+type NetworkPolicy struct {
+	Prefix netip.Prefix
+	Policy string
+}
+
+// SessionPolicies is a PolicySelector assigning named policies to users, groups and the
+// networks the registrations come from
+type SessionPolicies struct {
+	Default  SessionPolicy
+	Policies map[string]SessionPolicy
+	// Users maps user names to policy names
+	Users map[string]string
+	// Groups maps group names to policy names, for users without a policy of their own
+	Groups map[string]string
+	// UserGroups returns the groups of a user in order of precedence
+	// (the "members" of the file when loaded by LoadSessionPolicies)
+	UserGroups func(user string) []string
+	// Networks assigns policies to the remote addresses of registrations, for users and groups
+	// without a policy. The first network containing the address is used.
+	Networks []NetworkPolicy
+}
+
+// Select returns the policy of user, then of the first of the user's groups with a policy,
+// then of the first network containing the remote address of r, or Default
+func (p *SessionPolicies) Select(r *http.Request, user string) SessionPolicy {
+	if name, ok := p.Users[user]; ok {
+		return p.policy(name)
+	}
+	if p.UserGroups != nil {
+		for _, group := range p.UserGroups(user) {
+			if name, ok := p.Groups[group]; ok {
+				return p.policy(name)
+			}
+		}
+	}
+	if r != nil {
+		if addr, ok := remoteAddr(r); ok {
+			for _, network := range p.Networks {
+				if network.Prefix.Contains(addr) {
+					return p.policy(network.Policy)
+				}
+			}
+		}
+	}
+	return p.Default
+}
+
+// policy returns the named policy, or Default for a name without a policy such as "default"
+func (p *SessionPolicies) policy(name string) SessionPolicy {
+	if policy, ok := p.Policies[name]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// remoteAddr returns the address the request came from
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// policyFile is the JSON form of a SessionPolicy, with durations such as "5s"
+type policyFile struct {
+	CookieLifetime  string `json:"cookie_lifetime,omitempty"`
+	SessionLifetime string `json:"session_lifetime,omitempty"`
+	Sliding         bool   `json:"sliding,omitempty"`
+	MaxLifetime     string `json:"max_lifetime,omitempty"`
+	RefreshBefore   string `json:"refresh_before,omitempty"`
+}
+
+// LoadSessionPolicies reads policies from a JSON file:
+//
+//	{
+//	  "default": {"cookie_lifetime": "5m", "session_lifetime": "8h"},
+//	  "policies": {"high-risk": {"cookie_lifetime": "30s", "session_lifetime": "15m", "sliding": true, "max_lifetime": "2h", "refresh_before": "10s"}},
+//	  "users": {"admin": "high-risk"},
+//	  "groups": {"operators": "high-risk"},
+//	  "members": {"operators": ["alice", "bob"]},
+//	  "networks": {"0.0.0.0/0": "high-risk", "10.0.0.0/8": "default"}
+//	}
+//
+// A user in several groups gets the policy of the first group by name, and an address in
+// several networks the policy of the most specific network. Networks may refer to "default".
+func LoadSessionPolicies(path string) (*SessionPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Default  policyFile            `json:"default"`
+		Policies map[string]policyFile `json:"policies"`
+		Users    map[string]string     `json:"users"`
+		Groups   map[string]string     `json:"groups"`
+		Members  map[string][]string   `json:"members"`
+		Networks map[string]string     `json:"networks"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	policies := &SessionPolicies{
+		Policies: make(map[string]SessionPolicy),
+		Users:    file.Users,
+		Groups:   file.Groups,
+	}
+	if policies.Default, err = file.Default.parse("default"); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, policy := range file.Policies {
+		if policies.Policies[name], err = policy.parse(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for user, name := range file.Users {
+		if _, ok := policies.Policies[name]; !ok {
+			return nil, fmt.Errorf("%s: user %q has unknown policy %q", path, user, name)
+		}
+	}
+	for group, name := range file.Groups {
+		if _, ok := policies.Policies[name]; !ok {
+			return nil, fmt.Errorf("%s: group %q has unknown policy %q", path, group, name)
+		}
+	}
+
+	for network, name := range file.Networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("%s: network %q: %w", path, network, err)
+		}
+		if name != "default" {
+			if _, ok := policies.Policies[name]; !ok {
+				return nil, fmt.Errorf("%s: network %q has unknown policy %q", path, network, name)
+			}
+		}
+		policies.Networks = append(policies.Networks, NetworkPolicy{Prefix: prefix.Masked(), Policy: name})
+	}
+	// 最も狭いネットワークを優先する (同じ長さならアドレス順)
+	slices.SortFunc(policies.Networks, func(a, b NetworkPolicy) int {
+		if a.Prefix.Bits() != b.Prefix.Bits() {
+			return b.Prefix.Bits() - a.Prefix.Bits()
+		}
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+
+	groups := make(map[string][]string)
+	for group, users := range file.Members {
+		if _, ok := file.Groups[group]; !ok {
+			return nil, fmt.Errorf("%s: members of group %q without a policy", path, group)
+		}
+		for _, user := range users {
+			groups[user] = append(groups[user], group)
+		}
+	}
+	// map の順序に依存しないよう、グループ名の順で優先する
+	for _, userGroups := range groups {
+		slices.Sort(userGroups)
+	}
+	policies.UserGroups = func(user string) []string {
+		return groups[user]
+	}
+	return policies, nil
+}
+
+func (f policyFile) parse(name string) (SessionPolicy, error) {
+	policy := SessionPolicy{Name: name, Sliding: f.Sliding}
+	for _, field := range []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{f.CookieLifetime, &policy.CookieLifetime},
+		{f.SessionLifetime, &policy.SessionLifetime},
+		{f.MaxLifetime, &policy.MaxLifetime},
+		{f.RefreshBefore, &policy.RefreshBefore},
+	} {
+		if field.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(field.value)
+		if err != nil {
+			return SessionPolicy{}, fmt.Errorf("session policy %q: %w", name, err)
+		}
+		*field.dest = duration
+	}
+	return policy, policy.Validate()
+}
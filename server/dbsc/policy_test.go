@@ -0,0 +1,139 @@
+package dbsc_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/dbsc"
+)
+
+func TestLoadSessionPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{
+		"default": {"cookie_lifetime": "5m"},
+		"policies": {
+			"high-risk": {"cookie_lifetime": "30s", "session_lifetime": "15m", "sliding": true, "max_lifetime": "2h", "refresh_before": "10s"},
+			"low-risk": {"cookie_lifetime": "1h"}
+		},
+		"users": {"admin": "high-risk", "carol": "low-risk"},
+		"groups": {"operators": "high-risk", "staff": "low-risk"},
+		"members": {"operators": ["bob", "carol"], "staff": ["dave", "bob"]},
+		"networks": {"0.0.0.0/0": "high-risk", "10.0.0.0/8": "default", "10.1.0.0/16": "low-risk", "2001:db8::/32": "low-risk"}
+	}`)
+	policies, err := dbsc.LoadSessionPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dbsc.SessionPolicy{Name: "high-risk", CookieLifetime: 30 * time.Second, SessionLifetime: 15 * time.Minute, Sliding: true, MaxLifetime: 2 * time.Hour, RefreshBefore: 10 * time.Second}
+	if got := policies.Select(nil, "admin"); got != want {
+		t.Errorf("admin policy = %+v, want %+v", got, want)
+	}
+	// ユーザーのポリシーがグループより優先し、複数のグループではグループ名の順に選ぶ
+	for user, want := range map[string]string{"bob": "high-risk", "carol": "low-risk", "dave": "low-risk"} {
+		if got := policies.Select(nil, user); got.Name != want {
+			t.Errorf("%s policy = %q, want %q", user, got.Name, want)
+		}
+	}
+	if got := policies.Select(nil, "alice"); got != (dbsc.SessionPolicy{Name: "default", CookieLifetime: 5 * time.Minute}) {
+		t.Errorf("default policy = %+v", got)
+	}
+	// ユーザーやグループのポリシーがなければ、最も狭いネットワークのポリシーを使う
+	for remoteAddr, want := range map[string]string{
+		"192.0.2.1:1234":       "high-risk",
+		"10.2.0.1:1234":        "default",
+		"10.1.0.1:1234":        "low-risk",
+		"[::ffff:10.1.0.1]:80": "low-risk",
+		"[2001:db8::1]:443":    "low-risk",
+		"[2001:db9::1]:443":    "default",
+		"pipe":                 "default",
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/dbsc_start", nil)
+		r.RemoteAddr = remoteAddr
+		if got := policies.Select(r, "alice"); got.Name != want {
+			t.Errorf("policy from %s = %q, want %q", remoteAddr, got.Name, want)
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/dbsc_start", nil)
+	r.RemoteAddr = "10.1.0.1:1234"
+	if got := policies.Select(r, "bob"); got.Name != "high-risk" {
+		t.Errorf("group policy from a network = %q, want high-risk", got.Name)
+	}
+
+	for name, content := range map[string]string{
+		"unknown policy":         `{"users": {"admin": "missing"}}`,
+		"unknown group policy":   `{"groups": {"operators": "missing"}}`,
+		"members without policy": `{"members": {"operators": ["bob"]}}`,
+		"invalid duration":       `{"default": {"cookie_lifetime": "soon"}}`,
+		"negative lifetime":      `{"default": {"session_lifetime": "-1m"}}`,
+		"absolute with max":      `{"default": {"max_lifetime": "1h"}}`,
+		"refresh after expiry":   `{"default": {"cookie_lifetime": "1m", "refresh_before": "1m"}}`,
+		"invalid network":        `{"networks": {"10.0.0.0": "default"}}`,
+		"unknown network policy": `{"networks": {"10.0.0.0/8": "missing"}}`,
+		"malformed document":     `{"default":`,
+	} {
+		write(content)
+		if _, err := dbsc.LoadSessionPolicies(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestSessionPolicyLifetimes(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := dbsc.NewDBSCSessionManager()
+	manager.Clock = fake
+	start := fake.Now()
+
+	absolute, err := manager.GenerateSession("pem", "alice", "login", "", dbsc.SessionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if absolute.Policy.CookieLifetime != manager.CookieLifetime || !absolute.ExpiresAt.Equal(start.Add(manager.SessionLifetime)) {
+		t.Errorf("default policy = %+v, expires at %v", absolute.Policy, absolute.ExpiresAt)
+	}
+	sliding, err := manager.GenerateSession("pem", "bob", "login", "", dbsc.SessionPolicy{
+		CookieLifetime:  time.Minute,
+		SessionLifetime: 10 * time.Minute,
+		Sliding:         true,
+		MaxLifetime:     25 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := manager.GenerateCookie(sliding.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cookie.ExpiresAt.Equal(start.Add(time.Minute)) {
+		t.Errorf("cookie expires at %v, want the policy's lifetime", cookie.ExpiresAt)
+	}
+
+	// リフレッシュのたびにスライディングのセッションだけが延長され、上限で止まる
+	for i, want := range []time.Duration{18 * time.Minute, 25 * time.Minute} {
+		fake.Advance(8 * time.Minute)
+		manager.RecordRefresh(absolute.Identifier)
+		manager.RecordRefresh(sliding.Identifier)
+		session, ok := manager.GetSession(sliding.Identifier)
+		if !ok {
+			t.Fatalf("refresh %d: sliding session expired", i+1)
+		}
+		if !session.ExpiresAt.Equal(start.Add(want)) {
+			t.Errorf("refresh %d: sliding session expires at %v, want %v", i+1, session.ExpiresAt.Sub(start), want)
+		}
+	}
+	if _, ok := manager.GetSession(absolute.Identifier); ok {
+		t.Error("absolute session was extended past its lifetime")
+	}
+}
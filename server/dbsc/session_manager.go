@@ -1,100 +1,515 @@
 package dbsc
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"io"
+	"slices"
+	"sync"
 	"time"
 
-	"dbsc-demo/logging"
+	"dbsc-demo/clock"
+	"dbsc-demo/random"
 )
 
 type DBSCSessionManager struct {
-	cookies    map[string]*DBSCCookie
-	challenges map[string]*DBSCChallenge
-	sessions   map[string]*DBSCSession
+	// 各種の有効期限
+	ChallengeLifetime     time.Duration
+	CookieLifetime        time.Duration
+	SessionLifetime       time.Duration
+	AuthorizationLifetime time.Duration
+
+	// Clock and Random can be replaced in tests to make expiry and identifiers deterministic
+	Clock  clock.Clock
+	Random io.Reader
+
+	mu             sync.Mutex
+	cookies        map[string]*DBSCCookie
+	challenges     map[string]*DBSCChallenge
+	sessions       map[string]*DBSCSession
+	authorizations map[string]*DBSCAuthorization
+	// refreshChallenges は各セッションで最後に発行したリフレッシュ用チャレンジ
+	refreshChallenges map[string]string
 }
 
 func NewDBSCSessionManager() *DBSCSessionManager {
 	return &DBSCSessionManager{
-		cookies:    make(map[string]*DBSCCookie),
-		challenges: make(map[string]*DBSCChallenge),
-		sessions:   make(map[string]*DBSCSession),
+		ChallengeLifetime:     30 * time.Minute,
+		CookieLifetime:        5 * time.Second,
+		SessionLifetime:       10 * time.Minute,
+		AuthorizationLifetime: 5 * time.Minute,
+		Clock:                 clock.System,
+		Random:                random.System,
+		cookies:               make(map[string]*DBSCCookie),
+		challenges:            make(map[string]*DBSCChallenge),
+		sessions:              make(map[string]*DBSCSession),
+		authorizations:        make(map[string]*DBSCAuthorization),
+		refreshChallenges:     make(map[string]string),
+	}
+}
+
+// DBSCAuthorization is a single-use code binding a registration to a logged-in user
+type DBSCAuthorization struct {
+	Code         string
+	User         string
+	LoginSession string // 発行時のログインセッション
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+func (s *DBSCSessionManager) GenerateAuthorization(user string, loginSession string) (string, error) {
+	code, err := random.NewID(s.Random)
+	if err != nil {
+		return "", err
 	}
+	now := s.Clock.Now()
+	authorization := &DBSCAuthorization{
+		Code:         code,
+		User:         user,
+		LoginSession: loginSession,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(s.AuthorizationLifetime),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneExpired(now)
+	s.authorizations[authorization.Code] = authorization
+	return authorization.Code, nil
+}
+
+// ConsumeAuthorization returns the authorization for code and invalidates it
+func (s *DBSCSessionManager) ConsumeAuthorization(code string) (*DBSCAuthorization, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorization, exists := s.authorizations[code]
+	if !exists {
+		return nil, false
+	}
+	delete(s.authorizations, code)
+	if !s.Clock.Now().Before(authorization.ExpiresAt) {
+		return nil, false
+	}
+	return authorization, true
 }
 
 type DBSCChallenge struct {
-	Value     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	Value             string
+	SessionIdentifier string // リフレッシュ用の場合: 対象のセッションID (登録用は空)
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
+
+	// フェデレーション登録の場合のみ: プロバイダーセッションの情報
+	ProviderID     string
+	ProviderKeyPEM string
+}
+
+// GenerateChallenge issues a registration challenge
+func (s *DBSCSessionManager) GenerateChallenge() (string, error) {
+	return s.storeChallenge(&DBSCChallenge{})
+}
+
+// GenerateFederatedChallenge issues a registration challenge bound to a provider session
+func (s *DBSCSessionManager) GenerateFederatedChallenge(providerID string, providerKeyPEM string) (string, error) {
+	return s.storeChallenge(&DBSCChallenge{
+		ProviderID:     providerID,
+		ProviderKeyPEM: providerKeyPEM,
+	})
+}
+
+// GenerateRefreshChallenge issues a challenge usable only for refreshing the session, or returns
+// the outstanding one if it was issued less than reuse ago
+func (s *DBSCSessionManager) GenerateRefreshChallenge(sessionIdentifier string, reuse time.Duration) (string, bool, error) {
+	s.mu.Lock()
+	if value, ok := s.refreshChallenges[sessionIdentifier]; ok {
+		now := s.Clock.Now()
+		if challenge, exists := s.challenges[value]; exists && now.Before(challenge.CreatedAt.Add(reuse)) && now.Before(challenge.ExpiresAt) {
+			s.mu.Unlock()
+			return value, true, nil
+		}
+	}
+	s.mu.Unlock()
+
+	value, err := s.storeChallenge(&DBSCChallenge{
+		SessionIdentifier: sessionIdentifier,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshChallenges[sessionIdentifier] = value
+	return value, false, nil
 }
 
-func (s *DBSCSessionManager) GenerateChallenge() string {
-	challenge := &DBSCChallenge{
-		Value:     s.generateRandomID(),
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(30 * time.Minute),
+func (s *DBSCSessionManager) storeChallenge(challenge *DBSCChallenge) (string, error) {
+	value, err := random.NewID(s.Random)
+	if err != nil {
+		return "", err
 	}
+	now := s.Clock.Now()
+	challenge.Value = value
+	challenge.CreatedAt = now
+	challenge.ExpiresAt = now.Add(s.ChallengeLifetime)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneExpired(now)
 	s.challenges[challenge.Value] = challenge
-	return challenge.Value
+	return challenge.Value, nil
 }
 
 func (s *DBSCSessionManager) VerifyChallenge(value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, exists := s.challenges[value]
+	return exists && s.Clock.Now().Before(challenge.ExpiresAt)
+}
+
+// ConsumeChallenge returns the challenge and invalidates it so that a proof cannot be replayed
+func (s *DBSCSessionManager) ConsumeChallenge(value string) (*DBSCChallenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	challenge, exists := s.challenges[value]
-	return exists && time.Now().Before(challenge.ExpiresAt)
+	if !exists {
+		return nil, false
+	}
+	delete(s.challenges, value)
+	if !s.Clock.Now().Before(challenge.ExpiresAt) {
+		return nil, false
+	}
+	return challenge, true
 }
 
 type DBSCCookie struct {
-	Value     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	Value             string
+	SessionIdentifier string
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
 }
 
-func (s *DBSCSessionManager) GenerateCookie() *DBSCCookie {
+func (s *DBSCSessionManager) GenerateCookie(sessionIdentifier string) (*DBSCCookie, error) {
+	value, err := random.NewID(s.Random)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lifetime := s.CookieLifetime
+	if session, exists := s.sessions[sessionIdentifier]; exists {
+		lifetime = session.Policy.CookieLifetime
+	}
 	cookie := &DBSCCookie{
-		Value:     s.generateRandomID(),
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(5 * time.Second),
+		Value:             value,
+		SessionIdentifier: sessionIdentifier,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(lifetime),
 	}
+	s.pruneExpired(now)
 	s.cookies[cookie.Value] = cookie
-	return cookie
+	return cookie, nil
+}
+
+// RotateCookie issues a new cookie for the session and shortens the remaining lifetime of
+// its previous cookies to grace
+func (s *DBSCSessionManager) RotateCookie(sessionIdentifier string, grace time.Duration) (*DBSCCookie, error) {
+	cookie, err := s.GenerateCookie(sessionIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	graceEnd := cookie.CreatedAt.Add(grace)
+	for value, previous := range s.cookies {
+		if previous.SessionIdentifier != sessionIdentifier || value == cookie.Value {
+			continue
+		}
+		if graceEnd.Before(previous.ExpiresAt) {
+			previous.ExpiresAt = graceEnd
+		}
+		if !cookie.CreatedAt.Before(previous.ExpiresAt) {
+			delete(s.cookies, value)
+		}
+	}
+	return cookie, nil
 }
 
 func (s *DBSCSessionManager) VerifyCookie(value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	cookie, exists := s.cookies[value]
-	return exists && time.Now().Before(cookie.ExpiresAt)
+	return exists && s.Clock.Now().Before(cookie.ExpiresAt)
 }
 
 type DBSCSession struct {
-	Identifier   string
-	PublicKeyPEM string
-	CreatedAt    time.Time
-	ExpiresAt    time.Time
+	Identifier           string
+	PublicKeyPEM         string
+	CreatedAt            time.Time
+	ExpiresAt            time.Time
+	LastRefreshInitiator string // 最後にリフレッシュを開始したサイト (同一オリジンの場合は空)
+	ProviderID           string // フェデレーションの場合: プロバイダー側のセッションID
+	User                 string // セッションを登録したユーザー
+	LoginSession         string // 登録時のログインセッション
+	KeyThumbprint        string // 公開キーの JWK サムプリント
+	RefreshCount         int
+	LastRefreshedAt      time.Time
+	RechallengeRequired  bool // 管理者が再チャレンジを要求した (次のリフレッシュで解除)
+	// Policy is the policy chosen at registration, with the store defaults filled in
+	Policy SessionPolicy
 }
 
-func (s *DBSCSessionManager) GenerateSession(pem string) *DBSCSession {
+// GenerateSession registers a session with the lifetimes of policy. Zero lifetimes of the
+// policy are replaced by CookieLifetime and SessionLifetime.
+func (s *DBSCSessionManager) GenerateSession(pem string, user string, loginSession string, providerID string, policy SessionPolicy) (*DBSCSession, error) {
+	identifier, err := random.NewID(s.Random)
+	if err != nil {
+		return nil, err
+	}
+	if policy.CookieLifetime == 0 {
+		policy.CookieLifetime = s.CookieLifetime
+	}
+	if policy.SessionLifetime == 0 {
+		policy.SessionLifetime = s.SessionLifetime
+	}
+	now := s.Clock.Now()
 	session := &DBSCSession{
-		Identifier:   s.generateRandomID(),
-		PublicKeyPEM: pem,
-		CreatedAt:    time.Now(),
-		ExpiresAt:    time.Now().Add(10 * time.Minute), // 10 minutes expiration
+		Identifier:    identifier,
+		PublicKeyPEM:  pem,
+		User:          user,
+		LoginSession:  loginSession,
+		CreatedAt:     now,
+		ExpiresAt:     policy.expiresAt(now, now),
+		ProviderID:    providerID,
+		KeyThumbprint: keyThumbprint(pem),
+		Policy:        policy,
 	}
+	s.mu.Lock()
 	s.sessions[session.Identifier] = session
-	logging.Logger.Printf("Generated new session with ID: %s", session.Identifier)
-	return session
+	s.mu.Unlock()
+	return session, nil
 }
 
 func (s *DBSCSessionManager) VerifySession(identifier string, pem string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	session, exists := s.sessions[identifier]
-	return exists && time.Now().Before(session.ExpiresAt) && session.PublicKeyPEM == pem
+	return exists && s.Clock.Now().Before(session.ExpiresAt) && session.PublicKeyPEM == pem
 }
 
 func (s *DBSCSessionManager) IsExistSession(identifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[identifier]
+	return exists && s.Clock.Now().Before(session.ExpiresAt)
+}
+
+// GetSession returns a copy of the unexpired session
+func (s *DBSCSessionManager) GetSession(identifier string) (*DBSCSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[identifier]
+	if !exists || !s.Clock.Now().Before(session.ExpiresAt) {
+		return nil, false
+	}
+	copied := *session
+	return &copied, true
+}
+
+func (s *DBSCSessionManager) EndExpiredSession(identifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[identifier]
+	if !exists || s.Clock.Now().Before(session.ExpiresAt) {
+		return false
+	}
+	delete(s.sessions, identifier)
+	s.invalidateCredentials(identifier)
+	return true
+}
+
+func (s *DBSCSessionManager) GetCookie(value string) (*DBSCCookie, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookie, exists := s.cookies[value]
+	if !exists || !s.Clock.Now().Before(cookie.ExpiresAt) {
+		return nil, false
+	}
+	copied := *cookie
+	return &copied, true
+}
+
+// GetSessionByCookie resolves the session bound to a valid DBSC cookie
+func (s *DBSCSessionManager) GetSessionByCookie(value string) (*DBSCSession, bool) {
+	// 有効期限は RotateCookie が書き換えるので、ロック中に確認した GetCookie のコピーを使う
+	cookie, ok := s.GetCookie(value)
+	if !ok {
+		return nil, false
+	}
+	return s.GetSession(cookie.SessionIdentifier)
+}
+
+func (s *DBSCSessionManager) IsRegistered(loginSession string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Clock.Now()
+	for _, authorization := range s.authorizations {
+		if authorization.LoginSession == loginSession && now.Before(authorization.ExpiresAt) {
+			return true
+		}
+	}
+	for _, session := range s.sessions {
+		if session.LoginSession == loginSession && now.Before(session.ExpiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DBSCSessionManager) RecordRefreshInitiator(identifier string, initiator string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, exists := s.sessions[identifier]; exists {
+		session.LastRefreshInitiator = initiator
+	}
+}
+
+// RecordRefresh counts a successful refresh of the session and extends it when its policy is sliding
+func (s *DBSCSessionManager) RecordRefresh(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Clock.Now()
+	if session, exists := s.sessions[identifier]; exists && now.Before(session.ExpiresAt) {
+		session.RefreshCount++
+		session.LastRefreshedAt = now
+		session.RechallengeRequired = false
+		if expiresAt := session.Policy.expiresAt(session.CreatedAt, now); expiresAt.After(session.ExpiresAt) {
+			session.ExpiresAt = expiresAt
+		}
+	}
+}
+
+// ListSessions returns copies of the unexpired sessions matching filter, newest first
+func (s *DBSCSessionManager) ListSessions(filter SessionFilter) []DBSCSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Clock.Now()
+	sessions := []DBSCSession{}
+	for _, session := range s.sessions {
+		if now.Before(session.ExpiresAt) && filter.matches(session) {
+			sessions = append(sessions, *session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b DBSCSession) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return sessions
+}
+
+// RevokeSession deletes the session together with its cookies and refresh challenges
+func (s *DBSCSessionManager) RevokeSession(identifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[identifier]; !exists {
+		return false
+	}
+	delete(s.sessions, identifier)
+	s.invalidateCredentials(identifier)
+	return true
+}
+
+// RevokeUserSessions revokes every session of user and returns their identifiers
+func (s *DBSCSessionManager) RevokeUserSessions(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	identifiers := []string{}
+	for identifier, session := range s.sessions {
+		if session.User == user {
+			delete(s.sessions, identifier)
+			s.invalidateCredentials(identifier)
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	slices.Sort(identifiers)
+	return identifiers
+}
+
+// RequireRechallenge invalidates the session's cookies and outstanding challenges so that
+// the next request has to refresh with a newly issued challenge
+func (s *DBSCSessionManager) RequireRechallenge(identifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	session, exists := s.sessions[identifier]
-	return exists && time.Now().Before(session.ExpiresAt)
+	if !exists || !s.Clock.Now().Before(session.ExpiresAt) {
+		return false
+	}
+	session.RechallengeRequired = true
+	s.invalidateCredentials(identifier)
+	return true
 }
 
-func (s *DBSCSessionManager) generateRandomID() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return base64.URLEncoding.EncodeToString(bytes)
+// invalidateCredentials deletes the cookies and refresh challenges of a session. s.mu must be held.
+func (s *DBSCSessionManager) invalidateCredentials(identifier string) {
+	for value, cookie := range s.cookies {
+		if cookie.SessionIdentifier == identifier {
+			delete(s.cookies, value)
+		}
+	}
+	for value, challenge := range s.challenges {
+		if challenge.SessionIdentifier == identifier {
+			delete(s.challenges, value)
+		}
+	}
+	delete(s.refreshChallenges, identifier)
+}
+
+// pruneExpired forgets the expired challenges, cookies and authorizations. Expired sessions are
+// kept until EndExpiredSession reports them. s.mu must be held.
+func (s *DBSCSessionManager) pruneExpired(now time.Time) {
+	for value, challenge := range s.challenges {
+		if !now.Before(challenge.ExpiresAt) {
+			delete(s.challenges, value)
+		}
+	}
+	for value, cookie := range s.cookies {
+		if !now.Before(cookie.ExpiresAt) {
+			delete(s.cookies, value)
+		}
+	}
+	for code, authorization := range s.authorizations {
+		if !now.Before(authorization.ExpiresAt) {
+			delete(s.authorizations, code)
+		}
+	}
+	// 使用済みまたは期限切れのチャレンジを指す記録も消す
+	for identifier, value := range s.refreshChallenges {
+		if _, exists := s.challenges[value]; !exists {
+			delete(s.refreshChallenges, identifier)
+		}
+	}
+}
+
+// Stats counts the live entries
+func (s *DBSCSessionManager) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Clock.Now()
+	var stats StoreStats
+	for _, session := range s.sessions {
+		if now.Before(session.ExpiresAt) {
+			stats.Sessions++
+		}
+	}
+	for _, challenge := range s.challenges {
+		if now.Before(challenge.ExpiresAt) {
+			stats.Challenges++
+		}
+	}
+	for _, cookie := range s.cookies {
+		if now.Before(cookie.ExpiresAt) {
+			stats.Cookies++
+		}
+	}
+	for _, authorization := range s.authorizations {
+		if now.Before(authorization.ExpiresAt) {
+			stats.Authorizations++
+		}
+	}
+	return stats
 }
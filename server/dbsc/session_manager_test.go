@@ -0,0 +1,142 @@
+package dbsc_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/dbsc"
+)
+
+func TestRotateCookieConcurrentLookup(t *testing.T) {
+	manager := dbsc.NewDBSCSessionManager()
+	manager.CookieLifetime = time.Hour
+	session, err := manager.GenerateSession("pem", "test", "login", "", dbsc.SessionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := manager.GenerateCookie(session.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 古い Cookie の検証とローテーションが並行しても競合しない (-race で検出する)。
+	// 猶予期間を毎回短くして、ローテーションのたびに古い Cookie の有効期限を書き換える
+	const rotations = 1000
+	var rotated atomic.Bool
+	var started, wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for !rotated.Load() {
+				if _, ok := manager.GetSessionByCookie(cookie.Value); !ok {
+					t.Error("previous cookie rejected within the grace period")
+					return
+				}
+			}
+		}()
+	}
+	started.Wait()
+	for i := 0; i < rotations; i++ {
+		if _, err := manager.RotateCookie(session.Identifier, time.Duration(rotations-i)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated.Store(true)
+	wg.Wait()
+}
+
+func TestGenerateRefreshChallengeReuse(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := dbsc.NewDBSCSessionManager()
+	manager.Clock = fake
+	session, err := manager.GenerateSession("pem", "alice", "login", "", dbsc.SessionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := manager.GenerateSession("pem", "bob", "login", "", dbsc.SessionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const reuse = 2 * time.Second
+
+	first, reused, err := manager.GenerateRefreshChallenge(session.Identifier, reuse)
+	if err != nil || reused {
+		t.Fatalf("first challenge: reused = %v, err = %v", reused, err)
+	}
+	fake.Advance(reuse - time.Millisecond)
+	if again, reused, _ := manager.GenerateRefreshChallenge(session.Identifier, reuse); again != first || !reused {
+		t.Errorf("challenge within the window = %q (reused %v), want %q", again, reused, first)
+	}
+	if another, _, _ := manager.GenerateRefreshChallenge(other.Identifier, reuse); another == first {
+		t.Error("challenge shared with another session")
+	}
+
+	// 再利用の期間は発行時から数え、再び返しても延長しない
+	fake.Advance(time.Millisecond)
+	second, reused, _ := manager.GenerateRefreshChallenge(session.Identifier, reuse)
+	if second == first || reused {
+		t.Errorf("challenge after the window = %q (reused %v)", second, reused)
+	}
+
+	if _, ok := manager.ConsumeChallenge(second); !ok {
+		t.Fatal("challenge not consumable")
+	}
+	if third, reused, _ := manager.GenerateRefreshChallenge(session.Identifier, reuse); third == second || reused {
+		t.Error("consumed challenge issued again")
+	}
+	if zero, reused, _ := manager.GenerateRefreshChallenge(session.Identifier, 0); reused {
+		t.Errorf("challenge %q reused without a window", zero)
+	}
+}
+
+func TestPruneExpired(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := dbsc.NewDBSCSessionManager()
+	manager.Clock = fake
+	session, err := manager.GenerateSession("pem", "alice", "login", "", dbsc.SessionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 登録とリフレッシュを繰り返しても、期限切れのエントリは次の発行時に消える
+	for i := 0; i < 100; i++ {
+		if _, err := manager.GenerateAuthorization("alice", "login"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.GenerateChallenge(); err != nil {
+			t.Fatal(err)
+		}
+		challenge, _, err := manager.GenerateRefreshChallenge(session.Identifier, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			manager.ConsumeChallenge(challenge)
+		}
+		if _, err := manager.GenerateCookie(session.Identifier); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(manager.ChallengeLifetime)
+	}
+	challenges, cookies, authorizations, refreshChallenges := manager.StoredEntries()
+	if challenges > 2 || cookies > 1 || authorizations > 1 || refreshChallenges > 1 {
+		t.Errorf("stored challenges %d, cookies %d, authorizations %d, refresh challenges %d", challenges, cookies, authorizations, refreshChallenges)
+	}
+
+	if _, err := manager.GenerateCookie(session.Identifier); err != nil {
+		t.Fatal(err)
+	}
+	if challenges, cookies, authorizations, refreshChallenges := manager.StoredEntries(); challenges != 0 || cookies != 1 || authorizations != 0 || refreshChallenges != 0 {
+		t.Errorf("after expiry: challenges %d, cookies %d, authorizations %d, refresh challenges %d", challenges, cookies, authorizations, refreshChallenges)
+	}
+	// 期限切れのセッションは終了を報告するまで残す
+	if !manager.EndExpiredSession(session.Identifier) {
+		t.Error("expired session was pruned before it was reported")
+	}
+}
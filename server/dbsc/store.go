@@ -0,0 +1,92 @@
+package dbsc
+
+import "time"
+
+// Store keeps the authorizations, challenges, sessions and bound cookies of a DBSCServer.
+// DBSCSessionManager is the in-memory implementation; services running several instances
+// can provide a shared one.
+type Store interface {
+	GenerateAuthorization(user string, loginSession string) (string, error)
+	ConsumeAuthorization(code string) (*DBSCAuthorization, bool)
+
+	GenerateChallenge() (string, error)
+	GenerateFederatedChallenge(providerID string, providerKeyPEM string) (string, error)
+	// GenerateRefreshChallenge issues a refresh challenge for the session. A challenge of the
+	// session issued less than reuse ago and not yet consumed is returned again instead
+	// (reused is true), so that refreshes from several tabs arriving close together share it.
+	GenerateRefreshChallenge(sessionIdentifier string, reuse time.Duration) (value string, reused bool, err error)
+	VerifyChallenge(value string) bool
+	ConsumeChallenge(value string) (*DBSCChallenge, bool)
+
+	GenerateSession(pem string, user string, loginSession string, providerID string, policy SessionPolicy) (*DBSCSession, error)
+	VerifySession(identifier string, pem string) bool
+	IsExistSession(identifier string) bool
+	GetSession(identifier string) (*DBSCSession, bool)
+	// EndExpiredSession deletes the session if it has expired and reports whether it did.
+	// It is false for unknown sessions, so that only sessions that existed are reported as expired.
+	EndExpiredSession(identifier string) bool
+	// RecordRefreshInitiator records the site that initiated the last successful refresh
+	// (empty for same-origin)
+	RecordRefreshInitiator(identifier string, initiator string)
+	// RecordRefresh is called after the session was refreshed successfully. It extends sessions
+	// with a sliding policy.
+	RecordRefresh(identifier string)
+	// IsRegistered reports whether a registration for the login session is pending or has completed
+	IsRegistered(loginSession string) bool
+
+	GenerateCookie(sessionIdentifier string) (*DBSCCookie, error)
+	// RotateCookie issues a new cookie on refresh. The previous cookies of the session stay
+	// valid for at most grace, so that requests sent during the rotation do not fail.
+	RotateCookie(sessionIdentifier string, grace time.Duration) (*DBSCCookie, error)
+	// GetCookie returns the unexpired cookie with value
+	GetCookie(value string) (*DBSCCookie, bool)
+	GetSessionByCookie(value string) (*DBSCSession, bool)
+}
+
+var _ Store = (*DBSCSessionManager)(nil)
+
+// StoreStats counts the live (unexpired) entries of a store
+type StoreStats struct {
+	Sessions       int
+	Challenges     int
+	Cookies        int
+	Authorizations int
+}
+
+// StatsReporter is implemented by stores able to report their size
+type StatsReporter interface {
+	Stats() StoreStats
+}
+
+var _ StatsReporter = (*DBSCSessionManager)(nil)
+
+// SessionFilter selects the sessions returned by SessionAdmin.ListSessions.
+// Zero fields match every session.
+type SessionFilter struct {
+	User          string
+	KeyThumbprint string
+	// LoginSession selects the sessions registered from one login
+	LoginSession  string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func (f SessionFilter) matches(session *DBSCSession) bool {
+	return (f.User == "" || session.User == f.User) &&
+		(f.KeyThumbprint == "" || session.KeyThumbprint == f.KeyThumbprint) &&
+		(f.LoginSession == "" || session.LoginSession == f.LoginSession) &&
+		(f.CreatedAfter.IsZero() || session.CreatedAt.After(f.CreatedAfter)) &&
+		(f.CreatedBefore.IsZero() || session.CreatedAt.Before(f.CreatedBefore))
+}
+
+// SessionAdmin is implemented by stores that let operators list and revoke sessions
+type SessionAdmin interface {
+	ListSessions(filter SessionFilter) []DBSCSession
+	RevokeSession(identifier string) bool
+	RevokeUserSessions(user string) []string
+	// RequireRechallenge makes the next refresh of the session prove possession of its key
+	// with a newly issued challenge
+	RequireRechallenge(identifier string) bool
+}
+
+var _ SessionAdmin = (*DBSCSessionManager)(nil)
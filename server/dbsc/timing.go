@@ -0,0 +1,72 @@
+package dbsc
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// PadLatency holds back the responses of next until floor has passed since the request
+// arrived, so that the response time does not reveal which check failed: an unknown session
+// is rejected much faster than a proof with a bad signature. The response is buffered in the
+// meantime. Requests taking longer than floor are not delayed, so floor should be above the
+// usual latency of next. A floor of zero or less returns next unchanged.
+func PadLatency(floor time.Duration, next http.Handler) http.Handler {
+	if floor <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline := time.Now().Add(floor)
+		buffered := &bufferedResponse{header: w.Header().Clone(), status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			// クライアントが切断した場合は何も返さない
+			return
+		}
+
+		header := w.Header()
+		clear(header)
+		for name, values := range buffered.header {
+			header[name] = values
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	})
+}
+
+// bufferedResponse records a response to be written later
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(data)
+}
+
+// equalSecret compares identifiers and challenges in constant time.
+// Lookups of the in-memory store go through Go maps, whose hash is randomly seeded per
+// process, so they do not leak how much of a guessed value matches either.
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,45 @@
+package dbsc_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dbsc-demo/server/dbsc"
+)
+
+func TestPadLatency(t *testing.T) {
+	const floor = 50 * time.Millisecond
+	handler := dbsc.PadLatency(floor, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sec-Session-Challenge", `"challenge"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("X-Frame-Options", "DENY")
+	start := time.Now()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/dbsc_refresh", nil))
+	if elapsed := time.Since(start); elapsed < floor {
+		t.Errorf("response after %v, want at least %v", elapsed, floor)
+	}
+	// ステータス・ヘッダー・本文はそのまま、外側で設定したヘッダーも残る
+	if recorder.Code != http.StatusUnauthorized || recorder.Body.String() != "Unauthorized\n" {
+		t.Errorf("response = %d %q", recorder.Code, recorder.Body.String())
+	}
+	for name, want := range map[string]string{"Sec-Session-Challenge": `"challenge"`, "X-Frame-Options": "DENY"} {
+		if got := recorder.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// floor を超えたハンドラはそれ以上遅らせない
+	slow := dbsc.PadLatency(floor, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * floor)
+	}))
+	start = time.Now()
+	slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/dbsc_refresh", nil))
+	if elapsed := time.Since(start); elapsed >= 3*floor {
+		t.Errorf("slow handler padded to %v", elapsed)
+	}
+}
@@ -0,0 +1,158 @@
+package wellknown
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dbsc-demo/clock"
+)
+
+// maxDocumentSize limits the size of a fetched well-known document
+const maxDocumentSize = 64 * 1024
+
+// Client fetches and caches the well-known documents of peer origins
+type Client struct {
+	HTTPClient *http.Client
+	// キャッシュ指示がない場合の保持期間
+	DefaultMaxAge time.Duration
+	Clock         clock.Clock
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	doc          *Document
+	expiresAt    time.Time
+	etag         string
+	lastModified string
+}
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:    &http.Client{Timeout: 5 * time.Second},
+		DefaultMaxAge: 5 * time.Minute,
+		Clock:         clock.System,
+		cache:         make(map[string]*cacheEntry),
+	}
+}
+
+// Fetch returns the validated well-known document of origin, using the cache while it is fresh
+func (c *Client) Fetch(ctx context.Context, origin string) (*Document, error) {
+	if err := validateOrigin(origin); err != nil {
+		return nil, fmt.Errorf("invalid origin %q: %w", origin, err)
+	}
+
+	c.mu.Lock()
+	entry := c.cache[origin]
+	c.mu.Unlock()
+	if entry != nil && c.Clock.Now().Before(entry.expiresAt) {
+		return entry.doc, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+Path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if entry != nil {
+		// 期限切れのエントリは条件付きリクエストで再検証する
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch well-known document: %w", err)
+	}
+	defer res.Body.Close()
+
+	var doc *Document
+	switch {
+	case res.StatusCode == http.StatusNotModified && entry != nil:
+		doc = entry.doc
+	case res.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxDocumentSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read well-known document: %w", err)
+		}
+		if len(body) > maxDocumentSize {
+			return nil, fmt.Errorf("well-known document too large")
+		}
+		doc = &Document{}
+		if err := json.Unmarshal(body, doc); err != nil {
+			return nil, fmt.Errorf("failed to decode well-known document: %w", err)
+		}
+		if err := doc.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid well-known document: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("well-known document returned status %d", res.StatusCode)
+	}
+
+	c.store(origin, doc, res)
+	return doc, nil
+}
+
+// store caches the document following the Cache-Control / Expires headers of the response
+func (c *Client) store(origin string, doc *Document, res *http.Response) {
+	lifetime, cacheable := c.freshnessLifetime(res)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !cacheable {
+		delete(c.cache, origin)
+		return
+	}
+	c.cache[origin] = &cacheEntry{
+		doc:          doc,
+		expiresAt:    c.Clock.Now().Add(lifetime),
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+}
+
+func (c *Client) freshnessLifetime(res *http.Response) (time.Duration, bool) {
+	for _, directive := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store":
+			return 0, false
+		case "no-cache":
+			// 保存はするが毎回再検証する
+			return 0, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+
+	if expires := res.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true
+		}
+		date := c.Clock.Now()
+		if d, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+			date = d
+		}
+		if lifetime := expiresAt.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, true
+	}
+
+	return c.DefaultMaxAge, true
+}
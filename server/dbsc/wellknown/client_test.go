@@ -0,0 +1,117 @@
+package wellknown_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/dbsc/wellknown"
+)
+
+func TestClientCache(t *testing.T) {
+	const etag = `"v1"`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		advance time.Duration
+		// wantRequests は 2 回目の Fetch までにサーバーに届くリクエスト数
+		wantRequests    int
+		wantConditional bool
+	}{
+		{"fresh max-age", map[string]string{"Cache-Control": "public, max-age=60"}, 30 * time.Second, 1, false},
+		{"stale max-age", map[string]string{"Cache-Control": "public, max-age=60"}, 60 * time.Second, 2, false},
+		{"stale max-age with etag", map[string]string{"Cache-Control": "max-age=60", "ETag": etag}, 60 * time.Second, 2, true},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache", "ETag": etag}, 0, 2, true},
+		{"no-store", map[string]string{"Cache-Control": "no-store", "ETag": etag}, 0, 2, false},
+		{"fresh expires", map[string]string{"Expires": "+60s"}, 30 * time.Second, 1, false},
+		{"stale expires", map[string]string{"Expires": "+60s"}, 61 * time.Second, 2, false},
+		{"invalid expires", map[string]string{"Expires": "0"}, 0, 2, false},
+		{"max-age wins over expires", map[string]string{"Cache-Control": "max-age=60", "Expires": "+10s"}, 30 * time.Second, 1, false},
+		{"default max-age", nil, 4 * time.Minute, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, conditional := 0, false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				now := time.Now().UTC()
+				w.Header().Set("Date", now.Format(http.TimeFormat))
+				for name, value := range tt.headers {
+					if name == "Expires" && value[0] == '+' {
+						lifetime, _ := time.ParseDuration(value[1:])
+						value = now.Add(lifetime).Format(http.TimeFormat)
+					}
+					w.Header().Set(name, value)
+				}
+				if r.Header.Get("If-None-Match") == etag {
+					conditional = true
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte(`{"relying_origins":["https://rp.example"]}`))
+			}))
+			defer server.Close()
+
+			fake := clock.NewFake(time.Now())
+			client := wellknown.NewClient()
+			client.Clock = fake
+			for i := 0; i < 2; i++ {
+				doc, err := client.Fetch(context.Background(), server.URL)
+				if err != nil {
+					t.Fatalf("fetch %d: %v", i+1, err)
+				}
+				// 304 の場合もキャッシュしたドキュメントを返す
+				if !doc.HasRelyingOrigin("https://rp.example") {
+					t.Fatalf("fetch %d: document = %+v", i+1, doc)
+				}
+				fake.Advance(tt.advance)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", requests, tt.wantRequests)
+			}
+			if conditional != tt.wantConditional {
+				t.Errorf("conditional request = %v, want %v", conditional, tt.wantConditional)
+			}
+		})
+	}
+}
+
+func TestClientRejectsInvalidDocuments(t *testing.T) {
+	for name, body := range map[string]string{
+		"malformed json":   `{`,
+		"origin with path": `{"relying_origins":["https://rp.example/path"]}`,
+		"bad scheme":       `{"provider_origin":"ftp://idp.example"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+			if _, err := wellknown.NewClient().Fetch(context.Background(), server.URL); err == nil {
+				t.Error("invalid document was accepted")
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := wellknown.Handler(wellknown.Document{RegisteringOrigins: []string{"https://a.example"}}, time.Hour)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, wellknown.Path, nil))
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" || res.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Fatalf("response = %d, headers = %v", res.Code, res.Header())
+	}
+
+	request := httptest.NewRequest(http.MethodGet, wellknown.Path, nil)
+	request.Header.Set("If-None-Match", etag)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, request)
+	if res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+		t.Errorf("revalidation = %d with %d bytes, want 304", res.Code, res.Body.Len())
+	}
+}
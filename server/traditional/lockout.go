@@ -0,0 +1,93 @@
+package traditional
+
+import (
+	"sync"
+	"time"
+
+	"dbsc-demo/clock"
+)
+
+// Lockout locks an account for LockoutDuration after MaxFailures consecutive failed logins.
+// Failures are counted per user name, whether or not the account exists, so that the
+// lockout does not reveal which accounts exist.
+type Lockout struct {
+	MaxFailures     int
+	LockoutDuration time.Duration
+	Clock           clock.Clock
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// maxTrackedNames bounds the memory used by failures for many different user names
+const maxTrackedNames = 10000
+
+func NewLockout() *Lockout {
+	return &Lockout{
+		MaxFailures:     5,
+		LockoutDuration: 15 * time.Minute,
+		Clock:           clock.System,
+		failures:        make(map[string]*loginFailures),
+	}
+}
+
+// Locked returns how long the account stays locked, or 0 when it is not locked
+func (l *Lockout) Locked(name string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, exists := l.failures[name]
+	if !exists {
+		return 0
+	}
+	remaining := failures.lockedUntil.Sub(l.Clock.Now())
+	return max(remaining, 0)
+}
+
+// Fail records a failed login and reports whether the account is now locked
+func (l *Lockout) Fail(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Clock.Now()
+	failures, exists := l.failures[name]
+	if !exists {
+		if len(l.failures) >= maxTrackedNames {
+			l.prune(now)
+		}
+		failures = &loginFailures{}
+		l.failures[name] = failures
+	}
+	// ロック期間が過ぎた失敗は数え直す
+	if now.Sub(failures.lastFailure) > l.LockoutDuration {
+		failures.count = 0
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count >= l.MaxFailures {
+		failures.count = 0
+		failures.lockedUntil = now.Add(l.LockoutDuration)
+		return true
+	}
+	return false
+}
+
+// Reset forgets the failures of a successful login
+func (l *Lockout) Reset(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, name)
+}
+
+// prune forgets the names that are neither locked nor failed recently. l.mu must be held.
+func (l *Lockout) prune(now time.Time) {
+	for name, failures := range l.failures {
+		if now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) > l.LockoutDuration {
+			delete(l.failures, name)
+		}
+	}
+}
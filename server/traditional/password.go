@@ -0,0 +1,98 @@
+package traditional
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the argon2id parameters used for new password hashes.
+// Existing hashes keep the parameters encoded in them.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follows the OWASP minimum recommendation for argon2id
+var DefaultArgon2Params = Argon2Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// maxArgon2Params bounds the parameters read from a stored hash, so that a crafted hash in the
+// users file cannot make every login allocate gigabytes or run for minutes
+var maxArgon2Params = Argon2Params{
+	Memory:      256 * 1024,
+	Iterations:  16,
+	Parallelism: 16,
+	KeyLength:   64,
+}
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// HashPassword hashes password with argon2id into the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash)
+func HashPassword(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches an encoded hash from HashPassword
+func VerifyPassword(encoded string, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return false, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return false, errInvalidHash
+	}
+	if params.Memory == 0 || params.Memory > maxArgon2Params.Memory ||
+		params.Iterations == 0 || params.Iterations > maxArgon2Params.Iterations ||
+		params.Parallelism == 0 || params.Parallelism > maxArgon2Params.Parallelism {
+		return false, fmt.Errorf("%w: parameters out of range", errInvalidHash)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > int(maxArgon2Params.KeyLength) {
+		return false, errInvalidHash
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+// dummyHash is verified for unknown users so that the response time does not reveal
+// whether a user exists
+var dummyHash = sync.OnceValue(func() string {
+	hash, err := HashPassword("dummy password", DefaultArgon2Params)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
@@ -1,44 +1,158 @@
 package traditional
 
 import (
-	"dbsc-demo/logging"
+	"bytes"
+	"html/template"
 	"net/http"
+	"strconv"
+	"time"
+
+	"dbsc-demo/csrf"
+	"dbsc-demo/logging"
+	"dbsc-demo/secheaders"
+	"dbsc-demo/static"
 )
 
 const (
 	EndpointHome     = "/"
 	EndpointLogin    = "/login"
+	EndpointLogout   = "/logout"
 	EndpointUserPage = "/userpage"
+
+	// CookieName is the name of the traditional session cookie
+	CookieName = "traditional_cookie"
 )
 
+// LoginHook is called after a successful login, before the response is written.
+// sessionID is the Cookie.SessionID of the new session. An error aborts the login.
+type LoginHook func(w http.ResponseWriter, r *http.Request, username string, sessionID string) error
+
+// LogoutHook is called when a session ends by logout or by a new login replacing it.
+// Errors are logged; the session is ended regardless.
+type LogoutHook func(w http.ResponseWriter, r *http.Request, username string, sessionID string) error
+
+// BoundSession is the device bound session of a request, shown on the user page
+type BoundSession struct {
+	ID              string
+	ExpiresAt       time.Time
+	CookieExpiresAt time.Time
+	RefreshCount    int
+}
+
+// BoundSessionResolver returns the device bound session of the request, if any
+type BoundSessionResolver func(r *http.Request) (*BoundSession, bool)
+
+var templates = template.Must(template.ParseFS(static.FS, "*.html"))
+
 type TraditionalServer struct {
-	sessionManager *SessionManager
+	SessionManager *SessionManager
+	Users          UserRepository
+	Lockout        *Lockout
+	// BoundSession is optional; without it the user page shows no device bound session
+	BoundSession BoundSessionResolver
+	// SecureCookie adds the Secure attribute to the session cookie. Set it when serving over HTTPS.
+	SecureCookie bool
+	// CSRF issues the tokens embedded in the login and logout forms. The POST endpoints have to
+	// be wrapped with CSRF.Handler.
+	CSRF        *csrf.Protection
+	loginHooks  []LoginHook
+	logoutHooks []LogoutHook
 }
 
+// NewTraditionalServer returns a server with an empty in-memory user repository
 func NewTraditionalServer() *TraditionalServer {
 	return &TraditionalServer{
-		sessionManager: NewSessionManager(),
+		SessionManager: NewSessionManager(),
+		Users:          NewMemoryUserRepository(),
+		Lockout:        NewLockout(),
+		CSRF:           csrf.New(),
+	}
+}
+
+// OnLogin registers a hook called after a successful login
+func (s *TraditionalServer) OnLogin(hook LoginHook) {
+	s.loginHooks = append(s.loginHooks, hook)
+}
+
+// OnLogout registers a hook called when a session ends
+func (s *TraditionalServer) OnLogout(hook LogoutHook) {
+	s.logoutHooks = append(s.logoutHooks, hook)
+}
+
+// CurrentUser returns the user and the session ID of the traditional session cookie
+func (s *TraditionalServer) CurrentUser(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return "", "", false
+	}
+	session, ok := s.SessionManager.GetCookie(cookie.Value)
+	if !ok {
+		return "", "", false
 	}
+	return session.Username, session.SessionID, true
 }
 
 func HomePageHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, EndpointUserPage, http.StatusFound)
 }
 
-func LoginPageHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "static/login.html")
+// Nonce in the page data is the CSP nonce of the inline scripts and styles
+type loginPageData struct {
+	CSRFToken string
+	Nonce     string
 }
 
-func UserPageHandler(w http.ResponseWriter, r *http.Request) {
+func (s *TraditionalServer) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := s.CSRF.Token(w, r)
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to issue CSRF token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	render(w, r, "login.html", loginPageData{CSRFToken: token, Nonce: secheaders.Nonce(r.Context())})
+}
+
+type userPageData struct {
+	User      string
+	Session   *BoundSession
+	CSRFToken string
+	Nonce     string
+}
+
+func (s *TraditionalServer) UserPageHandler(w http.ResponseWriter, r *http.Request) {
 	// Disable browser cache
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	http.ServeFile(w, r, "static/userpage.html")
+
+	var data userPageData
+	var err error
+	if data.CSRFToken, err = s.CSRF.Token(w, r); err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to issue CSRF token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data.Nonce = secheaders.Nonce(r.Context())
+	data.User, _, _ = s.CurrentUser(r)
+	if s.BoundSession != nil {
+		data.Session, _ = s.BoundSession(r)
+	}
+	render(w, r, "userpage.html", data)
+}
+
+// render executes a page template, buffering it so that errors can still be reported
+func render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to render page", "page", name, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
 }
 
 func (s *TraditionalServer) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	logging.Logger.Println("Attempting to log in")
 
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
@@ -53,35 +167,137 @@ func (s *TraditionalServer) LoginHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if username != "test" || password != "test" {
+	if locked := s.Lockout.Locked(username); locked > 0 {
+		logging.Logger.WarnContext(r.Context(), "login to locked account", "user", username)
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.Round(time.Second).Seconds())))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	authenticated, err := s.authenticate(username, password)
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to authenticate", "user", username, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !authenticated {
+		if s.Lockout.Fail(username) {
+			logging.Logger.WarnContext(r.Context(), "account locked after repeated login failures", "user", username)
+		} else {
+			logging.Logger.InfoContext(r.Context(), "login failed", "user", username)
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	s.Lockout.Reset(username)
+
+	// セッション固定攻撃を防ぐため、ログイン前のセッションは引き継がずに破棄し、常に新しい ID を発行する
+	s.endSession(w, r)
+
+	session, err := s.SessionManager.GenerateCookie(username)
+	if err != nil {
+		logging.Logger.ErrorContext(r.Context(), "failed to generate session cookie", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, hook := range s.loginHooks {
+		if err := hook(w, r, username, session.SessionID); err != nil {
+			logging.Logger.ErrorContext(r.Context(), "login hook failed", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	logging.Logger.InfoContext(r.Context(), "logged in", "user", username)
+
+	s.setSessionCookie(w, session)
 
-	sessionID := s.sessionManager.GenerateCookie().Value
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// LogoutHandler ends the session on the server and removes the cookie
+func (s *TraditionalServer) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if username, ok := s.endSession(w, r); ok {
+		logging.Logger.InfoContext(r.Context(), "logged out", "user", username)
+	}
+	s.clearSessionCookie(w)
+	http.Redirect(w, r, EndpointLogin, http.StatusSeeOther)
+}
 
+// endSession deletes the session of the request's cookie, if any, and runs the logout hooks
+func (s *TraditionalServer) endSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return "", false
+	}
+	session, ok := s.SessionManager.DeleteCookie(cookie.Value)
+	if !ok {
+		return "", false
+	}
+	for _, hook := range s.logoutHooks {
+		if err := hook(w, r, session.Username, session.SessionID); err != nil {
+			logging.Logger.ErrorContext(r.Context(), "logout hook failed", "error", err)
+		}
+	}
+	return session.Username, true
+}
+
+// setSessionCookie sets the cookie of session. The browser keeps it until the absolute timeout;
+// the idle timeout is enforced by the server.
+func (s *TraditionalServer) setSessionCookie(w http.ResponseWriter, session *Cookie) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "traditional_cookie",
-		Value:    sessionID,
+		Name:     CookieName,
+		Value:    session.Value,
+		Path:     "/",
+		MaxAge:   max(int(session.ExpiresAt.Sub(s.SessionManager.Clock.Now()).Seconds()), 1),
+		HttpOnly: true,
+		Secure:   s.SecureCookie,
 		SameSite: http.SameSiteLaxMode,
-		// MaxAge: 3600,
 	})
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+func (s *TraditionalServer) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// authenticate checks the password of a user. Unknown users take as long as wrong passwords.
+func (s *TraditionalServer) authenticate(username string, password string) (bool, error) {
+	user, exists, err := s.Users.FindUser(username)
+	if err != nil {
+		return false, err
+	}
+	hash := dummyHash()
+	if exists {
+		hash = user.PasswordHash
+	}
+	match, err := VerifyPassword(hash, password)
+	if err != nil {
+		return false, err
+	}
+	return exists && match, nil
 }
 
 func (s *TraditionalServer) VerifyCookieMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logging.Logger.Println("Verifying traditional session")
-		cookie, err := r.Cookie("traditional_cookie")
+		cookie, err := r.Cookie(CookieName)
 		if err != nil || cookie == nil {
 			w.Header().Set("Location", EndpointLogin)
 			http.Error(w, "Session cookie not found", http.StatusFound)
 			return
 		}
 
-		if !s.sessionManager.VerifyCookie(cookie.Value) {
+		if !s.SessionManager.VerifyCookie(cookie.Value) {
+			// 期限切れのクッキーはブラウザからも削除する
+			s.clearSessionCookie(w)
 			w.Header().Set("Location", EndpointLogin)
 			http.Error(w, "Invalid session cookie", http.StatusFound)
 			return
@@ -1,47 +1,129 @@
 package traditional
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
+	"io"
+	"sync"
 	"time"
 
-	"dbsc-demo/logging"
+	"dbsc-demo/clock"
+	"dbsc-demo/random"
 )
 
+// ErrSessionNotFound is returned for a cookie that is unknown or expired
+var ErrSessionNotFound = errors.New("session not found or expired")
+
 type SessionManager struct {
+	// IdleTimeout ends a session that has not been used for this long
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a session this long after login, however active it is
+	AbsoluteTimeout time.Duration
+	Clock           clock.Clock
+	Random          io.Reader
+
+	mu      sync.Mutex
 	cookies map[string]*Cookie
 }
 
 type Cookie struct {
-	Value     string
-	CreatedAt time.Time
+	Value string
+	// SessionID identifies the login session, so that other layers (DBSC) can refer to the
+	// login without knowing the cookie.
+	SessionID  string
+	Username   string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ExpiresAt is the absolute expiry; the session ends earlier when idle for IdleTimeout
 	ExpiresAt time.Time
 }
 
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
-		cookies: make(map[string]*Cookie),
+		IdleTimeout:     15 * time.Minute,
+		AbsoluteTimeout: 8 * time.Hour,
+		Clock:           clock.System,
+		Random:          random.System,
+		cookies:         make(map[string]*Cookie),
 	}
 }
 
-func (s *SessionManager) GenerateCookie() *Cookie {
+// GenerateCookie starts a new login session for username
+func (s *SessionManager) GenerateCookie(username string) (*Cookie, error) {
+	value, err := random.NewID(s.Random)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := random.NewID(s.Random)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Clock.Now()
 	cookie := &Cookie{
-		Value:     s.generateRandomID(),
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(5 * time.Minute),
+		Value:      value,
+		SessionID:  sessionID,
+		Username:   username,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.AbsoluteTimeout),
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneExpired(now)
 	s.cookies[cookie.Value] = cookie
-	logging.Logger.Printf("Generated traditional cookie: %s", cookie.Value)
-	return cookie
+	copied := *cookie
+	return &copied, nil
 }
 
 func (s *SessionManager) VerifyCookie(value string) bool {
+	_, ok := s.GetCookie(value)
+	return ok
+}
+
+// GetCookie returns the live session of the cookie value and records it as used,
+// which postpones the idle timeout
+func (s *SessionManager) GetCookie(value string) (*Cookie, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Clock.Now()
+	cookie, ok := s.live(value, now)
+	if !ok {
+		return nil, false
+	}
+	cookie.LastSeenAt = now
+	copied := *cookie
+	return &copied, true
+}
+
+// DeleteCookie ends the session of the cookie value and returns it if it was live
+func (s *SessionManager) DeleteCookie(value string) (*Cookie, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookie, ok := s.live(value, s.Clock.Now())
+	delete(s.cookies, value)
+	if !ok {
+		return nil, false
+	}
+	return cookie, true
+}
+
+// live returns the session of value if neither timeout has passed. s.mu must be held.
+func (s *SessionManager) live(value string, now time.Time) (*Cookie, bool) {
 	cookie, exists := s.cookies[value]
-	return exists && time.Now().Before(cookie.ExpiresAt)
+	if !exists || !s.alive(cookie, now) {
+		return nil, false
+	}
+	return cookie, true
+}
+
+func (s *SessionManager) alive(cookie *Cookie, now time.Time) bool {
+	return now.Before(cookie.ExpiresAt) && now.Before(cookie.LastSeenAt.Add(s.IdleTimeout))
 }
 
-func (s *SessionManager) generateRandomID() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return base64.URLEncoding.EncodeToString(bytes)
+// pruneExpired forgets the ended sessions. s.mu must be held.
+func (s *SessionManager) pruneExpired(now time.Time) {
+	for value, cookie := range s.cookies {
+		if !s.alive(cookie, now) {
+			delete(s.cookies, value)
+		}
+	}
 }
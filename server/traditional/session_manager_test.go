@@ -0,0 +1,69 @@
+package traditional_test
+
+import (
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/traditional"
+)
+
+func newTestSessionManager() (*traditional.SessionManager, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	manager := traditional.NewSessionManager()
+	manager.Clock = fake
+	manager.IdleTimeout = 10 * time.Minute
+	manager.AbsoluteTimeout = time.Hour
+	return manager, fake
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	manager, fake := newTestSessionManager()
+	idle, err := manager.GenerateCookie("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := manager.GenerateCookie("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 使われているセッションはアイドルタイムアウトが延長される
+	for elapsed := time.Duration(0); elapsed < 50*time.Minute; elapsed += 5 * time.Minute {
+		fake.Advance(5 * time.Minute)
+		if !manager.VerifyCookie(active.Value) {
+			t.Fatalf("active session ended after %v", elapsed)
+		}
+	}
+	if manager.VerifyCookie(idle.Value) {
+		t.Error("idle session still valid")
+	}
+
+	// 絶対タイムアウトは使用中でも延長されない
+	fake.Advance(9 * time.Minute)
+	if !manager.VerifyCookie(active.Value) {
+		t.Fatal("active session ended before the absolute timeout")
+	}
+	fake.Advance(time.Minute)
+	if manager.VerifyCookie(active.Value) {
+		t.Error("session valid after the absolute timeout")
+	}
+}
+
+func TestDeleteCookie(t *testing.T) {
+	manager, _ := newTestSessionManager()
+	cookie, err := manager.GenerateCookie("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, ok := manager.DeleteCookie(cookie.Value)
+	if !ok || deleted.SessionID != cookie.SessionID || deleted.Username != "alice" {
+		t.Errorf("DeleteCookie = %+v, %v", deleted, ok)
+	}
+	if manager.VerifyCookie(cookie.Value) {
+		t.Error("deleted session still valid")
+	}
+	if _, ok := manager.DeleteCookie(cookie.Value); ok {
+		t.Error("deleted twice")
+	}
+}
@@ -0,0 +1,177 @@
+package traditional
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrUserExists is returned by AddUser when the name is taken
+var ErrUserExists = errors.New("user already exists")
+
+// User is an account of the traditional login
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+}
+
+// UserRepository stores the accounts of the traditional login
+type UserRepository interface {
+	FindUser(name string) (*User, bool, error)
+	AddUser(user *User) error
+	CountUsers() (int, error)
+}
+
+// MemoryUserRepository keeps the accounts in memory
+type MemoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: make(map[string]User)}
+}
+
+func (r *MemoryUserRepository) FindUser(name string) (*User, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, exists := r.users[name]
+	if !exists {
+		return nil, false, nil
+	}
+	return &user, true, nil
+}
+
+func (r *MemoryUserRepository) AddUser(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.users[user.Name]; exists {
+		return ErrUserExists
+	}
+	r.users[user.Name] = *user
+	return nil
+}
+
+func (r *MemoryUserRepository) CountUsers() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.users), nil
+}
+
+// FileUserRepository keeps the accounts in a JSON file, rewritten atomically on every change
+type FileUserRepository struct {
+	path string
+
+	mu     sync.Mutex
+	memory *MemoryUserRepository
+}
+
+type userFile struct {
+	Users []User `json:"users"`
+}
+
+// OpenFileUserRepository loads the accounts of path. A missing file is an empty repository.
+func OpenFileUserRepository(path string) (*FileUserRepository, error) {
+	r := &FileUserRepository{path: path, memory: NewMemoryUserRepository()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file userFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, user := range file.Users {
+		if err := r.memory.AddUser(&user); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, user.Name, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *FileUserRepository) FindUser(name string) (*User, bool, error) {
+	return r.memory.FindUser(name)
+}
+
+func (r *FileUserRepository) CountUsers() (int, error) {
+	return r.memory.CountUsers()
+}
+
+func (r *FileUserRepository) AddUser(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.memory.AddUser(user); err != nil {
+		return err
+	}
+	if err := r.save(); err != nil {
+		r.memory.mu.Lock()
+		delete(r.memory.users, user.Name)
+		r.memory.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// save writes the accounts to a temporary file and renames it over the repository file. r.mu must be held.
+func (r *FileUserRepository) save() error {
+	r.memory.mu.Lock()
+	file := userFile{Users: make([]User, 0, len(r.memory.users))}
+	for _, user := range r.memory.users {
+		file.Users = append(file.Users, user)
+	}
+	r.memory.mu.Unlock()
+	slices.SortFunc(file.Users, func(a, b User) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// AddUserWithPassword hashes password and adds the user to repository
+func AddUserWithPassword(repository UserRepository, name string, password string) error {
+	if name == "" || password == "" {
+		return errors.New("user name and password are required")
+	}
+	hash, err := HashPassword(password, DefaultArgon2Params)
+	if err != nil {
+		return err
+	}
+	return repository.AddUser(&User{Name: name, PasswordHash: hash})
+}
+
+// SeedDemoUser adds the test/test account when repository has no users, so that the demo
+// works out of the box. It reports whether the account was added. It only takes the in-memory
+// repository so that the well-known password is never written to a user file.
+func SeedDemoUser(repository *MemoryUserRepository) (bool, error) {
+	count, err := repository.CountUsers()
+	if err != nil || count > 0 {
+		return false, err
+	}
+	return true, AddUserWithPassword(repository, "test", "test")
+}
@@ -0,0 +1,144 @@
+package traditional_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dbsc-demo/clock"
+	"dbsc-demo/server/traditional"
+)
+
+// テストを速くするため小さいパラメータを使う
+var testParams = traditional.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestPassword(t *testing.T) {
+	hash, err := traditional.HashPassword("secret", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash = %q", hash)
+	}
+	if other, _ := traditional.HashPassword("secret", testParams); other == hash {
+		t.Error("hashes of the same password are equal, salt not random")
+	}
+
+	for _, tc := range []struct {
+		password string
+		want     bool
+	}{
+		{"secret", true},
+		{"Secret", false},
+		{"", false},
+	} {
+		if got, err := traditional.VerifyPassword(hash, tc.password); err != nil || got != tc.want {
+			t.Errorf("VerifyPassword(%q) = %v, %v, want %v", tc.password, got, err, tc.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"", "secret", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=64,t=1,p=1$!!$a2V5", "$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		// 上限を超えるパラメータは計算する前に拒否する
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=64,t=1000,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=255$c2FsdA$a2V5", "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + strings.Repeat("a2V5", 100),
+	} {
+		if _, err := traditional.VerifyPassword(invalid, "secret"); err == nil {
+			t.Errorf("VerifyPassword(%q) accepted an invalid hash", invalid)
+		}
+	}
+}
+
+func TestFileUserRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := traditional.OpenFileUserRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := traditional.AddUserWithPassword(users, "bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := traditional.AddUserWithPassword(users, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := traditional.AddUserWithPassword(users, "alice", "other"); !errors.Is(err, traditional.ErrUserExists) {
+		t.Errorf("duplicate user error = %v, want ErrUserExists", err)
+	}
+
+	// 開き直しても残っている
+	reopened, err := traditional.OpenFileUserRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := reopened.CountUsers(); count != 2 {
+		t.Errorf("users after reopen = %d, want 2", count)
+	}
+	user, ok, err := reopened.FindUser("alice")
+	if err != nil || !ok {
+		t.Fatalf("alice not found: %v", err)
+	}
+	if valid, err := traditional.VerifyPassword(user.PasswordHash, "secret"); err != nil || !valid {
+		t.Errorf("password of alice not verified: %v", err)
+	}
+	if _, ok, _ := reopened.FindUser("carol"); ok {
+		t.Error("unknown user found")
+	}
+}
+
+func TestSeedDemoUser(t *testing.T) {
+	users := traditional.NewMemoryUserRepository()
+	if seeded, err := traditional.SeedDemoUser(users); err != nil || !seeded {
+		t.Fatalf("SeedDemoUser = %v, %v", seeded, err)
+	}
+	if _, ok, _ := users.FindUser("test"); !ok {
+		t.Error("demo user not added")
+	}
+	if seeded, _ := traditional.SeedDemoUser(users); seeded {
+		t.Error("demo user seeded into a non-empty repository")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	lockout := traditional.NewLockout()
+	lockout.Clock = fake
+	lockout.MaxFailures = 3
+
+	for i := 1; i < 3; i++ {
+		if lockout.Fail("alice") {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+	// 成功すると数え直す
+	lockout.Reset("alice")
+	lockout.Fail("alice")
+	lockout.Fail("alice")
+	if lockout.Locked("alice") != 0 {
+		t.Fatal("locked before MaxFailures")
+	}
+	if !lockout.Fail("alice") {
+		t.Fatal("not locked after MaxFailures")
+	}
+	if locked := lockout.Locked("alice"); locked != lockout.LockoutDuration {
+		t.Errorf("Locked = %v, want %v", locked, lockout.LockoutDuration)
+	}
+	if lockout.Locked("bob") != 0 {
+		t.Error("another user is locked")
+	}
+
+	fake.Advance(lockout.LockoutDuration)
+	if locked := lockout.Locked("alice"); locked != 0 {
+		t.Errorf("Locked after the lockout = %v, want 0", locked)
+	}
+
+	// 間隔の空いた失敗は数えない
+	lockout.Fail("bob")
+	lockout.Fail("bob")
+	fake.Advance(lockout.LockoutDuration + time.Second)
+	if lockout.Fail("bob") {
+		t.Error("stale failures counted")
+	}
+}
@@ -0,0 +1,8 @@
+// Package static holds the HTML pages of the demo, embedded into the binary so that the
+// server does not depend on its working directory.
+package static
+
+import "embed"
+
+//go:embed *.html
+var FS embed.FS
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"dbsc-demo/server/traditional"
+)
+
+// runUserAdd implements "useradd -users-file path name". The password is read from the
+// first line of stdin so that it does not appear in the process list or shell history.
+// The users file has no default, like the server's, whose users are in memory without one.
+func runUserAdd(args []string, stdin io.Reader, stderr io.Writer) error {
+	flags := flag.NewFlagSet("useradd", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	usersFile := flags.String("users-file", "", "user file to add the account to (the server's -users-file)")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: dbsc-demo useradd -users-file path name < password")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *usersFile == "" {
+		flags.Usage()
+		return errors.New("useradd: -users-file required")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("useradd: user name required")
+	}
+	name := flags.Arg(0)
+
+	fmt.Fprintf(stderr, "password for %s: ", name)
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("useradd: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	users, err := traditional.OpenFileUserRepository(*usersFile)
+	if err != nil {
+		return fmt.Errorf("useradd: %w", err)
+	}
+	if err := traditional.AddUserWithPassword(users, name, password); err != nil {
+		return fmt.Errorf("useradd: %s: %w", name, err)
+	}
+	fmt.Fprintf(stderr, "\nadded %s to %s\n", name, *usersFile)
+	return nil
+}